@@ -0,0 +1,496 @@
+package clients
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxCacheEntrySize 超过这个长度的响应不缓存
+const maxCacheEntrySize = 4 << 20
+
+// CacheHeader 响应来自缓存时带上的头，值为 hit 或者 revalidated
+const CacheHeader = "X-Haruno-Cache"
+
+// CacheEntry 缓存的响应
+type CacheEntry struct {
+	StatusCode int         `json:"statusCode"`
+	Status     string      `json:"status"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body"`
+	// Expires 过期之前直接使用缓存，过期后发送条件请求
+	Expires time.Time `json:"expires"`
+	// Vary 响应的 Vary 列出的请求头在请求中的值，不一致时不使用缓存
+	Vary map[string]string `json:"vary,omitempty"`
+}
+
+// varyValues 响应的 Vary 列出的请求头在请求中的值
+func varyValues(req *http.Request, res http.Header) map[string]string {
+	var values map[string]string
+	for _, v := range res["Vary"] {
+		for _, name := range strings.Split(v, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+			if values == nil {
+				values = make(map[string]string)
+			}
+			values[name] = strings.Join(req.Header[name], ",")
+		}
+	}
+	return values
+}
+
+// matchVary 请求和缓存时的请求的 Vary 请求头是否一致
+func (e *CacheEntry) matchVary(req *http.Request) bool {
+	for name, value := range e.Vary {
+		if strings.Join(req.Header[name], ",") != value {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *CacheEntry) size() int64 {
+	size := int64(len(e.Body))
+	for k, v := range e.Header {
+		size += int64(len(k))
+		for _, s := range v {
+			size += int64(len(s))
+		}
+	}
+	return size
+}
+
+// CacheStore 缓存的存储后端
+type CacheStore interface {
+	Get(key string) (*CacheEntry, bool)
+	Set(key string, entry *CacheEntry)
+	Delete(key string)
+	// Size 缓存的数量和总长度
+	Size() (entries int, bytes int64)
+}
+
+// CacheStats 缓存的统计
+type CacheStats struct {
+	// Hits 没有过期，直接使用缓存
+	Hits int64 `json:"hits"`
+	// Revalidated 条件请求返回 304，使用缓存
+	Revalidated int64 `json:"revalidated"`
+	// Misses 没有缓存或者缓存已经改变
+	Misses  int64 `json:"misses"`
+	Entries int   `json:"entries"`
+	Bytes   int64 `json:"bytes"`
+}
+
+type cacheCounter struct {
+	hits        int64
+	revalidated int64
+	misses      int64
+}
+
+// CacheStats 缓存的统计，没有开启缓存时全为 0
+func (c *HTTPClient) CacheStats() CacheStats {
+	stats := CacheStats{
+		Hits:        atomic.LoadInt64(&c.cacheCounter.hits),
+		Revalidated: atomic.LoadInt64(&c.cacheCounter.revalidated),
+		Misses:      atomic.LoadInt64(&c.cacheCounter.misses),
+	}
+	if c.Cache != nil {
+		stats.Entries, stats.Bytes = c.Cache.Size()
+	}
+	return stats
+}
+
+// cacheControl 解析 Cache-Control
+func cacheControl(h http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, part := range strings.Split(h.Get("Cache-Control"), ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		key := strings.ToLower(strings.TrimSpace(kv[0]))
+		if len(kv) == 2 {
+			directives[key] = strings.Trim(strings.TrimSpace(kv[1]), `"`)
+		} else {
+			directives[key] = ""
+		}
+	}
+	return directives
+}
+
+// cacheableRequest 只缓存没有 Range 和 no-store 的 GET 请求
+func cacheableRequest(req *http.Request) bool {
+	if req.Method != http.MethodGet || req.Header.Get("Range") != "" {
+		return false
+	}
+	_, noStore := cacheControl(req.Header)["no-store"]
+	return !noStore
+}
+
+// expiresAt 根据响应头计算过期时间
+// 没有 max-age 和 Expires 时立即过期，之后每次都发送条件请求
+func expiresAt(h http.Header, now time.Time) time.Time {
+	cc := cacheControl(h)
+	if _, ok := cc["no-cache"]; ok {
+		return now
+	}
+	if v, ok := cc["max-age"]; ok {
+		if sec, err := strconv.Atoi(v); err == nil {
+			age, _ := strconv.Atoi(h.Get("Age"))
+			return now.Add(time.Duration(sec-age) * time.Second)
+		}
+	}
+	if t, err := http.ParseTime(h.Get("Expires")); err == nil {
+		return t
+	}
+	return now
+}
+
+// storable 响应是否可以缓存，Vary: * 的响应不缓存
+func storable(res *http.Response) bool {
+	if res.StatusCode != http.StatusOK {
+		return false
+	}
+	for _, v := range res.Header["Vary"] {
+		if strings.TrimSpace(v) == "*" {
+			return false
+		}
+	}
+	if _, ok := cacheControl(res.Header)["no-store"]; ok {
+		return false
+	}
+	return res.Header.Get("ETag") != "" || res.Header.Get("Last-Modified") != "" ||
+		expiresAt(res.Header, time.Now()).After(time.Now())
+}
+
+// cachedResponse 用缓存构造响应
+func cachedResponse(req *http.Request, entry *CacheEntry, state string) *http.Response {
+	header := cloneHeader(entry.Header)
+	header.Set(CacheHeader, state)
+	return &http.Response{
+		Status:        entry.Status,
+		StatusCode:    entry.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(entry.Body)),
+		ContentLength: int64(len(entry.Body)),
+		Request:       req,
+	}
+}
+
+// cacheKey 缓存的键，带有身份信息（Authorization、Cookie 和 Jar 中的 cookie）时加上它们的哈希
+// 不同身份的请求不会使用同一个缓存
+func (c *HTTPClient) cacheKey(req *http.Request) string {
+	key := req.URL.String()
+	hash := sha1.New()
+	credentials := false
+	for _, name := range []string{"Authorization", "Cookie"} {
+		for _, v := range req.Header[name] {
+			io.WriteString(hash, name+": "+v+"\n")
+			credentials = true
+		}
+	}
+	if c.Jar != nil {
+		for _, cookie := range c.Jar.Cookies(req.URL) {
+			io.WriteString(hash, "Jar: "+cookie.Name+"="+cookie.Value+"\n")
+			credentials = true
+		}
+	}
+	if credentials {
+		key += "#" + hex.EncodeToString(hash.Sum(nil))
+	}
+	return key
+}
+
+// doCached 使用缓存发送请求
+func (c *HTTPClient) doCached(req *http.Request) (*http.Response, error) {
+	key := c.cacheKey(req)
+	entry, ok := c.Cache.Get(key)
+	if ok && !entry.matchVary(req) {
+		// Vary 的请求头不一致，当作没有缓存，新的响应会覆盖它
+		entry, ok = nil, false
+	}
+	if ok && time.Now().Before(entry.Expires) {
+		atomic.AddInt64(&c.cacheCounter.hits, 1)
+		return cachedResponse(req, entry, "hit"), nil
+	}
+	if ok {
+		req = req.WithContext(req.Context())
+		req.Header = cloneHeader(req.Header)
+		if etag := entry.Header.Get("ETag"); etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		if modified := entry.Header.Get("Last-Modified"); modified != "" {
+			req.Header.Set("If-Modified-Since", modified)
+		}
+	}
+	res, err := c.doRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	if ok && res.StatusCode == http.StatusNotModified {
+		res.Body.Close()
+		atomic.AddInt64(&c.cacheCounter.revalidated, 1)
+		// 使用新的响应头更新缓存
+		for k, v := range res.Header {
+			entry.Header[k] = v
+		}
+		entry.Expires = expiresAt(res.Header, time.Now())
+		c.Cache.Set(key, entry)
+		return cachedResponse(req, entry, "revalidated"), nil
+	}
+	atomic.AddInt64(&c.cacheCounter.misses, 1)
+	if !storable(res) {
+		if ok {
+			c.Cache.Delete(key)
+		}
+		return res, nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, maxCacheEntrySize+1))
+	if err != nil {
+		res.Body.Close()
+		return nil, err
+	}
+	if len(body) > maxCacheEntrySize {
+		// 太大了不缓存，把读出来的部分接回去
+		res.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), res.Body), res.Body}
+		return res, nil
+	}
+	res.Body.Close()
+	c.Cache.Set(key, &CacheEntry{
+		StatusCode: res.StatusCode,
+		Status:     res.Status,
+		Header:     cloneHeader(res.Header),
+		Body:       body,
+		Expires:    expiresAt(res.Header, time.Now()),
+		Vary:       varyValues(req, res.Header),
+	})
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return res, nil
+}
+
+// MemoryCache 内存中的缓存，超过总长度时淘汰最久没有使用的
+type MemoryCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	bytes    int64
+	order    *list.List
+	entries  map[string]*list.Element
+}
+
+type memoryItem struct {
+	key   string
+	entry *CacheEntry
+	size  int64
+}
+
+// NewMemoryCache 创建内存缓存，maxBytes 为总长度的上限
+func NewMemoryCache(maxBytes int64) *MemoryCache {
+	return &MemoryCache{
+		maxBytes: maxBytes,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// Get 读取缓存
+func (m *MemoryCache) Get(key string) (*CacheEntry, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	el, ok := m.entries[key]
+	if !ok {
+		return nil, false
+	}
+	m.order.MoveToFront(el)
+	entry := *el.Value.(*memoryItem).entry
+	entry.Header = cloneHeader(entry.Header)
+	return &entry, true
+}
+
+// Set 写入缓存
+func (m *MemoryCache) Set(key string, entry *CacheEntry) {
+	size := entry.size()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.removeLocked(key)
+	if size > m.maxBytes {
+		return
+	}
+	m.entries[key] = m.order.PushFront(&memoryItem{key: key, entry: entry, size: size})
+	m.bytes += size
+	for m.bytes > m.maxBytes {
+		m.removeLocked(m.order.Back().Value.(*memoryItem).key)
+	}
+}
+
+// Delete 删除缓存
+func (m *MemoryCache) Delete(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.removeLocked(key)
+}
+
+func (m *MemoryCache) removeLocked(key string) {
+	el, ok := m.entries[key]
+	if !ok {
+		return
+	}
+	m.order.Remove(el)
+	delete(m.entries, key)
+	m.bytes -= el.Value.(*memoryItem).size
+}
+
+// Size 缓存的数量和总长度
+func (m *MemoryCache) Size() (int, int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.entries), m.bytes
+}
+
+// DiskCache 磁盘上的缓存，每个响应一个文件，超过总长度时淘汰最久没有使用的
+type DiskCache struct {
+	mu       sync.Mutex
+	dir      string
+	maxBytes int64
+	bytes    int64
+	sizes    map[string]int64
+}
+
+// NewDiskCache 创建磁盘缓存，dir 为缓存目录，maxBytes 为总长度的上限
+func NewDiskCache(dir string, maxBytes int64) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	d := &DiskCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		sizes:    make(map[string]int64),
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), ".cache") {
+			d.sizes[file.Name()] = file.Size()
+			d.bytes += file.Size()
+		}
+	}
+	d.evictLocked()
+	return d, nil
+}
+
+func (d *DiskCache) filename(key string) string {
+	sum := sha1.Sum([]byte(key))
+	return hex.EncodeToString(sum[:]) + ".cache"
+}
+
+// Get 读取缓存
+func (d *DiskCache) Get(key string) (*CacheEntry, bool) {
+	name := d.filename(key)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.sizes[name]; !ok {
+		return nil, false
+	}
+	file := path.Join(d.dir, name)
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, false
+	}
+	entry := new(CacheEntry)
+	if err := json.Unmarshal(raw, entry); err != nil {
+		return nil, false
+	}
+	// 用修改时间记录最近使用的时间
+	now := time.Now()
+	os.Chtimes(file, now, now)
+	return entry, true
+}
+
+// Set 写入缓存
+func (d *DiskCache) Set(key string, entry *CacheEntry) {
+	raw, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	name := d.filename(key)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.removeLocked(name)
+	if int64(len(raw)) > d.maxBytes {
+		return
+	}
+	if err := ioutil.WriteFile(path.Join(d.dir, name), raw, 0644); err != nil {
+		return
+	}
+	d.sizes[name] = int64(len(raw))
+	d.bytes += int64(len(raw))
+	d.evictLocked()
+}
+
+// Delete 删除缓存
+func (d *DiskCache) Delete(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.removeLocked(d.filename(key))
+}
+
+func (d *DiskCache) removeLocked(name string) {
+	size, ok := d.sizes[name]
+	if !ok {
+		return
+	}
+	os.Remove(path.Join(d.dir, name))
+	delete(d.sizes, name)
+	d.bytes -= size
+}
+
+// evictLocked 超过总长度时按修改时间淘汰
+func (d *DiskCache) evictLocked() {
+	if d.bytes <= d.maxBytes {
+		return
+	}
+	files, err := ioutil.ReadDir(d.dir)
+	if err != nil {
+		return
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+	for _, file := range files {
+		if d.bytes <= d.maxBytes {
+			return
+		}
+		d.removeLocked(file.Name())
+	}
+}
+
+// Size 缓存的数量和总长度
+func (d *DiskCache) Size() (int, int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.sizes), d.bytes
+}
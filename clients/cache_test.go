@@ -0,0 +1,106 @@
+package clients
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+)
+
+func TestMemoryCacheLRU(t *testing.T) {
+	entry := func(n int) *CacheEntry {
+		return &CacheEntry{Body: make([]byte, n)}
+	}
+	m := NewMemoryCache(100)
+	m.Set("a", entry(40))
+	m.Set("b", entry(40))
+	// 读取后 a 变成最近使用的
+	if _, ok := m.Get("a"); !ok {
+		t.Fatal("a should be cached")
+	}
+	m.Set("c", entry(40))
+	if _, ok := m.Get("b"); ok {
+		t.Error("b is the least recently used and should be evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := m.Get(key); !ok {
+			t.Errorf("%s should be cached", key)
+		}
+	}
+	if entries, bytes := m.Size(); entries != 2 || bytes != 80 {
+		t.Errorf("size = %d entries, %d bytes", entries, bytes)
+	}
+	// 超过总长度的不缓存
+	m.Set("d", entry(200))
+	if _, ok := m.Get("d"); ok {
+		t.Error("entry larger than the cache should not be stored")
+	}
+	m.Delete("a")
+	if entries, bytes := m.Size(); entries != 1 || bytes != 40 {
+		t.Errorf("size after delete = %d entries, %d bytes", entries, bytes)
+	}
+}
+
+func TestCacheKeyCredentials(t *testing.T) {
+	c := NewHTTPClient()
+	newReq := func(header, value string) *http.Request {
+		req, _ := c.NewRequest(http.MethodGet, "http://example.com/feed", nil)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		return req
+	}
+	anonymous := c.cacheKey(newReq("", ""))
+	if anonymous != "http://example.com/feed" {
+		t.Errorf("anonymous key = %s", anonymous)
+	}
+	alice := c.cacheKey(newReq("Authorization", "Bearer alice"))
+	bob := c.cacheKey(newReq("Authorization", "Bearer bob"))
+	if alice == anonymous || alice == bob {
+		t.Error("requests with different credentials should not share a key")
+	}
+	if c.cacheKey(newReq("Cookie", "session=1")) == anonymous {
+		t.Error("cookie header should be part of the key")
+	}
+	u, _ := url.Parse("http://example.com/")
+	c.Jar.SetCookies(u, []*http.Cookie{{Name: "session", Value: "2"}})
+	if c.cacheKey(newReq("", "")) == anonymous {
+		t.Error("cookies in the jar should be part of the key")
+	}
+}
+
+func TestCacheVary(t *testing.T) {
+	var requests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Language")
+		fmt.Fprint(w, r.Header.Get("Accept-Language"))
+	}))
+	defer server.Close()
+	c := NewHTTPClient()
+	c.Cache = NewMemoryCache(1 << 20)
+	get := func(lang string) string {
+		req, _ := c.NewRequest(http.MethodGet, server.URL, nil)
+		req.Header.Set("Accept-Language", lang)
+		res, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		return string(body)
+	}
+	if body := get("en"); body != "en" {
+		t.Fatalf("got %s", body)
+	}
+	if body := get("en"); body != "en" || atomic.LoadInt64(&requests) != 1 {
+		t.Fatalf("second request should hit the cache, got %s after %d requests", body, requests)
+	}
+	if body := get("ja"); body != "ja" {
+		t.Fatalf("different Accept-Language should not use the cache, got %s", body)
+	}
+}
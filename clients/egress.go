@@ -0,0 +1,248 @@
+package clients
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 出站限制的错误
+var (
+	// ErrHostNotAllowed 访问的域名不在允许的列表中
+	ErrHostNotAllowed = errors.New("egress: host is not allowed")
+	// ErrQuotaExceeded 超过每分钟的请求数量
+	ErrQuotaExceeded = errors.New("egress: request quota exceeded")
+	// ErrResponseTooLarge 响应超过最大长度
+	ErrResponseTooLarge = errors.New("egress: response is too large")
+)
+
+// egressError 违反出站限制的错误，不需要重试
+func egressError(err error) bool {
+	err = unwrapEgress(err)
+	return err == ErrHostNotAllowed || err == ErrQuotaExceeded || err == ErrResponseTooLarge
+}
+
+// unwrapEgress http.Client 把 Transport 返回的错误包装在 url.Error 中，违反出站限制时取出原来的错误
+func unwrapEgress(err error) error {
+	if e, ok := err.(*url.Error); ok {
+		switch e.Err {
+		case ErrHostNotAllowed, ErrQuotaExceeded, ErrResponseTooLarge:
+			return e.Err
+		}
+	}
+	return err
+}
+
+// EgressPolicy 客户端的出站限制
+type EgressPolicy struct {
+	// AllowHosts 允许访问的域名，*.example.com 匹配所有子域名，为空时不限制
+	AllowHosts []string `toml:"allowHosts"`
+	// Quota 每分钟的请求数量（包括重试和重定向），为 0 时不限制
+	Quota int `toml:"quota"`
+	// MaxResponseSize 响应的最大长度（字节），为 0 时不限制
+	MaxResponseSize int64 `toml:"maxResponseSize"`
+}
+
+// EgressStats 出站请求的统计
+type EgressStats struct {
+	// Requests 发出的请求数量
+	Requests int64 `json:"requests"`
+	// Denied 域名不允许被拒绝的请求数量
+	Denied int64 `json:"denied"`
+	// Throttled 超过配额被拒绝的请求数量
+	Throttled int64 `json:"throttled"`
+	// Oversize 响应过大被中断的数量
+	Oversize int64 `json:"oversize"`
+	// BytesIn 读取的响应长度
+	BytesIn int64 `json:"bytesIn"`
+}
+
+type egressCounter struct {
+	requests  int64
+	denied    int64
+	throttled int64
+	oversize  int64
+	bytesIn   int64
+}
+
+// egress 出站限制的状态
+type egress struct {
+	policy EgressPolicy
+	mu     sync.Mutex
+	window time.Time
+	count  int
+}
+
+// allowHost 检查域名（不包括端口）
+func (e *egress) allowHost(host string) bool {
+	if len(e.policy.AllowHosts) == 0 {
+		return true
+	}
+	host = strings.ToLower(host)
+	for _, pattern := range e.policy.AllowHosts {
+		pattern = strings.ToLower(pattern)
+		if strings.HasPrefix(pattern, "*.") {
+			if strings.HasSuffix(host, pattern[1:]) {
+				return true
+			}
+			continue
+		}
+		if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// take 取一次配额，按自然分钟计数
+func (e *egress) take() bool {
+	if e.policy.Quota <= 0 {
+		return true
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	now := time.Now()
+	if now.Sub(e.window) >= time.Minute {
+		e.window = now
+		e.count = 0
+	}
+	if e.count >= e.policy.Quota {
+		return false
+	}
+	e.count++
+	return true
+}
+
+// SetEgress 设置出站限制，需要在发送请求之前调用
+// 限制在客户端的 Transport 中检查，直接调用 Client.Do 以及重定向的请求同样检查域名和配额
+// 出站限制只是约定，不是沙箱：插件和主程序在同一个进程中，替换 Transport、
+// 使用 DefaultHTTPClient 或者直接使用 net/http 都可以绕过限制
+func (c *HTTPClient) SetEgress(policy EgressPolicy) {
+	c.egress = &egress{policy: policy}
+}
+
+// egressTransport 每次发出请求前检查出站限制，并统计响应的长度
+type egressTransport struct {
+	client *HTTPClient
+	base   http.RoundTripper
+}
+
+func (t *egressTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.client.checkEgress(req); err != nil {
+		// RoundTripper 需要关闭请求的 body
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	res, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.client.limitResponse(req, res); err != nil {
+		res.Body.Close()
+		return nil, err
+	}
+	return res, nil
+}
+
+// CloseIdleConnections 关闭底层 Transport 的空闲连接
+func (t *egressTransport) CloseIdleConnections() {
+	if ci, ok := t.base.(interface{ CloseIdleConnections() }); ok {
+		ci.CloseIdleConnections()
+	}
+}
+
+// EgressStats 出站请求的统计
+func (c *HTTPClient) EgressStats() EgressStats {
+	return EgressStats{
+		Requests:  atomic.LoadInt64(&c.egressCounter.requests),
+		Denied:    atomic.LoadInt64(&c.egressCounter.denied),
+		Throttled: atomic.LoadInt64(&c.egressCounter.throttled),
+		Oversize:  atomic.LoadInt64(&c.egressCounter.oversize),
+		BytesIn:   atomic.LoadInt64(&c.egressCounter.bytesIn),
+	}
+}
+
+// violate 记录违反出站限制的请求
+func (c *HTTPClient) violate(req *http.Request, err error) error {
+	if c.OnViolation != nil {
+		c.OnViolation(req, err)
+	}
+	return err
+}
+
+// checkEgress 发出请求前检查域名和配额
+func (c *HTTPClient) checkEgress(req *http.Request) error {
+	e := c.egress
+	if e == nil {
+		atomic.AddInt64(&c.egressCounter.requests, 1)
+		return nil
+	}
+	if !e.allowHost(req.URL.Hostname()) {
+		atomic.AddInt64(&c.egressCounter.denied, 1)
+		return c.violate(req, ErrHostNotAllowed)
+	}
+	if !e.take() {
+		atomic.AddInt64(&c.egressCounter.throttled, 1)
+		return c.violate(req, ErrQuotaExceeded)
+	}
+	atomic.AddInt64(&c.egressCounter.requests, 1)
+	return nil
+}
+
+// limitResponse 限制响应的长度
+func (c *HTTPClient) limitResponse(req *http.Request, res *http.Response) error {
+	max := int64(-1)
+	if c.egress != nil && c.egress.policy.MaxResponseSize > 0 {
+		max = c.egress.policy.MaxResponseSize
+	}
+	if max >= 0 && res.ContentLength > max {
+		atomic.AddInt64(&c.egressCounter.oversize, 1)
+		return c.violate(req, ErrResponseTooLarge)
+	}
+	res.Body = &egressBody{ReadCloser: res.Body, client: c, req: req, remain: max}
+	return nil
+}
+
+// egressBody 统计读取的长度，超过最大长度时返回 ErrResponseTooLarge
+type egressBody struct {
+	io.ReadCloser
+	client *HTTPClient
+	req    *http.Request
+	// remain 还可以读取的长度，小于 0 时不限制
+	remain   int64
+	exceeded bool
+}
+
+func (b *egressBody) Read(p []byte) (int, error) {
+	if b.exceeded {
+		return 0, ErrResponseTooLarge
+	}
+	if b.remain < 0 {
+		n, err := b.ReadCloser.Read(p)
+		atomic.AddInt64(&b.client.egressCounter.bytesIn, int64(n))
+		return n, err
+	}
+	// 多读一个字节判断是否超过长度
+	if int64(len(p)) > b.remain+1 {
+		p = p[:b.remain+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) > b.remain {
+		n = int(b.remain)
+		b.remain = 0
+		b.exceeded = true
+		atomic.AddInt64(&b.client.egressCounter.bytesIn, int64(n))
+		atomic.AddInt64(&b.client.egressCounter.oversize, 1)
+		return n, b.client.violate(b.req, ErrResponseTooLarge)
+	}
+	b.remain -= int64(n)
+	atomic.AddInt64(&b.client.egressCounter.bytesIn, int64(n))
+	return n, err
+}
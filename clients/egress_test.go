@@ -0,0 +1,117 @@
+package clients
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestAllowHost(t *testing.T) {
+	e := &egress{policy: EgressPolicy{AllowHosts: []string{"api.example.com", "*.Twimg.com"}}}
+	cases := []struct {
+		host string
+		want bool
+	}{
+		{"api.example.com", true},
+		{"API.Example.com", true},
+		{"example.com", false},
+		{"www.api.example.com", false},
+		{"pbs.twimg.com", true},
+		{"a.b.twimg.com", true},
+		{"twimg.com", false},
+		{"eviltwimg.com", false},
+		{"twimg.com.evil.com", false},
+	}
+	for _, c := range cases {
+		if got := e.allowHost(c.host); got != c.want {
+			t.Errorf("allowHost(%q) = %v, want %v", c.host, got, c.want)
+		}
+	}
+	if !(&egress{}).allowHost("anything.com") {
+		t.Error("empty allow list should allow all hosts")
+	}
+}
+
+func readEgressBody(content string, max int64) (string, *HTTPClient, error) {
+	c := NewHTTPClient()
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	body := &egressBody{ReadCloser: ioutil.NopCloser(strings.NewReader(content)), client: c, req: req, remain: max}
+	raw, err := ioutil.ReadAll(body)
+	return string(raw), c, err
+}
+
+func TestEgressBody(t *testing.T) {
+	cases := []struct {
+		content  string
+		max      int64
+		want     string
+		exceeded bool
+	}{
+		{"hello", -1, "hello", false},
+		{"hello", 5, "hello", false},
+		{"hello", 10, "hello", false},
+		{"hello world", 5, "hello", true},
+		{"hello", 0, "", true},
+	}
+	for _, c := range cases {
+		got, client, err := readEgressBody(c.content, c.max)
+		if got != c.want {
+			t.Errorf("read %q with max %d = %q, want %q", c.content, c.max, got, c.want)
+		}
+		if (err == ErrResponseTooLarge) != c.exceeded {
+			t.Errorf("read %q with max %d error = %v", c.content, c.max, err)
+		}
+		stats := client.EgressStats()
+		if stats.BytesIn != int64(len(c.want)) {
+			t.Errorf("read %q with max %d bytesIn = %d, want %d", c.content, c.max, stats.BytesIn, len(c.want))
+		}
+		if (stats.Oversize == 1) != c.exceeded {
+			t.Errorf("read %q with max %d oversize = %d", c.content, c.max, stats.Oversize)
+		}
+	}
+}
+
+// 直接调用 Client.Do 和重定向的请求同样检查出站限制
+func TestEgressTransport(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer target.Close()
+	u, _ := url.Parse(target.URL)
+	redirect := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://localhost:"+u.Port()+"/", http.StatusFound)
+	}))
+	defer redirect.Close()
+
+	c := NewHTTPClient()
+	if err := c.SetProxy("direct"); err != nil {
+		t.Fatal(err)
+	}
+	c.SetEgress(EgressPolicy{AllowHosts: []string{"127.0.0.1"}})
+	violations := 0
+	c.OnViolation = func(req *http.Request, err error) { violations++ }
+
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost:"+u.Port()+"/", nil)
+	if _, err := c.Client.Do(req); err == nil || !egressError(err) {
+		t.Errorf("Client.Do() error = %v, want %v", err, ErrHostNotAllowed)
+	}
+	if _, err := c.Get(redirect.URL); err != ErrHostNotAllowed {
+		t.Errorf("redirect error = %v, want %v", err, ErrHostNotAllowed)
+	}
+	res, err := c.Get(target.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	stats := c.EgressStats()
+	if stats.Denied != 2 || violations != 2 {
+		t.Errorf("denied = %d, violations = %d, want 2", stats.Denied, violations)
+	}
+	// 重定向前的请求和允许的请求各计一次
+	if stats.Requests != 2 {
+		t.Errorf("requests = %d, want 2", stats.Requests)
+	}
+}
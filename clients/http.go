@@ -1,46 +1,298 @@
 package clients
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/cookiejar"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
+// 请求的默认配置
+const (
+	defaultHTTPTimeout      = 30 * time.Second
+	defaultHTTPRetryBackoff = 500 * time.Millisecond
+	maxHTTPRetryBackoff     = 30 * time.Second
+	// limiterPruneInterval 清理空闲域名限制的间隔
+	limiterPruneInterval = time.Minute
+)
+
+// HTTPStatusError 响应的状态码不是 2xx
+type HTTPStatusError struct {
+	URL        string
+	Status     string
+	StatusCode int
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("http: %s %s", e.URL, e.Status)
+}
+
 // HTTPClient 支持socks或者http代理的，以及cookie的http客户端
+// 代理通过 SetProxy 设置，默认使用环境变量中的代理
 type HTTPClient struct {
+	// cacheCounter 和 egressCounter 放在开头保证 64 位对齐
+	cacheCounter  cacheCounter
+	egressCounter egressCounter
 	http.Client
+	// Header 每个请求默认的请求头，创建请求时复制一份
 	Header http.Header
+	// DefaultTimeout 请求的 context 没有设置期限时使用的超时时间（包括读取响应），为 0 时不限制
+	DefaultTimeout time.Duration
+	// Retries 幂等的请求（GET HEAD OPTIONS PUT DELETE）失败时重试的次数
+	Retries int
+	// RetryBackoff 第一次重试前等待的时间，之后每次翻倍
+	RetryBackoff time.Duration
+	// HostLimit 没有单独设置的域名使用的限制
+	HostLimit HostLimit
+	// Cache 缓存，为 nil 时不缓存
+	// 只缓存 GET 请求，遵循 Cache-Control 的 max-age，过期后使用 ETag 和 Last-Modified 发送条件请求
+	Cache CacheStore
+	// OnViolation 请求违反出站限制（见 SetEgress）时调用
+	OnViolation func(req *http.Request, err error)
+	egress      *egress
+	hostLimits  map[string]HostLimit
+	limiters    map[string]*hostLimiter
+	lastPrune   time.Time
+	lmu         sync.Mutex
 }
 
 // DefaultHTTPClient 默认的公共http客户端
 // 建议没有特殊需求的功能都使用这个客户端
-var DefaultHTTPClient = NewHTTPClient()
+// 为了兼容之前的行为，DefaultTimeout 为 0（不限制），需要超时的请求通过 ctx 设置
+var DefaultHTTPClient = newDefaultHTTPClient()
 
-// NewHTTPClient 创建新的 http client 客户端
+func newDefaultHTTPClient() *HTTPClient {
+	client := NewHTTPClient()
+	client.DefaultTimeout = 0
+	return client
+}
+
+// NewHTTPClient 创建新的 http client 客户端，DefaultTimeout 默认为 30 秒
 func NewHTTPClient() *HTTPClient {
 	client := new(HTTPClient)
 	// 设置默认的请求头
 	client.Header = make(http.Header)
 	client.Header.Set("User-Agent", "Haruno Robot")
+	client.DefaultTimeout = defaultHTTPTimeout
 	jar, _ := cookiejar.New(nil)
 	client.Jar = jar
 	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
-	client.Transport = transport
+	client.Transport = &egressTransport{client: client, base: transport}
 	return client
 }
 
+func cloneHeader(h http.Header) http.Header {
+	clone := make(http.Header, len(h))
+	for k, v := range h {
+		clone[k] = append([]string(nil), v...)
+	}
+	return clone
+}
+
+// SetHostLimit 设置单个域名（包括端口时需要带上端口）的并发和速率限制
+func (c *HTTPClient) SetHostLimit(host string, limit HostLimit) {
+	c.lmu.Lock()
+	defer c.lmu.Unlock()
+	if c.hostLimits == nil {
+		c.hostLimits = make(map[string]HostLimit)
+	}
+	c.hostLimits[host] = limit
+	delete(c.limiters, host)
+}
+
+func (c *HTTPClient) limiter(host string) *hostLimiter {
+	c.lmu.Lock()
+	defer c.lmu.Unlock()
+	limit, ok := c.hostLimits[host]
+	if !ok {
+		limit = c.HostLimit
+	}
+	if limit.Concurrency <= 0 && limit.Rate <= 0 {
+		return nil
+	}
+	if c.limiters == nil {
+		c.limiters = make(map[string]*hostLimiter)
+	}
+	c.pruneLimitersLocked(time.Now())
+	l, ok := c.limiters[host]
+	if !ok {
+		l = newHostLimiter(limit)
+		c.limiters[host] = l
+	}
+	return l
+}
+
+// pruneLimitersLocked 定时删除空闲的域名限制，需要持有 lmu
+func (c *HTTPClient) pruneLimitersLocked(now time.Time) {
+	if now.Sub(c.lastPrune) < limiterPruneInterval {
+		return
+	}
+	c.lastPrune = now
+	for host, l := range c.limiters {
+		if l.idle(now) {
+			delete(c.limiters, host)
+		}
+	}
+}
+
 // NewRequest 使用客户端创建http请求
 func (c *HTTPClient) NewRequest(method, url string, body io.Reader) (*http.Request, error) {
+	return c.NewRequestWithContext(context.Background(), method, url, body)
+}
+
+// NewRequestWithContext 使用客户端创建http请求，ctx 可以用来设置单个请求的超时时间
+func (c *HTTPClient) NewRequestWithContext(ctx context.Context, method, url string, body io.Reader) (*http.Request, error) {
 	req, err := http.NewRequest(method, url, body)
 	if err != nil {
 		return nil, err
 	}
 	if c.Header != nil {
-		req.Header = c.Header
+		req.Header = cloneHeader(c.Header)
+	}
+	return req.WithContext(ctx), nil
+}
+
+// idempotent 可以安全重试的请求
+func idempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+	default:
+		return false
+	}
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// retryStatus 可以重试的状态码
+func retryStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code == http.StatusBadGateway ||
+		code == http.StatusServiceUnavailable || code == http.StatusGatewayTimeout
+}
+
+// cancelBody 关闭响应时释放超时和并发名额
+type cancelBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// Do 发送请求
+// 按域名限制并发和速率，context 没有期限时使用 DefaultTimeout，幂等的请求失败时按 Retries 重试
+// 设置了 Cache 时可以缓存的请求优先使用缓存
+func (c *HTTPClient) Do(req *http.Request) (*http.Response, error) {
+	if c.Cache != nil && cacheableRequest(req) {
+		return c.doCached(req)
 	}
-	return req, nil
+	return c.doRequest(req)
+}
+
+func (c *HTTPClient) doRequest(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	cancel := context.CancelFunc(func() {})
+	if _, ok := ctx.Deadline(); !ok && c.DefaultTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, c.DefaultTimeout)
+	}
+	retries := 0
+	if idempotent(req) {
+		retries = c.Retries
+	}
+	backoff := c.RetryBackoff
+	if backoff <= 0 {
+		backoff = defaultHTTPRetryBackoff
+	}
+	for attempt := 0; ; attempt++ {
+		res, err := c.do(ctx, req, attempt)
+		if attempt >= retries || (err == nil && !retryStatus(res.StatusCode)) || ctx.Err() != nil || egressError(err) {
+			if err != nil {
+				cancel()
+				return nil, err
+			}
+			res.Body = &cancelBody{ReadCloser: res.Body, release: cancel}
+			return res, nil
+		}
+		wait := retryWait(ctx, backoff<<uint(attempt), res)
+		if res != nil {
+			res.Body.Close()
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			cancel()
+			if err == nil {
+				err = ctx.Err()
+			}
+			return nil, err
+		case <-timer.C:
+		}
+	}
+}
+
+// retryWait 重试前等待的时间，优先使用服务器在 Retry-After 中要求的时间
+// 不超过 maxHTTPRetryBackoff 以及 ctx 剩余的时间
+func retryWait(ctx context.Context, backoff time.Duration, res *http.Response) time.Duration {
+	wait := backoff
+	if wait > maxHTTPRetryBackoff || wait <= 0 {
+		wait = maxHTTPRetryBackoff
+	}
+	if res != nil {
+		if sec, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil && sec >= 0 {
+			wait = maxHTTPRetryBackoff
+			// 先比较秒数，避免很大的值溢出
+			if sec < int(maxHTTPRetryBackoff/time.Second) {
+				wait = time.Duration(sec) * time.Second
+			}
+		}
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if remain := time.Until(deadline); remain < wait {
+			wait = remain
+		}
+	}
+	if wait < 0 {
+		wait = 0
+	}
+	return wait
+}
+
+// do 发送一次请求，响应关闭前一直占用域名的并发名额
+func (c *HTTPClient) do(ctx context.Context, req *http.Request, attempt int) (*http.Response, error) {
+	r := req.WithContext(ctx)
+	if attempt > 0 && req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		r.Body = body
+	}
+	release := func() {}
+	if l := c.limiter(req.URL.Host); l != nil {
+		var err error
+		if release, err = l.acquire(ctx); err != nil {
+			return nil, err
+		}
+	}
+	// 出站限制在 Transport 中检查
+	res, err := c.Client.Do(r)
+	if err != nil {
+		release()
+		return nil, unwrapEgress(err)
+	}
+	res.Body = &cancelBody{ReadCloser: res.Body, release: release}
+	return res, nil
 }
 
 // Head 增强http.Client.Head方法
@@ -75,3 +327,53 @@ func (c *HTTPClient) Post(url string, contentType string, body io.Reader) (*http
 func (c *HTTPClient) PostForm(url string, data url.Values) (*http.Response, error) {
 	return c.Post(url, "application/x-www-form-urlencoded", strings.NewReader(data.Encode()))
 }
+
+// GetJSON 发送GET请求，把json格式的响应解析到 v
+func (c *HTTPClient) GetJSON(url string, v interface{}) error {
+	return c.GetJSONContext(context.Background(), url, v)
+}
+
+// GetJSONContext 发送GET请求，把json格式的响应解析到 v
+func (c *HTTPClient) GetJSONContext(ctx context.Context, url string, v interface{}) error {
+	req, err := c.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	return c.doJSON(req, v)
+}
+
+// PostJSON 把 body 编码成json发送POST请求，把json格式的响应解析到 v，v 为 nil 时忽略响应
+func (c *HTTPClient) PostJSON(url string, body, v interface{}) error {
+	return c.PostJSONContext(context.Background(), url, body, v)
+}
+
+// PostJSONContext 把 body 编码成json发送POST请求，把json格式的响应解析到 v，v 为 nil 时忽略响应
+func (c *HTTPClient) PostJSONContext(ctx context.Context, url string, body, v interface{}) error {
+	raw, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := c.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("Accept", "application/json")
+	return c.doJSON(req, v)
+}
+
+func (c *HTTPClient) doJSON(req *http.Request, v interface{}) error {
+	res, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return &HTTPStatusError{URL: req.URL.String(), Status: res.Status, StatusCode: res.StatusCode}
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
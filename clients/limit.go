@@ -0,0 +1,113 @@
+package clients
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// HostLimit 单个域名的请求限制
+type HostLimit struct {
+	// Concurrency 同时进行的请求数量，为 0 时不限制
+	Concurrency int `toml:"concurrency"`
+	// Rate 每秒的请求数量，为 0 时不限制
+	Rate float64 `toml:"rate"`
+	// Burst 突发的请求数量
+	Burst int `toml:"burst"`
+}
+
+// hostLimiter 单个域名的并发和速率限制
+type hostLimiter struct {
+	sem    chan struct{}
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newHostLimiter(limit HostLimit) *hostLimiter {
+	l := &hostLimiter{
+		rate:  limit.Rate,
+		burst: float64(limit.Burst),
+		last:  time.Now(),
+	}
+	if limit.Concurrency > 0 {
+		l.sem = make(chan struct{}, limit.Concurrency)
+	}
+	if l.burst < 1 {
+		l.burst = 1
+	}
+	l.tokens = l.burst
+	return l
+}
+
+// idle 没有进行中的请求并且令牌已经补满，和新建的限制没有区别
+func (l *hostLimiter) idle(now time.Time) bool {
+	if len(l.sem) > 0 {
+		return false
+	}
+	if l.rate <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.tokens+now.Sub(l.last).Seconds()*l.rate >= l.burst
+}
+
+// reserve 取一个令牌，返回需要等待的时间
+func (l *hostLimiter) reserve() time.Duration {
+	if l.rate <= 0 {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// unreserve 归还 reserve 取出的令牌
+func (l *hostLimiter) unreserve() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.tokens++
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+}
+
+// acquire 等待令牌和并发名额，返回释放并发名额的函数
+// 等待令牌时 ctx 结束会归还令牌
+func (l *hostLimiter) acquire(ctx context.Context) (func(), error) {
+	if wait := l.reserve(); wait > 0 {
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			l.unreserve()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+	if l.sem == nil {
+		return func() {}, nil
+	}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case l.sem <- struct{}{}:
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() { <-l.sem })
+	}, nil
+}
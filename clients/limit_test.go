@@ -0,0 +1,120 @@
+package clients
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestHostLimiterRate(t *testing.T) {
+	l := newHostLimiter(HostLimit{Rate: 10, Burst: 2})
+	for i := 0; i < 2; i++ {
+		if wait := l.reserve(); wait != 0 {
+			t.Fatalf("burst %d: wait %v", i, wait)
+		}
+	}
+	if wait := l.reserve(); wait <= 0 || wait > 100*time.Millisecond {
+		t.Fatalf("after burst: wait %v, want about 100ms", wait)
+	}
+}
+
+func TestHostLimiterIdle(t *testing.T) {
+	l := newHostLimiter(HostLimit{Concurrency: 1, Rate: 1, Burst: 1})
+	if !l.idle(time.Now()) {
+		t.Fatal("new limiter should be idle")
+	}
+	release, err := l.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.idle(time.Now().Add(time.Hour)) {
+		t.Fatal("limiter with a running request should not be idle")
+	}
+	release()
+	if l.idle(time.Now()) {
+		t.Fatal("limiter without tokens should not be idle")
+	}
+	if !l.idle(time.Now().Add(2 * time.Second)) {
+		t.Fatal("limiter should be idle after the tokens are refilled")
+	}
+}
+
+func TestPruneLimiters(t *testing.T) {
+	c := NewHTTPClient()
+	c.HostLimit = HostLimit{Rate: 1, Burst: 1}
+	c.limiter("a.example.com").reserve()
+	c.limiter("b.example.com")
+	c.lmu.Lock()
+	c.lastPrune = time.Time{}
+	c.pruneLimitersLocked(time.Now())
+	_, a := c.limiters["a.example.com"]
+	_, b := c.limiters["b.example.com"]
+	c.lmu.Unlock()
+	if !a || b {
+		t.Fatalf("busy limiter should be kept (%v) and idle one pruned (%v)", a, b)
+	}
+}
+
+func TestDefaultClientTimeout(t *testing.T) {
+	if DefaultHTTPClient.DefaultTimeout != 0 {
+		t.Errorf("shared client timeout = %v, want 0", DefaultHTTPClient.DefaultTimeout)
+	}
+	if c := NewHTTPClient(); c.DefaultTimeout != defaultHTTPTimeout {
+		t.Errorf("new client timeout = %v, want %v", c.DefaultTimeout, defaultHTTPTimeout)
+	}
+}
+
+// 等待令牌时取消会归还令牌
+func TestHostLimiterCancel(t *testing.T) {
+	l := newHostLimiter(HostLimit{Rate: 1, Burst: 1})
+	if wait := l.reserve(); wait != 0 {
+		t.Fatalf("first reserve: wait %v", wait)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := l.acquire(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("acquire() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	// 没有归还时需要等待将近 2s
+	if wait := l.reserve(); wait > time.Second {
+		t.Errorf("after cancel: wait %v, want at most 1s", wait)
+	}
+}
+
+func TestRetryWait(t *testing.T) {
+	retryAfter := func(v string) *http.Response {
+		return &http.Response{Header: http.Header{"Retry-After": []string{v}}}
+	}
+	background := context.Background()
+	cases := []struct {
+		name    string
+		backoff time.Duration
+		res     *http.Response
+		want    time.Duration
+	}{
+		{"backoff", time.Second, nil, time.Second},
+		{"overflow", -1, nil, maxHTTPRetryBackoff},
+		{"long backoff", time.Hour, nil, maxHTTPRetryBackoff},
+		{"retry after", time.Second, retryAfter("2"), 2 * time.Second},
+		{"long retry after", time.Second, retryAfter("3600"), maxHTTPRetryBackoff},
+		{"huge retry after", time.Second, retryAfter("99999999999999"), maxHTTPRetryBackoff},
+		{"invalid retry after", time.Second, retryAfter("soon"), time.Second},
+	}
+	for _, c := range cases {
+		if got := retryWait(background, c.backoff, c.res); got != c.want {
+			t.Errorf("%s: retryWait() = %v, want %v", c.name, got, c.want)
+		}
+	}
+	// 不超过 ctx 剩余的时间
+	ctx, cancel := context.WithTimeout(background, 100*time.Millisecond)
+	defer cancel()
+	if got := retryWait(ctx, time.Second, retryAfter("10")); got > 100*time.Millisecond {
+		t.Errorf("retryWait() = %v, want at most 100ms", got)
+	}
+	expired, cancelExpired := context.WithDeadline(background, time.Now().Add(-time.Second))
+	defer cancelExpired()
+	if got := retryWait(expired, time.Second, nil); got != 0 {
+		t.Errorf("retryWait() with expired ctx = %v, want 0", got)
+	}
+}
@@ -1,138 +1,572 @@
 package clients
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"math/rand"
+	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/haruno-bot/haruno/logger"
 )
 
+// 重连和心跳的默认配置
+const (
+	defaultWSMinBackoff   = time.Second
+	defaultWSMaxBackoff   = time.Minute
+	defaultWSPingInterval = 5 * time.Second
+	defaultWSPongTimeout  = 15 * time.Second
+	defaultWSBufferTTL    = 10 * time.Second
+	wsHandshakeTimeout    = 10 * time.Second
+	// wsInboxSize 等待 OnMessage 处理的消息数量
+	wsInboxSize = 1024
+)
+
+// websocket客户端的错误
+var (
+	// ErrWSNotConnected 连接不可用
+	ErrWSNotConnected = errors.New("websocket: connection is not available")
+	// ErrWSBufferFull 断开期间的发送缓冲区已满
+	ErrWSBufferFull = errors.New("websocket: outbound buffer is full")
+)
+
+// wsPending 断开期间缓冲的消息
+type wsPending struct {
+	msgType int
+	msg     []byte
+	expire  time.Time
+}
+
+// WSState websocket连接的状态
+type WSState int32
+
+// websocket连接的状态
+const (
+	// WSIdle 还没有调用 Dial
+	WSIdle WSState = iota
+	// WSConnecting 正在建立第一次连接
+	WSConnecting
+	// WSConnected 已连接
+	WSConnected
+	// WSReconnecting 连接断开，正在重连
+	WSReconnecting
+	// WSClosed 已经调用 Close 关闭
+	WSClosed
+)
+
+var wsStateStr = []string{"idle", "connecting", "connected", "reconnecting", "closed"}
+
+func (s WSState) String() string {
+	if s < 0 || int(s) >= len(wsStateStr) {
+		return "unknown"
+	}
+	return wsStateStr[s]
+}
+
 // WSClient 拓展的websocket客户端，可以自动重连
 // 这个没有默认的客户端
+// 回调都在连接协程中按顺序同步调用，不要在里面做耗时的操作
+// OnMessage 在单独的协程中按顺序调用，处理太慢时不会影响心跳
 type WSClient struct {
-	Name      string
+	Name string
+	// OnMessage 收到消息
 	OnMessage func([]byte)
-	OnError   func(error)
+	// OnError 连接失败，连接断开的原因通过 OnDisconnect 报告
+	OnError func(error)
+	// OnConnect 每次连接成功（包括重连）
 	OnConnect func(*WSClient)
-	Filter    func([]byte) bool
-	headers   http.Header
-	conn      *websocket.Conn
-	url       string
-	closed    bool
-	rquit     chan int
-	wquit     chan int
-	dialer    *websocket.Dialer
-	mmu       sync.Mutex
-	cmu       sync.Mutex
+	// OnDisconnect 连接断开，err 为断开的原因
+	OnDisconnect func(c *WSClient, err error)
+	// OnReconnect 断开后重连成功，attempts 为尝试的次数
+	OnReconnect func(c *WSClient, attempts int)
+	Filter      func([]byte) bool
+	// MinBackoff, MaxBackoff 重连的等待时间，每次失败后翻倍并加上随机抖动
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// PingInterval 发送心跳的间隔
+	PingInterval time.Duration
+	// PongTimeout 超过这个时间没有收到任何消息（包括心跳的响应）时认为连接已经断开
+	// 写入消息的超时时间也是它
+	PongTimeout time.Duration
+	// BufferSize 断开期间最多缓冲的消息数量，为 0 时不缓冲，Send 直接返回错误
+	// 缓冲的消息在重连后按顺序发出
+	BufferSize int
+	// BufferTTL 缓冲的消息的有效期，过期的消息不再发送
+	// 需要等待响应的调用方应该设置为小于等待响应的超时时间
+	BufferTTL time.Duration
+	// OnOverflow 缓冲区已满，msg 被丢弃
+	OnOverflow func(c *WSClient, msg []byte)
+	// OnExpire 缓冲的消息过期（或者关闭时还没有发出），msg 被丢弃
+	OnExpire func(c *WSClient, msg []byte)
+	lastSeen int64
+	lastErr  error
+	headers  http.Header
+	url      string
+	state    int32
+	dialer   *websocket.Dialer
+	ctx      context.Context
+	cancel   context.CancelFunc
+	done     chan struct{}
+	conn     *websocket.Conn
+	broken   chan error
+	buffer   []wsPending
+	flushing bool
+	bmu      sync.Mutex
+	mmu      sync.Mutex
+	cmu      sync.Mutex
 }
 
 // Dial 设置和远程服务器链接
+// 第一次连接失败时返回错误，并在后台继续按退避时间重试，直到调用 Close
 func (c *WSClient) Dial(url string, headers http.Header) error {
-	c.closed = true
+	c.cmu.Lock()
+	if c.State() != WSIdle {
+		c.cmu.Unlock()
+		return errors.New("websocket: client has been dialed")
+	}
 	c.url = url
 	c.headers = headers
 	if c.Name == "" {
 		c.Name = "Websocket"
 	}
-	if c.dialer == nil {
-		c.dialer = &websocket.Dialer{
-			Proxy: http.ProxyFromEnvironment,
-		}
+	c.initDialer()
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	c.done = make(chan struct{})
+	c.setState(WSConnecting)
+	c.cmu.Unlock()
+
+	conn, err := c.dial()
+	if err != nil {
+		c.reportError(err)
 	}
-	var err error
-	if c.conn, _, err = c.dialer.Dial(url, headers); err != nil {
-		return err
+	go c.run(conn)
+	return err
+}
+
+// State 当前的连接状态
+func (c *WSClient) State() WSState {
+	return WSState(atomic.LoadInt32(&c.state))
+}
+
+func (c *WSClient) setState(s WSState) {
+	atomic.StoreInt32(&c.state, int32(s))
+}
+
+// LastSeen 最后一次收到消息（包括心跳的响应）的时间
+func (c *WSClient) LastSeen() time.Time {
+	nano := atomic.LoadInt64(&c.lastSeen)
+	if nano == 0 {
+		return time.Time{}
 	}
-	c.closed = false
-	c.rquit = make(chan int)
-	c.wquit = make(chan int)
-	if c.OnConnect != nil {
-		go c.OnConnect(c)
+	return time.Unix(0, nano)
+}
+
+// Staleness 距离最后一次收到消息的时间，没有连接时为 0
+func (c *WSClient) Staleness() time.Duration {
+	if !c.IsConnected() {
+		return 0
 	}
-	go func() {
-		for {
-			var msg []byte
-			if _, msg, err = c.conn.ReadMessage(); err != nil {
-				if c.OnError != nil {
-					go c.OnError(err)
-				}
-				close(c.rquit)
-				return
-			}
-			if c.Filter != nil {
-				if !c.Filter(msg) {
-					continue
-				}
-			}
-			if c.OnMessage != nil {
-				go c.OnMessage(msg)
-			}
-		}
-	}()
-	go c.setupPing()
-	return nil
+	return time.Since(c.LastSeen())
+}
+
+// LastError 最后一次断开或者连接失败的原因
+func (c *WSClient) LastError() error {
+	c.cmu.Lock()
+	defer c.cmu.Unlock()
+	return c.lastErr
+}
+
+func (c *WSClient) pingInterval() time.Duration {
+	if c.PingInterval <= 0 {
+		return defaultWSPingInterval
+	}
+	return c.PingInterval
+}
+
+func (c *WSClient) pongTimeout() time.Duration {
+	if c.PongTimeout <= 0 {
+		return defaultWSPongTimeout
+	}
+	return c.PongTimeout
+}
+
+// touch 收到消息，延长读取的期限
+func (c *WSClient) touch(conn *websocket.Conn) {
+	now := time.Now()
+	atomic.StoreInt64(&c.lastSeen, now.UnixNano())
+	conn.SetReadDeadline(now.Add(c.pingInterval() + c.pongTimeout()))
+}
+
+// IsConnected 检查是否在连接状态
+func (c *WSClient) IsConnected() bool {
+	return c.State() == WSConnected
 }
 
 // Send 发送消息
+// 开启缓冲时，断开期间的消息放进缓冲区，重连后按顺序发出
 func (c *WSClient) Send(msgType int, msg []byte) error {
-	if c.closed {
-		return errors.New("can not use closed connection")
+	return c.SendWithTTL(msgType, msg, c.bufferTTL())
+}
+
+// SendWithTTL 发送消息，断开期间缓冲的消息在 ttl 之后过期
+func (c *WSClient) SendWithTTL(msgType int, msg []byte, ttl time.Duration) error {
+	c.bmu.Lock()
+	state := c.State()
+	buffering := state == WSConnecting || state == WSReconnecting || len(c.buffer) > 0 || c.flushing
+	if c.BufferSize > 0 && state != WSIdle && state != WSClosed && buffering {
+		expired := c.pruneLocked(time.Now())
+		full := len(c.buffer) >= c.BufferSize
+		if !full {
+			c.buffer = append(c.buffer, wsPending{msgType: msgType, msg: msg, expire: time.Now().Add(ttl)})
+		}
+		c.bmu.Unlock()
+		c.expired(expired)
+		if full {
+			if c.OnOverflow != nil {
+				c.OnOverflow(c, msg)
+			}
+			return ErrWSBufferFull
+		}
+		return nil
+	}
+	c.bmu.Unlock()
+	c.cmu.Lock()
+	conn, broken := c.conn, c.broken
+	c.cmu.Unlock()
+	if conn == nil || !c.IsConnected() {
+		return ErrWSNotConnected
 	}
+	return c.write(conn, broken, msgType, msg)
+}
+
+// Buffered 缓冲区中等待发送的消息数量
+func (c *WSClient) Buffered() int {
+	c.bmu.Lock()
+	defer c.bmu.Unlock()
+	return len(c.buffer)
+}
+
+// Writable 现在调用 Send 是否可能成功（已连接或者可以缓冲）
+func (c *WSClient) Writable() bool {
+	switch c.State() {
+	case WSConnected:
+		return true
+	case WSConnecting, WSReconnecting:
+		return c.BufferSize > 0
+	}
+	return false
+}
+
+func (c *WSClient) bufferTTL() time.Duration {
+	if c.BufferTTL <= 0 {
+		return defaultWSBufferTTL
+	}
+	return c.BufferTTL
+}
+
+// pruneLocked 移除缓冲区开头过期的消息，需要持有 bmu
+func (c *WSClient) pruneLocked(now time.Time) []wsPending {
+	i := 0
+	for i < len(c.buffer) && now.After(c.buffer[i].expire) {
+		i++
+	}
+	if i == 0 {
+		return nil
+	}
+	expired := append([]wsPending(nil), c.buffer[:i]...)
+	c.buffer = append(c.buffer[:0], c.buffer[i:]...)
+	return expired
+}
+
+func (c *WSClient) expired(pending []wsPending) {
+	if c.OnExpire == nil {
+		return
+	}
+	for _, p := range pending {
+		c.OnExpire(c, p.msg)
+	}
+}
+
+// flush 重连后按顺序发出缓冲的消息，期间新的消息继续放进缓冲区
+func (c *WSClient) flush(conn *websocket.Conn, broken chan error) {
+	for {
+		c.bmu.Lock()
+		expired := c.pruneLocked(time.Now())
+		if len(c.buffer) == 0 {
+			c.flushing = false
+			c.bmu.Unlock()
+			c.expired(expired)
+			return
+		}
+		p := c.buffer[0]
+		c.buffer = c.buffer[1:]
+		c.bmu.Unlock()
+		c.expired(expired)
+		if err := c.write(conn, broken, p.msgType, p.msg); err != nil {
+			// 连接又断开了，放回去等下次重连
+			c.bmu.Lock()
+			c.buffer = append([]wsPending{p}, c.buffer...)
+			c.flushing = false
+			c.bmu.Unlock()
+			return
+		}
+	}
+}
+
+// write 写入消息，失败时断开连接，由连接协程重连
+func (c *WSClient) write(conn *websocket.Conn, broken chan error, msgType int, msg []byte) error {
 	c.mmu.Lock()
-	defer c.mmu.Unlock()
-	err := c.conn.WriteMessage(msgType, msg)
+	conn.SetWriteDeadline(time.Now().Add(c.pongTimeout()))
+	err := conn.WriteMessage(msgType, msg)
+	c.mmu.Unlock()
 	if err != nil {
-		close(c.wquit)
-		if c.OnError != nil {
-			go c.OnError(err)
+		c.setLastError(err)
+		select {
+		case broken <- err:
+		default:
 		}
 		return err
 	}
 	return nil
 }
 
-// IsConnected 检查是否在连接状态
-func (c *WSClient) IsConnected() bool {
-	return !c.closed
+// Close 关闭连接并停止重连，等待连接协程退出或者 ctx 结束
+func (c *WSClient) Close(ctx context.Context) error {
+	c.cmu.Lock()
+	if c.State() == WSIdle || c.State() == WSClosed {
+		c.setState(WSClosed)
+		c.cmu.Unlock()
+		return nil
+	}
+	c.setState(WSClosed)
+	conn := c.conn
+	c.cmu.Unlock()
+	if conn != nil {
+		c.mmu.Lock()
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+			time.Now().Add(time.Second))
+		c.mmu.Unlock()
+	}
+	c.cancel()
+	c.bmu.Lock()
+	dropped := c.buffer
+	c.buffer = nil
+	c.bmu.Unlock()
+	c.expired(dropped)
+	select {
+	case <-c.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
-func (c *WSClient) close() {
+func (c *WSClient) dial() (*websocket.Conn, error) {
+	conn, _, err := c.dialer.DialContext(c.ctx, c.url, c.headers)
+	return conn, err
+}
+
+func (c *WSClient) setLastError(err error) {
 	c.cmu.Lock()
-	defer c.cmu.Unlock()
-	if c.closed {
-		return
+	c.lastErr = err
+	c.cmu.Unlock()
+}
+
+func (c *WSClient) reportError(err error) {
+	c.setLastError(err)
+	if c.OnError != nil {
+		c.OnError(err)
 	}
-	if c.conn != nil {
-		c.conn.Close()
+}
+
+// backoff 第 attempt 次重连前等待的时间
+func (c *WSClient) backoff(attempt int) time.Duration {
+	min, max := c.MinBackoff, c.MaxBackoff
+	if min <= 0 {
+		min = defaultWSMinBackoff
 	}
-	c.closed = true
+	if max <= 0 {
+		max = defaultWSMaxBackoff
+	}
+	wait := min
+	for i := 1; i < attempt && wait < max; i++ {
+		wait *= 2
+	}
+	if wait > max {
+		wait = max
+	}
+	// 一半固定一半随机，避免多个客户端同时重连
+	half := wait / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// run 连接协程，连接断开后按退避时间重连，直到调用 Close
+func (c *WSClient) run(conn *websocket.Conn) {
+	defer close(c.done)
+	reconnect := false
+	attempts := 0
 	for {
-		if err := c.Dial(c.url, c.headers); err == nil {
+		if conn != nil {
+			c.connected(conn, reconnect, attempts)
+			err := c.serve(conn)
+			if c.ctx.Err() != nil {
+				return
+			}
+			c.cmu.Lock()
+			c.conn = nil
+			if c.State() == WSClosed {
+				c.cmu.Unlock()
+				return
+			}
+			c.setState(WSReconnecting)
+			c.cmu.Unlock()
+			if c.OnDisconnect != nil {
+				c.OnDisconnect(c, err)
+			} else {
+				logger.Logger.Printf("%s has broken down: %v", c.Name, err)
+			}
+			reconnect = true
+			attempts = 0
+		}
+		attempts++
+		wait := c.backoff(attempts)
+		logger.Logger.Printf("%s is not connected, will reconnect after %v (attempt %d).", c.Name, wait, attempts)
+		timer := time.NewTimer(wait)
+		select {
+		case <-c.ctx.Done():
+			timer.Stop()
 			return
+		case <-timer.C:
+		}
+		c.bmu.Lock()
+		expired := c.pruneLocked(time.Now())
+		c.bmu.Unlock()
+		c.expired(expired)
+		var err error
+		if conn, err = c.dial(); err != nil {
+			conn = nil
+			if c.ctx.Err() != nil {
+				return
+			}
+			c.reportError(err)
 		}
-		logger.Logger.Println(c.Name, "has broken down, will reconnect after 5s.")
-		time.Sleep(time.Second * 5)
 	}
 }
 
-func (c *WSClient) setupPing() {
-	ticker := time.NewTicker(time.Second * 5)
-	pingMsg := []byte("")
+// connected 连接成功，更新状态并调用回调
+func (c *WSClient) connected(conn *websocket.Conn, reconnect bool, attempts int) {
+	c.cmu.Lock()
+	if c.State() == WSClosed {
+		c.cmu.Unlock()
+		conn.Close()
+		return
+	}
+	c.conn = conn
+	c.broken = make(chan error, 1)
+	broken := c.broken
+	c.touch(conn)
+	conn.SetPongHandler(func(string) error {
+		c.touch(conn)
+		return nil
+	})
+	c.bmu.Lock()
+	c.flushing = len(c.buffer) > 0
+	c.setState(WSConnected)
+	c.bmu.Unlock()
+	c.cmu.Unlock()
+	c.flush(conn, broken)
+	if c.OnConnect != nil {
+		c.OnConnect(c)
+	}
+	if reconnect && c.OnReconnect != nil {
+		c.OnReconnect(c, attempts)
+	}
+}
+
+// serve 读取消息并定时发送心跳，连接断开或者关闭时返回断开的原因
+// 超过 PingInterval + PongTimeout 没有收到任何消息时读取超时，断开连接
+// 读取协程只负责读取，消息放进队列由处理协程按顺序调用 OnMessage，处理的耗时不影响读取的期限
+func (c *WSClient) serve(conn *websocket.Conn) error {
+	c.cmu.Lock()
+	broken := c.broken
+	c.cmu.Unlock()
+	readErr := make(chan error, 1)
+	inbox := make(chan []byte, wsInboxSize)
+	stop := make(chan struct{})
+	handled := make(chan struct{})
+	go func() {
+		defer close(handled)
+		for msg := range inbox {
+			if c.OnMessage != nil {
+				c.OnMessage(msg)
+			}
+		}
+	}()
+	go func() {
+		defer close(inbox)
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				if e, ok := err.(net.Error); ok && e.Timeout() {
+					err = fmt.Errorf("no message or pong received in %v: %v", time.Since(c.LastSeen()).Truncate(time.Millisecond), err)
+				}
+				readErr <- err
+				return
+			}
+			c.touch(conn)
+			if c.Filter != nil && !c.Filter(msg) {
+				continue
+			}
+			select {
+			case inbox <- msg:
+				continue
+			default:
+			}
+			// 队列满了，等待处理协程，等待的时间不算在读取的期限内
+			select {
+			case inbox <- msg:
+				conn.SetReadDeadline(time.Now().Add(c.pingInterval() + c.pongTimeout()))
+			case <-stop:
+				readErr <- c.ctx.Err()
+				return
+			}
+		}
+	}()
+	ticker := time.NewTicker(c.pingInterval())
 	defer ticker.Stop()
-	defer c.close()
-	for {
+	var err error
+	for err == nil {
 		select {
-		case <-c.rquit:
-			return
-		case <-c.wquit:
-			return
+		case <-c.ctx.Done():
+			err = c.ctx.Err()
+		case err = <-readErr:
+			readErr = nil
+			if c.ctx.Err() == nil {
+				c.setLastError(err)
+			}
+		case err = <-broken:
 		case <-ticker.C:
-			if c.Send(websocket.PingMessage, pingMsg) != nil {
-				return
+			c.mmu.Lock()
+			e := conn.WriteControl(websocket.PingMessage, []byte(""), time.Now().Add(c.pongTimeout()))
+			c.mmu.Unlock()
+			if e != nil {
+				c.setLastError(e)
+				err = e
 			}
 		}
 	}
+	close(stop)
+	conn.Close()
+	// 等待读取协程退出、已经收到的消息处理完，保证重连后消息的顺序
+	if readErr != nil {
+		<-readErr
+	}
+	<-handled
+	return err
 }
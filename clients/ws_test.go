@@ -0,0 +1,77 @@
+package clients
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// 处理消息很慢时连接仍然正常，心跳不受影响
+func TestWSSlowHandler(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for _, msg := range []string{"1", "2", "3"} {
+			conn.WriteMessage(websocket.TextMessage, []byte(msg))
+		}
+		// 读取时自动响应心跳
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	var mu sync.Mutex
+	received := make([]string, 0)
+	disconnected := 0
+	done := make(chan struct{})
+	c := &WSClient{
+		PingInterval: 50 * time.Millisecond,
+		PongTimeout:  100 * time.Millisecond,
+		OnMessage: func(msg []byte) {
+			time.Sleep(300 * time.Millisecond)
+			mu.Lock()
+			received = append(received, string(msg))
+			if len(received) == 3 {
+				close(done)
+			}
+			mu.Unlock()
+		},
+		OnDisconnect: func(c *WSClient, err error) {
+			mu.Lock()
+			disconnected++
+			mu.Unlock()
+		},
+	}
+	if err := c.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("messages are not handled")
+	}
+	// 继续收发几次心跳
+	time.Sleep(300 * time.Millisecond)
+	c.Close(context.Background())
+	mu.Lock()
+	defer mu.Unlock()
+	if disconnected != 0 {
+		t.Fatalf("slow handler should not break the connection, disconnected %d time(s)", disconnected)
+	}
+	if strings.Join(received, "") != "123" {
+		t.Fatalf("messages out of order: %v", received)
+	}
+}
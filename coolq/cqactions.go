@@ -1,5 +1,10 @@
 package coolq
 
+import (
+	"errors"
+	"fmt"
+)
+
 // 文档: https://cqhttp.cc/docs/4.4/#/API?id=api-列表
 // 大致先做这些...
 const (
@@ -7,12 +12,20 @@ const (
 	ActionSendPrivateMsg = "send_private_msg" // DONE: websocket
 	// ActionSendGroupMsg 发送群消息
 	ActionSendGroupMsg = "send_group_msg" // DONE: websocket
+	// ActionSendMsg 发送消息
+	ActionSendMsg = "send_msg"
 	// ActionSetGroupKick 群组踢人
 	ActionSetGroupKick = "set_group_kick" // DONE: websocket
 	// ActionSetGroupBan 群组单人禁言
 	ActionSetGroupBan = "set_group_ban" // DONE: websocket
 	// ActionSetGroupWholeBan 群组全员禁言
 	ActionSetGroupWholeBan = "set_group_whole_ban" // DONE: websocket
+	// ActionDeleteMsg 撤回消息
+	ActionDeleteMsg = "delete_msg" // DONE: websocket
+	// ActionSetFriendAddRequest 处理加好友请求
+	ActionSetFriendAddRequest = "set_friend_add_request" // DONE: websocket
+	// ActionSetGroupAddRequest 处理加群请求／邀请
+	ActionSetGroupAddRequest = "set_group_add_request" // DONE: websocket
 	// ActionGetStatus 获取插件运行状态
 	ActionGetStatus = "get_status" // DONE: http
 )
@@ -32,6 +45,30 @@ type CQResponse struct {
 	Echo    int64       `json:"echo"`
 }
 
+// retCodeAsync 后端没有同步返回结果，转为异步执行，结果未知
+const retCodeAsync = 1
+
+// api调用的错误
+var (
+	// ErrAPIDisconnected api连接不可用
+	ErrAPIDisconnected = errors.New("coolq: api connection is not available")
+	// ErrAPITimeout api响应超时
+	ErrAPITimeout = errors.New("coolq: api response time out")
+	// ErrAPIMuted 会话因为疑似机器人循环被熔断
+	ErrAPIMuted = errors.New("coolq: conversation is muted by loop guard")
+)
+
+// APIError api响应的 retcode 不为 0
+type APIError struct {
+	Action  string
+	Status  string
+	RetCode int
+}
+
+func (err *APIError) Error() string {
+	return fmt.Sprintf("coolq: action %s failed, status = %s, retcode = %d", err.Action, err.Status, err.RetCode)
+}
+
 // CQTypeSendGroupMsg SendGroupMsg动作的数据格式
 type CQTypeSendGroupMsg struct {
 	GroupID    int64  `json:"group_id"`
@@ -66,6 +103,26 @@ type CQTypeSetGroupWholeBan struct {
 	Enable  bool  `json:"enable"`
 }
 
+// CQTypeDeleteMsg ActionDeleteMsg动作数据格式
+type CQTypeDeleteMsg struct {
+	MessageID int64 `json:"message_id"`
+}
+
+// CQTypeSetFriendAddRequest ActionSetFriendAddRequest动作数据格式
+type CQTypeSetFriendAddRequest struct {
+	Flag    string `json:"flag"`
+	Approve bool   `json:"approve"`
+	Remark  string `json:"remark"`
+}
+
+// CQTypeSetGroupAddRequest ActionSetGroupAddRequest动作数据格式
+type CQTypeSetGroupAddRequest struct {
+	Flag    string `json:"flag"`
+	SubType string `json:"sub_type"`
+	Approve bool   `json:"approve"`
+	Reason  string `json:"reason"`
+}
+
 // CQTypeGetStatus ActionGetStatus的响应数据格式
 type CQTypeGetStatus struct {
 	AppInitialized bool `json:"app_initialized"`
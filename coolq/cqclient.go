@@ -1,10 +1,12 @@
 package coolq
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -15,7 +17,8 @@ import (
 
 const timeForWait = 30
 
-const noFilterKey = "__NEVER_SET_UNUSED_KEY__"
+// maxBufferTTL 断开期间缓冲的api调用的最长有效期（秒），小于等待响应的时间
+const maxBufferTTL = timeForWait / 2
 
 // Filter 过滤函数
 type Filter func(*CQEvent) bool
@@ -23,10 +26,18 @@ type Filter func(*CQEvent) bool
 // Handler 处理函数
 type Handler func(*CQEvent)
 
+// echoEntry echo队列中的元素
+// ch 不为空时表示有调用者在等待响应
+type echoEntry struct {
+	sent int64
+	ch   chan *CQResponse
+}
+
 type pluginEntry struct {
 	keys     []string
 	fitlers  map[string]Filter
 	handlers map[string]Handler
+	noFilter []Handler
 }
 
 // cqclient 酷q机器人连接客户端
@@ -39,7 +50,20 @@ type cqclient struct {
 	httpConn      *clients.HTTPClient
 	apiURL        string
 	pluginEntries map[string]pluginEntry
-	echoqueue     map[int64]bool
+	echoqueue     map[int64]*echoEntry
+	echoSeq       int64
+	selfID        int64
+	ctx           context.Context
+	cancel        context.CancelFunc
+	sessions      *sessionManager
+	perm          *permission
+	dispatcher    *dispatcher
+	deduper       *deduper
+	postSecret    string
+	guard         *loopGuard
+	sender        *sender
+	splitter      *splitter
+	retrier       *retrier
 }
 
 func handleConnect(conn *clients.WSClient) {
@@ -48,6 +72,14 @@ func handleConnect(conn *clients.WSClient) {
 	}
 }
 
+func handleDisconnect(conn *clients.WSClient, err error) {
+	logger.Field(conn.Name).Errorf("disconnected: %v", err)
+}
+
+func handleReconnect(conn *clients.WSClient, attempts int) {
+	logger.Field(conn.Name).Infof("reconnected after %d attempt(s)", attempts)
+}
+
 // RegisterAllPlugins 注册所有的插件
 func (c *cqclient) RegisterAllPlugins() {
 	// 1. 先全部执行加载函数
@@ -67,18 +99,29 @@ func (c *cqclient) RegisterAllPlugins() {
 		pluginName := plug.Name()
 		pluginFilters := plug.Filters()
 		pluginHandlers := plug.Handlers()
+		// 插件设置了权限要求的 handler 先套上权限检查
+		if provider, ok := plug.(PermissionProvider); ok {
+			guarded := make(map[string]Handler, len(pluginHandlers))
+			required := provider.Permissions()
+			for key, handler := range pluginHandlers {
+				if role, ok := required[key]; ok {
+					handler = c.perm.guard(fmt.Sprintf("%s/%s", pluginName, key), role, handler)
+				}
+				guarded[key] = handler
+			}
+			pluginHandlers = guarded
+		}
 		hasFilter := make(map[string]bool)
 		entry := pluginEntry{
 			keys:     make([]string, 0),
 			fitlers:  make(map[string]Filter),
 			handlers: make(map[string]Handler),
 		}
-		noFilterHanlers := make([]Handler, 0)
 		// 对应filter的key寻找相应的handler， 没有的话则给出警告
 		for key, filter := range pluginFilters {
 			handler := pluginHandlers[key]
 			if handler == nil {
-				logger.Logger.Warnf("插件 %s 中存在没有使用的key: %s\n", pluginName, key)
+				logger.Field(pluginName).Warnf("存在没有使用的key: %s", key)
 				continue
 			}
 			hasFilter[key] = true
@@ -86,15 +129,10 @@ func (c *cqclient) RegisterAllPlugins() {
 			entry.fitlers[key] = filter
 			entry.handlers[key] = handler
 		}
+		// 最后注册无key的handler
 		for key, handler := range pluginHandlers {
 			if !hasFilter[key] {
-				noFilterHanlers = append(noFilterHanlers, handler)
-			}
-		}
-		// 最后注册无key的handler
-		entry.handlers[noFilterKey] = func(event *CQEvent) {
-			for _, hanldeFunc := range noFilterHanlers {
-				hanldeFunc(event)
+				entry.noFilter = append(entry.noFilter, handler)
 			}
 		}
 		c.pluginEntries[pluginName] = entry
@@ -105,10 +143,64 @@ func (c *cqclient) RegisterAllPlugins() {
 	}
 }
 
-func (c *cqclient) deqEcho(echo int64) {
+// handleEvent 处理上报的事件
+// source 事件的来源 (websocket 或者 http)
+func (c *cqclient) handleEvent(source string, raw []byte) {
+	event := new(CQEvent)
+	err := json.Unmarshal(raw, event)
+	if err != nil {
+		logger.Field(source).Errorf("on message error %v", err)
+		return
+	}
+	event.raw = raw
+	if event.SelfID != 0 {
+		atomic.StoreInt64(&c.selfID, event.SelfID)
+	}
+	// 丢弃重复的事件
+	if c.deduper.duplicated(event) {
+		return
+	}
+	// 丢弃机器人自己的消息
+	if isSelf(event) {
+		return
+	}
+	c.guard.observe(event)
+	// 有会话在等待的消息直接交给会话处理
+	if c.sessions.deliver(event) {
+		return
+	}
+	c.dispatcher.submit(event)
+}
+
+// eventFor 为插件复制一份事件，并记录插件名称
+func (c *cqclient) eventFor(name string, event *CQEvent) *CQEvent {
+	ev := event.clone()
+	ev.SetValue(valuePlugin, name)
+	return ev
+}
+
+// nextEcho 生成一个新的echo
+func (c *cqclient) nextEcho() int64 {
+	return atomic.AddInt64(&c.echoSeq, 1)
+}
+
+func (c *cqclient) enqEcho(echo int64, wait bool) chan *CQResponse {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	entry := &echoEntry{sent: time.Now().Unix()}
+	if wait {
+		entry.ch = make(chan *CQResponse, 1)
+	}
+	c.echoqueue[echo] = entry
+	return entry.ch
+}
+
+func (c *cqclient) deqEcho(echo int64) *echoEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := c.echoqueue[echo]
 	delete(c.echoqueue, echo)
+	return entry
 }
 
 // Initialize 初始化客户端
@@ -116,13 +208,26 @@ func (c *cqclient) deqEcho(echo int64) {
 func (c *cqclient) Initialize(token string) {
 	c.token = token
 	c.httpConn = clients.NewHTTPClient()
+	// 代理地址在 SetProxy 时已经检查过
+	c.httpConn.SetProxy(backendProxy())
 	c.httpConn.Header.Set("Authorization", fmt.Sprintf("Token %s", c.token))
 
+	if c.dispatcher == nil {
+		c.dispatcher = newDispatcher(DispatchConfig{})
+	}
+	c.dispatcher.start(c)
+	go c.sender.run(c)
+
 	c.apiConn.Name = "coolq api conn"
 	c.eventConn.Name = "coolq event conn"
 	// 注册连接事件回调
 	c.apiConn.OnConnect = handleConnect
 	c.eventConn.OnConnect = handleConnect
+	// 注册断开和重连事件回调
+	c.apiConn.OnDisconnect = handleDisconnect
+	c.eventConn.OnDisconnect = handleDisconnect
+	c.apiConn.OnReconnect = handleReconnect
+	c.eventConn.OnReconnect = handleReconnect
 	// 注册错误事件回调
 	c.apiConn.OnError = func(err error) {
 		logger.Field(c.apiConn.Name).Error(err)
@@ -139,31 +244,14 @@ func (c *cqclient) Initialize(token string) {
 			return
 		}
 		// echo队列 - 确定发送消息是否超时
-		echo := msg.Echo
-		if c.echoqueue[echo] {
-			c.deqEcho(echo)
+		entry := c.deqEcho(msg.Echo)
+		if entry != nil && entry.ch != nil {
+			entry.ch <- msg
 		}
 	}
 	// 注册上报事件回调
 	c.eventConn.OnMessage = func(raw []byte) {
-		event := new(CQEvent)
-		err := json.Unmarshal(raw, event)
-		if err != nil {
-			logger.Field(c.eventConn.Name).Errorf("on message error %v", err)
-			return
-		}
-		for name, entry := range c.pluginEntries {
-			// 先异步处理没有key的回调
-			go entry.handlers[noFilterKey](event)
-			// 一次异步执行所有的 filter 和 handler 对
-			for _, key := range entry.keys {
-				go func(key string, name string) {
-					if c.pluginEntries[name].fitlers[key](event) {
-						c.pluginEntries[name].handlers[key](event)
-					}
-				}(key, name)
-			}
-		}
+		c.handleEvent(c.eventConn.Name, raw)
 	}
 
 	// 定时清理echo队列 (30s)
@@ -174,13 +262,20 @@ func (c *cqclient) Initialize(token string) {
 			select {
 			case <-ticker.C:
 				now := time.Now().Unix()
-				for echo, state := range c.echoqueue {
-					// 对于超过30s未响应的给出提示
-					if state && now-echo > timeForWait {
-						logger.Errorf("(echo) id = %d response time out (30s)", echo)
-						c.deqEcho(echo)
+				timeouts := make([]int64, 0)
+				c.mu.Lock()
+				for echo, entry := range c.echoqueue {
+					// 等待响应的调用者自己处理超时
+					if entry.ch == nil && now-entry.sent > timeForWait {
+						timeouts = append(timeouts, echo)
 					}
 				}
+				c.mu.Unlock()
+				// 对于超过30s未响应的给出提示
+				for _, echo := range timeouts {
+					logger.Errorf("(echo) id = %d response time out (30s)", echo)
+					c.deqEcho(echo)
+				}
 			}
 		}
 	}()
@@ -198,6 +293,182 @@ func (c *cqclient) Connect(wsURL, httpURL string) {
 	c.apiURL = httpURL
 }
 
+// Shutdown 关闭客户端，所有 handler 的上下文都会被取消
+// 停止外部插件（ctx 结束时强制结束进程），然后关闭 websocket 连接，等待连接协程退出或者 ctx 结束
+func (c *cqclient) Shutdown(ctx context.Context) error {
+	c.cancel()
+	stdioErr := stopStdioPlugins(ctx)
+	apiErr := c.apiConn.Close(ctx)
+	eventErr := c.eventConn.Close(ctx)
+	for _, err := range []error{stdioErr, apiErr, eventErr} {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WebsocketConfig websocket连接的配置
+type WebsocketConfig struct {
+	// PingInterval 发送心跳的间隔（秒）
+	PingInterval int `toml:"pingInterval"`
+	// PongTimeout 超过这个时间（秒）没有收到任何消息时断开重连
+	PongTimeout int `toml:"pongTimeout"`
+	// MinBackoff, MaxBackoff 重连的等待时间（秒）
+	MinBackoff int `toml:"minBackoff"`
+	MaxBackoff int `toml:"maxBackoff"`
+	// BufferSize 断开期间最多缓冲的api调用数量，为 0 时不缓冲
+	BufferSize int `toml:"bufferSize"`
+	// BufferTTL 缓冲的api调用的有效期（秒），最多为 maxBufferTTL
+	BufferTTL int `toml:"bufferTTL"`
+}
+
+// SetWebsocket 设置websocket连接配置，需要在 Connect 之前调用
+func (c *cqclient) SetWebsocket(cfg WebsocketConfig) {
+	for _, conn := range []*clients.WSClient{c.apiConn, c.eventConn} {
+		conn.PingInterval = time.Duration(cfg.PingInterval) * time.Second
+		conn.PongTimeout = time.Duration(cfg.PongTimeout) * time.Second
+		conn.MinBackoff = time.Duration(cfg.MinBackoff) * time.Second
+		conn.MaxBackoff = time.Duration(cfg.MaxBackoff) * time.Second
+	}
+	// 只有 api 连接需要发送消息
+	c.apiConn.BufferSize = cfg.BufferSize
+	c.apiConn.BufferTTL = time.Duration(cfg.BufferTTL) * time.Second
+	// 缓冲的调用需要在等待响应超时之前发出，并留出响应的时间
+	if cfg.BufferTTL <= 0 || cfg.BufferTTL > maxBufferTTL {
+		c.apiConn.BufferTTL = maxBufferTTL * time.Second
+	}
+	c.apiConn.OnOverflow = func(conn *clients.WSClient, msg []byte) {
+		action, echo := bufferedCall(msg)
+		logger.Field(conn.Name).Warnf("outbound buffer is full, drop %s (echo = %d)", action, echo)
+	}
+	c.apiConn.OnExpire = func(conn *clients.WSClient, msg []byte) {
+		action, echo := bufferedCall(msg)
+		logger.Field(conn.Name).Warnf("buffered call expired, drop %s (echo = %d)", action, echo)
+		// 调用没有发出，等待响应的调用者立即失败
+		if entry := c.deqEcho(echo); entry != nil && entry.ch != nil {
+			entry.ch <- nil
+		}
+	}
+}
+
+// bufferedCall 缓冲区中的api调用的 action 和 echo
+func bufferedCall(msg []byte) (string, int64) {
+	call := struct {
+		Action string `json:"action"`
+		Echo   int64  `json:"echo"`
+	}{}
+	json.Unmarshal(msg, &call)
+	return call.Action, call.Echo
+}
+
+// ConnStats websocket连接的运行状态
+type ConnStats struct {
+	State string `json:"state"`
+	// Buffered 断开期间缓冲的消息数量
+	Buffered int `json:"buffered"`
+	// Staleness 距离最后一次收到消息的时间（毫秒）
+	Staleness int64  `json:"staleness"`
+	LastError string `json:"lastError,omitempty"`
+}
+
+func connStats(conn *clients.WSClient) ConnStats {
+	stats := ConnStats{
+		State:     conn.State().String(),
+		Buffered:  conn.Buffered(),
+		Staleness: int64(conn.Staleness() / time.Millisecond),
+	}
+	if err := conn.LastError(); err != nil {
+		stats.LastError = err.Error()
+	}
+	return stats
+}
+
+// ConnStats websocket连接的状态
+func (c *cqclient) ConnStats() map[string]ConnStats {
+	return map[string]ConnStats{
+		"api":   connStats(c.apiConn),
+		"event": connStats(c.eventConn),
+	}
+}
+
+// SetDispatch 设置事件分发配置，需要在 Initialize 之前调用
+func (c *cqclient) SetDispatch(cfg DispatchConfig) {
+	c.dispatcher = newDispatcher(cfg)
+}
+
+// SetDedup 设置事件去重配置
+func (c *cqclient) SetDedup(cfg DedupConfig) {
+	c.deduper = newDeduper(cfg)
+}
+
+// DedupStats 事件去重的运行状态
+func (c *cqclient) DedupStats() DedupStats {
+	return c.deduper.stats()
+}
+
+// SetGuard 设置防循环配置
+func (c *cqclient) SetGuard(cfg GuardConfig) {
+	c.guard = newLoopGuard(cfg)
+}
+
+// SetSender 设置发送队列配置，需要在 Initialize 之前调用
+func (c *cqclient) SetSender(cfg SenderConfig) {
+	c.sender = newSender(cfg)
+	c.splitter = newSplitter(cfg.Split)
+}
+
+// SenderStats 发送队列的运行状态
+func (c *cqclient) SenderStats() SenderStats {
+	return c.sender.stats()
+}
+
+// SetRetry 设置失败重试配置
+func (c *cqclient) SetRetry(cfg RetryConfig) {
+	c.retrier = newRetrier(cfg)
+}
+
+// DispatchStats 事件分发的运行状态
+func (c *cqclient) DispatchStats() DispatchStats {
+	if c.dispatcher == nil {
+		return DispatchStats{}
+	}
+	return c.dispatcher.stats()
+}
+
+// SetPermission 设置权限配置
+func (c *cqclient) SetPermission(cfg PermissionConfig) {
+	c.perm.load(cfg)
+}
+
+// RoleOf 获取事件触发者的权限等级
+func (c *cqclient) RoleOf(event *CQEvent) Role {
+	return c.perm.roleOf(event)
+}
+
+// IsSuperUser 是否为超级用户
+func (c *cqclient) IsSuperUser(userID int64) bool {
+	return c.perm.isSuperUser(userID)
+}
+
+// CheckPermission 检查事件的触发者是否满足权限要求
+func (c *cqclient) CheckPermission(event *CQEvent, role Role) bool {
+	return c.perm.check(event, role)
+}
+
+// WaitNext 等待和 event 同一个用户在同一个群（或者私聊）中的下一条消息
+// 等待期间该用户的消息不会再经过插件的 filter
+// timeout 等待超时时间，超时返回 ErrSessionTimeout
+// cancelWords 取消词，收到取消词时返回 ErrSessionCanceled
+func (c *cqclient) WaitNext(event *CQEvent, timeout time.Duration, cancelWords ...string) (*CQEvent, error) {
+	return c.sessions.wait(event, timeout, cancelWords)
+}
+
+// SelfID 机器人自己的QQ号，从上报的事件中得到，还没有收到事件时为 0
+func (c *cqclient) SelfID() int64 {
+	return atomic.LoadInt64(&c.selfID)
+}
+
 // IsAPIOk api服务是否可用
 func (c *cqclient) IsAPIOk() bool {
 	return c.apiConn.IsConnected()
@@ -209,40 +480,102 @@ func (c *cqclient) IsEventOk() bool {
 }
 
 // APISendJSON 发送api json格式的数据
+// api 调用在后台执行，可以重试的失败按配置重试，最终失败时记录死信
 func (c *cqclient) APISendJSON(data interface{}) {
-	if !c.IsAPIOk() {
+	payload, isMsg := data.(*CQWSMessage)
+	if isMsg {
+		go func() {
+			_, attempts, err := c.callWithRetry(payload.Action, payload.Params)
+			if err != nil {
+				c.recordFailure(payload.Action, payload.Params, err, attempts)
+			}
+		}()
 		return
 	}
 	msg, _ := json.Marshal(data)
-	c.apiConn.Send(websocket.TextMessage, msg)
+	if err := c.apiConn.Send(websocket.TextMessage, msg); err != nil {
+		logger.Errorf("send json error: %v", err)
+	}
+}
+
+// APICall 通过websocket调用api，并等待响应
+// 连接不可用时返回 ErrAPIDisconnected，超时返回 ErrAPITimeout
+// retcode 不为 0 时同时返回响应和 *APIError
+func (c *cqclient) APICall(action string, params interface{}) (*CQResponse, error) {
+	echo, ch, err := c.apiSubmit(action, params)
+	if err != nil {
+		return nil, err
+	}
+	return c.apiAwait(action, echo, ch)
+}
+
+// apiSubmit 发送api请求，返回等待响应的管道
+func (c *cqclient) apiSubmit(action string, params interface{}) (int64, chan *CQResponse, error) {
+	// 断开期间开启了缓冲时也可以发送，重连后按顺序发出
+	if !c.apiConn.Writable() {
+		return 0, nil, ErrAPIDisconnected
+	}
+	if !c.guardSend(action, params) {
+		return 0, nil, ErrAPIMuted
+	}
+	echo := c.nextEcho()
+	msg, err := json.Marshal(&CQWSMessage{
+		Action: action,
+		Params: params,
+		Echo:   echo,
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	ch := c.enqEcho(echo, true)
+	if err := c.apiConn.Send(websocket.TextMessage, msg); err != nil {
+		c.deqEcho(echo)
+		if err == clients.ErrWSNotConnected {
+			err = ErrAPIDisconnected
+		}
+		return 0, nil, err
+	}
+	return echo, ch, nil
+}
+
+// apiAwait 等待api响应
+func (c *cqclient) apiAwait(action string, echo int64, ch chan *CQResponse) (*CQResponse, error) {
+	timer := time.NewTimer(timeForWait * time.Second)
+	defer timer.Stop()
+	select {
+	case res := <-ch:
+		// 缓冲的调用过期，没有发出
+		if res == nil {
+			return nil, ErrAPIDisconnected
+		}
+		if res.RetCode != 0 {
+			return res, &APIError{Action: action, Status: res.Status, RetCode: res.RetCode}
+		}
+		return res, nil
+	case <-timer.C:
+		c.deqEcho(echo)
+		return nil, ErrAPITimeout
+	}
 }
 
 // SendGroupMsg 发送群消息
-// websocket 接口
+// 经过发送队列，websocket 接口
 func (c *cqclient) SendGroupMsg(groupID int64, message string) {
-	payload := &CQWSMessage{
-		Action: ActionSendGroupMsg,
-		Params: CQTypeSendGroupMsg{
-			GroupID: groupID,
-			Message: message,
-		},
-		Echo: time.Now().Unix(),
-	}
-	c.APISendJSON(payload)
+	c.Send(&SendRequest{
+		MessageType: "group",
+		TargetID:    groupID,
+		Message:     message,
+	})
 }
 
 // SendPrivateMsg 发送私聊消息
-// websocket 接口
+// 经过发送队列，websocket 接口
 func (c *cqclient) SendPrivateMsg(userID int64, message string) {
-	payload := &CQWSMessage{
-		Action: ActionSendPrivateMsg,
-		Params: CQTypeSendPrivateMsg{
-			UserID:  userID,
-			Message: message,
-		},
-		Echo: time.Now().Unix(),
-	}
-	c.APISendJSON(payload)
+	c.Send(&SendRequest{
+		MessageType: "private",
+		TargetID:    userID,
+		Message:     message,
+	})
 }
 
 // SetGroupKick 群组踢人
@@ -256,7 +589,7 @@ func (c *cqclient) SetGroupKick(groupID, userID int64, reject bool) {
 			UserID:           userID,
 			RejectAddRequest: reject,
 		},
-		Echo: time.Now().Unix(),
+		Echo: c.nextEcho(),
 	}
 	c.APISendJSON(payload)
 }
@@ -272,7 +605,7 @@ func (c *cqclient) SetGroupBan(groupID, userID int64, duration int64) {
 			UserID:   userID,
 			Duration: duration,
 		},
-		Echo: time.Now().Unix(),
+		Echo: c.nextEcho(),
 	}
 	c.APISendJSON(payload)
 }
@@ -287,13 +620,61 @@ func (c *cqclient) SetGroupWholeBan(groupID int64, enable bool) {
 			GroupID: groupID,
 			Enable:  enable,
 		},
-		Echo: time.Now().Unix(),
+		Echo: c.nextEcho(),
+	}
+	c.APISendJSON(payload)
+}
+
+// DeleteMsg 撤回消息
+// websocket 接口
+func (c *cqclient) DeleteMsg(messageID int64) {
+	payload := &CQWSMessage{
+		Action: ActionDeleteMsg,
+		Params: CQTypeDeleteMsg{
+			MessageID: messageID,
+		},
+		Echo: c.nextEcho(),
+	}
+	c.APISendJSON(payload)
+}
+
+// SetFriendAddRequest 处理加好友请求
+// flag 请求事件中的 flag
+// remark 同意时的好友备注
+// websocket 接口
+func (c *cqclient) SetFriendAddRequest(flag string, approve bool, remark string) {
+	payload := &CQWSMessage{
+		Action: ActionSetFriendAddRequest,
+		Params: CQTypeSetFriendAddRequest{
+			Flag:    flag,
+			Approve: approve,
+			Remark:  remark,
+		},
+		Echo: c.nextEcho(),
+	}
+	c.APISendJSON(payload)
+}
+
+// SetGroupAddRequest 处理加群请求／邀请
+// subType add 或者 invite，和请求事件中的 sub_type 一致
+// reason 拒绝的理由
+// websocket 接口
+func (c *cqclient) SetGroupAddRequest(flag, subType string, approve bool, reason string) {
+	payload := &CQWSMessage{
+		Action: ActionSetGroupAddRequest,
+		Params: CQTypeSetGroupAddRequest{
+			Flag:    flag,
+			SubType: subType,
+			Approve: approve,
+			Reason:  reason,
+		},
+		Echo: c.nextEcho(),
 	}
 	c.APISendJSON(payload)
 }
 
 func warnHTTPApiURLNotSet() {
-	logger.Logger.Warnln("Try to request a http api url, but no http api url was set.")
+	logger.Warn("Try to request a http api url, but no http api url was set.")
 }
 
 func (c *cqclient) getAPIURL(api string) string {
@@ -308,14 +689,8 @@ func (c *cqclient) GetStatus() *CQTypeGetStatus {
 		return nil
 	}
 	url := c.getAPIURL(ActionGetStatus)
-	res, err := c.httpConn.Get(url)
-	if err != nil {
-		logger.Errorf("cqclient http method getStatus error: %v", err)
-		return nil
-	}
-	defer res.Body.Close()
 	response := new(CQResponse)
-	if err := json.NewDecoder(res.Body).Decode(response); err != nil {
+	if err := c.httpConn.GetJSON(url, response); err != nil {
 		logger.Errorf("cqclient http method getStatus error: %v", err)
 		return nil
 	}
@@ -334,8 +709,23 @@ func (c *cqclient) GetStatus() *CQTypeGetStatus {
 }
 
 // Client 唯一的酷q机器人实体
-var Client = &cqclient{
-	apiConn:       new(clients.WSClient),
-	eventConn:     new(clients.WSClient),
-	pluginEntries: make(map[string]pluginEntry),
+var Client = newClient()
+
+func newClient() *cqclient {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &cqclient{
+		ctx:           ctx,
+		cancel:        cancel,
+		apiConn:       new(clients.WSClient),
+		eventConn:     new(clients.WSClient),
+		pluginEntries: make(map[string]pluginEntry),
+		echoqueue:     make(map[int64]*echoEntry),
+		sessions:      newSessionManager(),
+		perm:          newPermission(),
+		deduper:       newDeduper(DedupConfig{}),
+		guard:         newLoopGuard(GuardConfig{}),
+		sender:        newSender(SenderConfig{}),
+		splitter:      newSplitter(SplitConfig{}),
+		retrier:       newRetrier(RetryConfig{}),
+	}
 }
@@ -0,0 +1,42 @@
+package coolq
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestBufferTTLClamp(t *testing.T) {
+	for _, ttl := range []int{0, maxBufferTTL + 1, timeForWait * 2} {
+		c := newClient()
+		c.SetWebsocket(WebsocketConfig{BufferTTL: ttl})
+		if c.apiConn.BufferTTL != maxBufferTTL*time.Second {
+			t.Errorf("bufferTTL %d: got %v", ttl, c.apiConn.BufferTTL)
+		}
+	}
+	c := newClient()
+	c.SetWebsocket(WebsocketConfig{BufferTTL: 5})
+	if c.apiConn.BufferTTL != 5*time.Second {
+		t.Errorf("bufferTTL 5: got %v", c.apiConn.BufferTTL)
+	}
+}
+
+// 缓冲的调用过期时等待响应的调用者立即失败，而不是等到超时
+func TestBufferExpireFailsEcho(t *testing.T) {
+	c := newClient()
+	c.SetWebsocket(WebsocketConfig{BufferSize: 1})
+	echo := c.nextEcho()
+	ch := c.enqEcho(echo, true)
+	msg, _ := json.Marshal(&CQWSMessage{Action: ActionSetGroupBan, Echo: echo})
+	c.apiConn.OnExpire(c.apiConn, msg)
+	start := time.Now()
+	if _, err := c.apiAwait(ActionSetGroupBan, echo, ch); err != ErrAPIDisconnected {
+		t.Fatalf("expired call: got %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("expired call should fail immediately")
+	}
+	if entry := c.deqEcho(echo); entry != nil {
+		t.Fatal("expired echo should be removed")
+	}
+}
@@ -0,0 +1,188 @@
+package coolq
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/haruno-bot/haruno/clients"
+	"github.com/haruno-bot/haruno/logger"
+)
+
+// 事件上保存的值的key
+const (
+	// ValueCaptures 正则匹配的分组 []string
+	ValueCaptures = "coolq.captures"
+	// ValueNamedCaptures 正则命名分组的匹配 map[string]string
+	ValueNamedCaptures = "coolq.named_captures"
+	// valuePlugin 处理事件的插件名称
+	valuePlugin = "coolq.plugin"
+)
+
+// handlerTimeout 每次处理事件的 context 的超时时间
+const handlerTimeout = 5 * time.Minute
+
+// Context handler 的上下文
+// 包装了触发的事件，提供回复和常用操作的方法
+// 在机器人关闭、handler 超过 handlerTimeout（[dispatch]）或者超时（5min）时 Done()
+type Context struct {
+	context.Context
+	// Event 触发的事件
+	Event *CQEvent
+	// Plugin 处理事件的插件名称
+	Plugin string
+	// Log 以插件名称为域的logger
+	Log logger.LogInterface
+}
+
+// ContextHandler 使用上下文的处理函数
+type ContextHandler func(*Context)
+
+// Handle 把使用上下文的处理函数转换成 Handler
+func Handle(handler ContextHandler) Handler {
+	return func(event *CQEvent) {
+		ctx, cancel := NewContext(event)
+		defer cancel()
+		handler(ctx)
+	}
+}
+
+// NewContext 为事件创建上下文，处理完成后需要调用 cancel
+func NewContext(event *CQEvent) (*Context, context.CancelFunc) {
+	plugin, _ := event.Value(valuePlugin).(string)
+	base, ok := event.Value(valueContext).(context.Context)
+	if !ok {
+		base = Client.ctx
+	}
+	parent, cancel := context.WithTimeout(base, handlerTimeout)
+	ctx := &Context{
+		Context: parent,
+		Event:   event,
+		Plugin:  plugin,
+		Log:     logger.Field(plugin),
+	}
+	return ctx, cancel
+}
+
+// Reply 回复到事件来源的群或者私聊
+func (ctx *Context) Reply(message string) {
+	switch ctx.Event.MessageType {
+	case "group":
+		Client.SendGroupMsg(ctx.Event.GroupID, message)
+	case "private":
+		Client.SendPrivateMsg(ctx.Event.UserID, message)
+	default:
+		if ctx.Event.GroupID != 0 {
+			Client.SendGroupMsg(ctx.Event.GroupID, message)
+		} else if ctx.Event.UserID != 0 {
+			Client.SendPrivateMsg(ctx.Event.UserID, message)
+		}
+	}
+}
+
+// ReplyAt 回复并@触发者，私聊时和 Reply 相同
+func (ctx *Context) ReplyAt(message string) {
+	if ctx.Event.GroupID == 0 {
+		ctx.Reply(message)
+		return
+	}
+	ctx.Reply(fmt.Sprintf("[CQ:at,qq=%d] %s", ctx.Event.UserID, message))
+}
+
+// Quote 引用触发的消息回复
+func (ctx *Context) Quote(message string) {
+	if ctx.Event.MessageID == 0 {
+		ctx.Reply(message)
+		return
+	}
+	ctx.Reply(fmt.Sprintf("[CQ:reply,id=%d]%s", ctx.Event.MessageID, message))
+}
+
+// Recall 撤回触发的消息
+func (ctx *Context) Recall() {
+	if ctx.Event.MessageID == 0 {
+		return
+	}
+	Client.DeleteMsg(ctx.Event.MessageID)
+}
+
+// Kick 把触发者踢出群
+// reject 是否拒绝此人再次加群
+func (ctx *Context) Kick(reject bool) {
+	if ctx.Event.GroupID == 0 {
+		return
+	}
+	Client.SetGroupKick(ctx.Event.GroupID, ctx.Event.UserID, reject)
+}
+
+// Ban 禁言触发者，duration 为 0 时取消禁言
+func (ctx *Context) Ban(duration time.Duration) {
+	if ctx.Event.GroupID == 0 {
+		return
+	}
+	Client.SetGroupBan(ctx.Event.GroupID, ctx.Event.UserID, int64(duration/time.Second))
+}
+
+// Approve 同意加好友或者加群的请求
+func (ctx *Context) Approve() {
+	ctx.handleRequest(true, "")
+}
+
+// Reject 拒绝加好友或者加群的请求
+func (ctx *Context) Reject(reason string) {
+	ctx.handleRequest(false, reason)
+}
+
+func (ctx *Context) handleRequest(approve bool, reason string) {
+	if ctx.Event.PostType != "request" {
+		return
+	}
+	switch ctx.Event.RequestType {
+	case "friend":
+		Client.SetFriendAddRequest(ctx.Event.Flag, approve, "")
+	case "group":
+		Client.SetGroupAddRequest(ctx.Event.Flag, ctx.Event.SubType, approve, reason)
+	}
+}
+
+// Captures 正则过滤器匹配的分组，第0个为整个匹配
+func (ctx *Context) Captures() []string {
+	matches, _ := ctx.Event.Value(ValueCaptures).([]string)
+	return matches
+}
+
+// NamedCaptures 正则过滤器命名分组的匹配
+func (ctx *Context) NamedCaptures() map[string]string {
+	named, _ := ctx.Event.Value(ValueNamedCaptures).(map[string]string)
+	return named
+}
+
+// Session 以触发的事件创建会话
+func (ctx *Context) Session(cancelWords ...string) *Session {
+	return NewSession(ctx.Event, cancelWords...)
+}
+
+// Config 把插件的配置解析到v
+func (ctx *Context) Config(v interface{}) error {
+	return PluginConfig(ctx.Plugin, v)
+}
+
+// Storage 插件的持久化存储
+func (ctx *Context) Storage() *Storage {
+	return GetStorage(ctx.Plugin)
+}
+
+// HTTP 插件专用的http客户端
+func (ctx *Context) HTTP() *clients.HTTPClient {
+	return PluginHTTPClient(ctx.Plugin)
+}
+
+// Image 使用插件的http客户端下载图片，返回可以发送的图片段落
+func (ctx *Context) Image(url string) (Section, error) {
+	return Media.ImageSection(ctx, ctx.HTTP(), url)
+}
+
+// ArchiveImages 下载事件消息中的图片和语音到媒体缓存目录
+func (ctx *Context) ArchiveImages() ([]*MediaFile, error) {
+	return Media.Archive(ctx, ctx.HTTP(), ctx.Event)
+}
@@ -0,0 +1,202 @@
+package coolq
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// backendCall 模拟的后端收到的 api 调用
+type backendCall struct {
+	Action string                 `json:"action"`
+	Params map[string]interface{} `json:"params"`
+	Echo   int64                  `json:"echo"`
+}
+
+// startFakeBackend 启动模拟的 coolq websocket 后端，把 Client 替换成连接到它的客户端
+// 所有的 api 调用都成功，收到的调用按顺序放进返回的管道
+func startFakeBackend(t *testing.T) (<-chan backendCall, func()) {
+	t.Helper()
+	calls := make(chan backendCall, 16)
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			_, raw, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if r.URL.Path != "/api" {
+				continue
+			}
+			call := backendCall{}
+			if err := json.Unmarshal(raw, &call); err != nil {
+				t.Errorf("invalid api call %s: %v", raw, err)
+				continue
+			}
+			calls <- call
+			res, _ := json.Marshal(map[string]interface{}{
+				"status":  "ok",
+				"retcode": 0,
+				"data":    map[string]interface{}{"message_id": 1},
+				"echo":    call.Echo,
+			})
+			if err := conn.WriteMessage(websocket.TextMessage, res); err != nil {
+				return
+			}
+		}
+	}))
+	old := Client
+	Client = newClient()
+	Client.Initialize("token")
+	Client.Connect("ws"+strings.TrimPrefix(srv.URL, "http"), "")
+	deadline := time.Now().Add(5 * time.Second)
+	for !Client.IsAPIOk() {
+		if time.Now().After(deadline) {
+			t.Fatal("api connection is not ready")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return calls, func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		Client.Shutdown(ctx)
+		Client = old
+		srv.Close()
+	}
+}
+
+// nextCall 等待后端收到下一个调用
+func nextCall(t *testing.T, calls <-chan backendCall) backendCall {
+	t.Helper()
+	select {
+	case call := <-calls:
+		return call
+	case <-time.After(5 * time.Second):
+		t.Fatal("backend did not receive any call")
+	}
+	return backendCall{}
+}
+
+func groupEvent() *CQEvent {
+	return &CQEvent{PostType: "message", MessageType: "group", GroupID: 100, UserID: 2, MessageID: 5}
+}
+
+func TestContextActions(t *testing.T) {
+	calls, stop := startFakeBackend(t)
+	defer stop()
+	private := &CQEvent{PostType: "message", MessageType: "private", UserID: 2, MessageID: 6}
+	friend := &CQEvent{PostType: "request", RequestType: "friend", Flag: "f1"}
+	join := &CQEvent{PostType: "request", RequestType: "group", SubType: "add", Flag: "g1", GroupID: 100}
+	cases := []struct {
+		name   string
+		event  *CQEvent
+		call   func(ctx *Context)
+		action string
+		params map[string]interface{}
+	}{
+		{"reply group", groupEvent(), func(ctx *Context) { ctx.Reply("hi") },
+			ActionSendGroupMsg, map[string]interface{}{"group_id": 100.0, "message": "hi", "auto_escape": false}},
+		{"reply private", private, func(ctx *Context) { ctx.Reply("hi") },
+			ActionSendPrivateMsg, map[string]interface{}{"user_id": 2.0, "message": "hi", "auto_escape": false}},
+		{"reply at", groupEvent(), func(ctx *Context) { ctx.ReplyAt("hi") },
+			ActionSendGroupMsg, map[string]interface{}{"group_id": 100.0, "message": "[CQ:at,qq=2] hi", "auto_escape": false}},
+		{"reply at private", private, func(ctx *Context) { ctx.ReplyAt("hi") },
+			ActionSendPrivateMsg, map[string]interface{}{"user_id": 2.0, "message": "hi", "auto_escape": false}},
+		{"quote", groupEvent(), func(ctx *Context) { ctx.Quote("hi") },
+			ActionSendGroupMsg, map[string]interface{}{"group_id": 100.0, "message": "[CQ:reply,id=5]hi", "auto_escape": false}},
+		{"recall", groupEvent(), func(ctx *Context) { ctx.Recall() },
+			ActionDeleteMsg, map[string]interface{}{"message_id": 5.0}},
+		{"kick", groupEvent(), func(ctx *Context) { ctx.Kick(true) },
+			ActionSetGroupKick, map[string]interface{}{"group_id": 100.0, "user_id": 2.0, "reject_add_request": true}},
+		{"ban", groupEvent(), func(ctx *Context) { ctx.Ban(90 * time.Second) },
+			ActionSetGroupBan, map[string]interface{}{"group_id": 100.0, "user_id": 2.0, "duration": 90.0}},
+		{"approve friend", friend, func(ctx *Context) { ctx.Approve() },
+			ActionSetFriendAddRequest, map[string]interface{}{"flag": "f1", "approve": true, "remark": ""}},
+		{"reject group", join, func(ctx *Context) { ctx.Reject("no") },
+			ActionSetGroupAddRequest, map[string]interface{}{"flag": "g1", "sub_type": "add", "approve": false, "reason": "no"}},
+	}
+	for _, c := range cases {
+		ctx, cancel := NewContext(c.event)
+		c.call(ctx)
+		cancel()
+		call := nextCall(t, calls)
+		if call.Action != c.action || !reflect.DeepEqual(call.Params, c.params) {
+			t.Errorf("%s: backend received %s %v, want %s %v", c.name, call.Action, call.Params, c.action, c.params)
+		}
+	}
+}
+
+// 条件不满足时不调用 api
+func TestContextActionsSkipped(t *testing.T) {
+	calls, stop := startFakeBackend(t)
+	defer stop()
+	private := &CQEvent{PostType: "message", MessageType: "private", UserID: 2}
+	ctx, cancel := NewContext(private)
+	defer cancel()
+	ctx.Recall()
+	ctx.Kick(false)
+	ctx.Ban(time.Minute)
+	ctx.Approve()
+	select {
+	case call := <-calls:
+		t.Fatalf("unexpected call %s %v", call.Action, call.Params)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestContextCaptures(t *testing.T) {
+	event := groupEvent()
+	ctx, cancel := NewContext(event)
+	defer cancel()
+	if ctx.Captures() != nil || ctx.NamedCaptures() != nil {
+		t.Fatal("captures should be nil without a regex filter")
+	}
+	event.SetValue(ValueCaptures, []string{"/roll 2", "2"})
+	event.SetValue(ValueNamedCaptures, map[string]string{"count": "2"})
+	if got := ctx.Captures(); !reflect.DeepEqual(got, []string{"/roll 2", "2"}) {
+		t.Errorf("Captures() = %v", got)
+	}
+	if got := ctx.NamedCaptures(); got["count"] != "2" {
+		t.Errorf("NamedCaptures() = %v", got)
+	}
+}
+
+// 关闭客户端时所有 handler 的上下文都被取消
+func TestContextCancel(t *testing.T) {
+	old := Client
+	Client = newClient()
+	defer func() { Client = old }()
+	ctx, cancel := NewContext(groupEvent())
+	defer cancel()
+	if _, ok := ctx.Deadline(); !ok {
+		t.Error("context should have a deadline")
+	}
+	select {
+	case <-ctx.Done():
+		t.Fatal("context should not be done yet")
+	default:
+	}
+	Client.cancel()
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("context should be done after the client is shut down")
+	}
+	handled := make(chan *Context, 1)
+	Handle(func(ctx *Context) { handled <- ctx })(groupEvent())
+	if err := (<-handled).Err(); err == nil {
+		t.Error("context should be canceled after the handler returns")
+	}
+}
@@ -0,0 +1,128 @@
+package coolq
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 去重的默认配置
+const (
+	defaultDedupWindow  = 5 * time.Minute
+	defaultDedupEntries = 10000
+)
+
+// DedupConfig 事件去重配置
+type DedupConfig struct {
+	// Window 去重的时间窗口（秒）
+	Window int `toml:"window"`
+	// MaxEntries 最多记录的事件数量
+	MaxEntries int `toml:"maxEntries"`
+}
+
+// DedupStats 事件去重的运行状态
+type DedupStats struct {
+	Tracked    int   `json:"tracked"`
+	Duplicates int64 `json:"duplicates"`
+}
+
+type dedupEntry struct {
+	key    string
+	expire time.Time
+}
+
+// deduper 在一段时间窗口内丢弃重复的事件
+// 重连或者同时开启 websocket 和 http 上报时同一个事件可能会收到多次
+type deduper struct {
+	mu         sync.Mutex
+	window     time.Duration
+	maxEntries int
+	seen       map[string]bool
+	order      []dedupEntry
+	head       int
+	duplicates int64
+}
+
+func newDeduper(cfg DedupConfig) *deduper {
+	window := time.Duration(cfg.Window) * time.Second
+	if window <= 0 {
+		window = defaultDedupWindow
+	}
+	maxEntries := cfg.MaxEntries
+	if maxEntries <= 0 {
+		maxEntries = defaultDedupEntries
+	}
+	return &deduper{
+		window:     window,
+		maxEntries: maxEntries,
+		seen:       make(map[string]bool),
+		order:      make([]dedupEntry, 0),
+	}
+}
+
+// dedupKey 消息事件使用 message_id，其他事件使用原始内容的哈希
+// 哈希时去掉 self_id 和 time，没有解析的字段也会参与比较
+// timed 为 true 时还需要比较事件的时间
+func dedupKey(event *CQEvent) (key string, timed bool) {
+	if event.PostType == "message" && event.MessageID != 0 {
+		return fmt.Sprintf("message:%d:%d", event.SelfID, event.MessageID), false
+	}
+	raw := event.Raw()
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err == nil {
+		delete(fields, "self_id")
+		delete(fields, "time")
+		// map 按键排序编码，和上报时字段的顺序、空白无关
+		raw, _ = json.Marshal(fields)
+	}
+	return fmt.Sprintf("%s:%x", event.PostType, sha1.Sum(raw)), true
+}
+
+// duplicated 检查事件是否重复，没有重复时记录下来
+// 不同的上报方式收到同一个事件的时间可能相差 1 秒
+func (d *deduper) duplicated(event *CQEvent) bool {
+	key, timed := dedupKey(event)
+	keys := []string{key}
+	if timed {
+		keys = []string{
+			fmt.Sprintf("%s:%d", key, event.Time),
+			fmt.Sprintf("%s:%d", key, event.Time-1),
+			fmt.Sprintf("%s:%d", key, event.Time+1),
+		}
+	}
+	key = keys[0]
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	// 清理过期和超出数量的记录
+	for d.head < len(d.order) && (d.order[d.head].expire.Before(now) || len(d.seen) >= d.maxEntries) {
+		delete(d.seen, d.order[d.head].key)
+		d.head++
+	}
+	// 清理出的空间超过一半时再整理
+	if d.head > len(d.order)/2 {
+		d.order = append(d.order[:0], d.order[d.head:]...)
+		d.head = 0
+	}
+	for _, k := range keys {
+		if d.seen[k] {
+			atomic.AddInt64(&d.duplicates, 1)
+			return true
+		}
+	}
+	d.seen[key] = true
+	d.order = append(d.order, dedupEntry{key: key, expire: now.Add(d.window)})
+	return false
+}
+
+func (d *deduper) stats() DedupStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return DedupStats{
+		Tracked:    len(d.seen),
+		Duplicates: atomic.LoadInt64(&d.duplicates),
+	}
+}
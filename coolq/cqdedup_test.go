@@ -0,0 +1,78 @@
+package coolq
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func parseEvent(t *testing.T, raw string) *CQEvent {
+	t.Helper()
+	event := new(CQEvent)
+	if err := json.Unmarshal([]byte(raw), event); err != nil {
+		t.Fatal(err)
+	}
+	event.raw = []byte(raw)
+	return event
+}
+
+func TestDedupKey(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		same bool
+	}{
+		{
+			"same message id",
+			`{"post_type":"message","message_type":"group","group_id":1,"message_id":10,"self_id":1,"time":100}`,
+			`{"post_type":"message","message_type":"group","group_id":1,"message_id":10,"self_id":1,"time":101,"font":1}`,
+			true,
+		},
+		{
+			"different message id",
+			`{"post_type":"message","message_id":10,"self_id":1}`,
+			`{"post_type":"message","message_id":11,"self_id":1}`,
+			false,
+		},
+		{
+			// 没有解析的字段不同的通知不能被当作重复
+			"unmodeled fields",
+			`{"post_type":"notice","notice_type":"group_upload","group_id":1,"user_id":2,"file":{"name":"a.txt"},"time":100}`,
+			`{"post_type":"notice","notice_type":"group_upload","group_id":1,"user_id":2,"file":{"name":"b.txt"},"time":100}`,
+			false,
+		},
+		{
+			"field order and self_id",
+			`{"post_type":"notice","notice_type":"poke","user_id":2,"target_id":3,"self_id":1,"time":100}`,
+			`{"time":100, "self_id":4, "target_id":3, "user_id":2, "notice_type":"poke", "post_type":"notice"}`,
+			true,
+		},
+	}
+	for _, tt := range tests {
+		a, _ := dedupKey(parseEvent(t, tt.a))
+		b, _ := dedupKey(parseEvent(t, tt.b))
+		if (a == b) != tt.same {
+			t.Errorf("%s: keys %s and %s, want same = %v", tt.name, a, b, tt.same)
+		}
+	}
+}
+
+func TestDeduplicated(t *testing.T) {
+	d := newDeduper(DedupConfig{})
+	notice := `{"post_type":"notice","notice_type":"poke","user_id":2,"target_id":3,"time":%d}`
+	events := []struct {
+		time int
+		dup  bool
+	}{
+		{100, false},
+		// 另一种上报方式晚了 1 秒
+		{101, true},
+		// 相同的内容在之后再次发生
+		{200, false},
+	}
+	for _, e := range events {
+		if got := d.duplicated(parseEvent(t, fmt.Sprintf(notice, e.time))); got != e.dup {
+			t.Errorf("time %d: duplicated = %v, want %v", e.time, got, e.dup)
+		}
+	}
+}
@@ -0,0 +1,355 @@
+package coolq
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/haruno-bot/haruno/logger"
+)
+
+// 队列满时的处理策略
+const (
+	// OverflowDropNewest 丢弃新的事件
+	OverflowDropNewest = "drop-newest"
+	// OverflowDropOldest 丢弃队列中最早的事件
+	OverflowDropOldest = "drop-oldest"
+	// OverflowBlock 阻塞直到队列有空位
+	OverflowBlock = "block"
+)
+
+// 事件分发的默认配置
+const (
+	defaultDispatchWorkers   = 8
+	defaultDispatchQueueSize = 1024
+	// defaultHandlerTimeout 默认的 handler 运行时间（秒），超过后取消 handler 的上下文
+	defaultHandlerTimeout = 10
+)
+
+// 分发时保存在事件上的值
+const (
+	// valueDetach 让 handler 不再阻塞所在会话的后续事件
+	valueDetach = "coolq.detach"
+	// valueContext handler 的上下文，超时后被取消
+	valueContext = "coolq.context"
+)
+
+// DispatchConfig 事件分发配置
+type DispatchConfig struct {
+	// Workers 处理事件的协程数量
+	Workers int `toml:"workers"`
+	// QueueSize 队列的总长度，平均分给每个协程
+	QueueSize int `toml:"queueSize"`
+	// Overflow 队列满时的处理策略: drop-newest, drop-oldest, block
+	Overflow string `toml:"overflow"`
+	// HandlerTimeout 一个事件的 handler 的运行时间（秒）
+	// 超时后取消还在运行的 handler 的上下文（Context.Done()），等它们返回后再处理同一个会话的后续事件
+	HandlerTimeout int `toml:"handlerTimeout"`
+}
+
+// DispatchStats 事件分发的运行状态
+type DispatchStats struct {
+	Workers      int     `json:"workers"`
+	QueueSize    int     `json:"queueSize"`
+	QueueDepth   int     `json:"queueDepth"`
+	Processed    int64   `json:"processed"`
+	Dropped      int64   `json:"dropped"`
+	SlowEvents   int64   `json:"slowEvents"`
+	LatencyMs    float64 `json:"latencyMs"`
+	MaxLatencyMs float64 `json:"maxLatencyMs"`
+}
+
+type dispatchJob struct {
+	event    *CQEvent
+	enqueued time.Time
+}
+
+// dispatcher 有界的事件分发器
+// 同一个群（或者私聊）的事件总是交给同一个协程，按顺序处理
+type dispatcher struct {
+	overflow   string
+	queueSize  int
+	timeout    time.Duration
+	queues     []chan *dispatchJob
+	processed  int64
+	dropped    int64
+	slow       int64
+	mu         sync.Mutex
+	latency    time.Duration
+	maxLatency time.Duration
+}
+
+func newDispatcher(cfg DispatchConfig) *dispatcher {
+	workers := cfg.Workers
+	if workers <= 0 {
+		workers = defaultDispatchWorkers
+	}
+	queueSize := cfg.QueueSize
+	if queueSize <= 0 {
+		queueSize = defaultDispatchQueueSize
+	}
+	perWorker := queueSize / workers
+	if perWorker < 1 {
+		perWorker = 1
+	}
+	overflow := cfg.Overflow
+	switch overflow {
+	case OverflowDropNewest, OverflowDropOldest, OverflowBlock:
+	case "":
+		overflow = OverflowDropNewest
+	default:
+		logger.Errorf("unknown dispatch overflow policy %s, use %s", overflow, OverflowDropNewest)
+		overflow = OverflowDropNewest
+	}
+	timeout := cfg.HandlerTimeout
+	if timeout <= 0 {
+		timeout = defaultHandlerTimeout
+	}
+	d := &dispatcher{
+		overflow:  overflow,
+		queueSize: perWorker * workers,
+		timeout:   time.Duration(timeout) * time.Second,
+		queues:    make([]chan *dispatchJob, workers),
+	}
+	for i := range d.queues {
+		d.queues[i] = make(chan *dispatchJob, perWorker)
+	}
+	return d
+}
+
+// start 启动所有的协程
+func (d *dispatcher) start(c *cqclient) {
+	for _, queue := range d.queues {
+		go func(queue chan *dispatchJob) {
+			for {
+				select {
+				case <-c.ctx.Done():
+					return
+				case job := <-queue:
+					c.dispatch(job.event)
+					d.observe(time.Since(job.enqueued))
+				}
+			}
+		}(queue)
+	}
+}
+
+// conversationKey 事件所属的会话，同一个会话的事件按顺序处理
+func conversationKey(event *CQEvent) string {
+	if event.MessageType == "private" {
+		return fmt.Sprintf("private:%d", event.UserID)
+	}
+	if event.GroupID != 0 {
+		return fmt.Sprintf("group:%d", event.GroupID)
+	}
+	return fmt.Sprintf("user:%d", event.UserID)
+}
+
+// submit 把事件放进对应会话的队列
+func (d *dispatcher) submit(event *CQEvent) {
+	h := fnv.New32a()
+	h.Write([]byte(conversationKey(event)))
+	queue := d.queues[h.Sum32()%uint32(len(d.queues))]
+	job := &dispatchJob{event: event, enqueued: time.Now()}
+	switch d.overflow {
+	case OverflowBlock:
+		queue <- job
+		return
+	case OverflowDropOldest:
+		for {
+			select {
+			case queue <- job:
+				return
+			default:
+			}
+			select {
+			case <-queue:
+				d.drop()
+			default:
+			}
+		}
+	default:
+		select {
+		case queue <- job:
+		default:
+			d.drop()
+		}
+	}
+}
+
+func (d *dispatcher) drop() {
+	if atomic.AddInt64(&d.dropped, 1)%100 == 1 {
+		logger.Errorf("event queue is full, %d events have been dropped", atomic.LoadInt64(&d.dropped))
+	}
+}
+
+// observe 记录事件从进入队列到处理完成的延迟
+func (d *dispatcher) observe(latency time.Duration) {
+	atomic.AddInt64(&d.processed, 1)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.latency == 0 {
+		d.latency = latency
+	} else {
+		d.latency += (latency - d.latency) / 8
+	}
+	if latency > d.maxLatency {
+		d.maxLatency = latency
+	}
+}
+
+func (d *dispatcher) stats() DispatchStats {
+	depth := 0
+	for _, queue := range d.queues {
+		depth += len(queue)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return DispatchStats{
+		Workers:      len(d.queues),
+		QueueSize:    d.queueSize,
+		QueueDepth:   depth,
+		Processed:    atomic.LoadInt64(&d.processed),
+		Dropped:      atomic.LoadInt64(&d.dropped),
+		SlowEvents:   atomic.LoadInt64(&d.slow),
+		LatencyMs:    float64(d.latency) / float64(time.Millisecond),
+		MaxLatencyMs: float64(d.maxLatency) / float64(time.Millisecond),
+	}
+}
+
+type namedEntry struct {
+	name string
+	pluginEntry
+}
+
+// snapshotEntries 复制一份已经注册的插件，按名称排序
+func (c *cqclient) snapshotEntries() []namedEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entries := make([]namedEntry, 0, len(c.pluginEntries))
+	for name, entry := range c.pluginEntries {
+		entries = append(entries, namedEntry{name: name, pluginEntry: entry})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].name < entries[j].name
+	})
+	return entries
+}
+
+// wait 等待一个事件的 handler 完成
+// 超时后调用 expire 取消还在运行的 handler 并记录它们的插件名称，然后继续等待
+// handler 需要响应上下文的取消，否则会一直阻塞所在会话（以及同一个协程上的其他会话）
+func (d *dispatcher) wait(event *CQEvent, wg *sync.WaitGroup, expire func() []string) {
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+	timer := time.NewTimer(d.timeout)
+	defer timer.Stop()
+	select {
+	case <-finished:
+		return
+	case <-timer.C:
+	}
+	atomic.AddInt64(&d.slow, 1)
+	logger.Warnf("handlers for %s are still running after %v, cancel them: %s",
+		conversationKey(event), d.timeout, strings.Join(expire(), ", "))
+	<-finished
+}
+
+// runningHandler 正在运行并且没有 detach 的 handler
+type runningHandler struct {
+	name   string
+	cancel context.CancelFunc
+}
+
+// dispatch 依次执行所有插件的 filter，并发执行通过的 handler
+// 等所有的 handler 返回（或者 detach）后才会处理同一个会话的下一个事件
+// 超过 HandlerTimeout 时取消 handler 的上下文，仍然等待它们返回以保证顺序
+func (c *cqclient) dispatch(event *CQEvent) {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	running := make(map[int]runningHandler)
+	next := 0
+	run := func(name string, ev *CQEvent, handler Handler) {
+		var once sync.Once
+		ctx, cancel := context.WithCancel(c.ctx)
+		mu.Lock()
+		id := next
+		next++
+		running[id] = runningHandler{name: name, cancel: cancel}
+		mu.Unlock()
+		done := func() {
+			once.Do(func() {
+				mu.Lock()
+				delete(running, id)
+				mu.Unlock()
+				wg.Done()
+			})
+		}
+		ev.SetValue(valueDetach, done)
+		ev.SetValue(valueContext, ctx)
+		wg.Add(1)
+		go func() {
+			defer cancel()
+			defer done()
+			defer recoverPlugin(name)
+			handler(ev)
+		}()
+	}
+	for _, entry := range c.snapshotEntries() {
+		if len(entry.noFilter) > 0 {
+			handlers := entry.noFilter
+			run(entry.name, c.eventFor(entry.name, event), func(ev *CQEvent) {
+				for _, handler := range handlers {
+					handler(ev)
+				}
+			})
+		}
+		for _, key := range entry.keys {
+			ev := c.eventFor(entry.name, event)
+			if !runFilter(entry.name, entry.fitlers[key], ev) {
+				continue
+			}
+			run(entry.name, ev, entry.handlers[key])
+		}
+	}
+	c.dispatcher.wait(event, &wg, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		names := make([]string, 0, len(running))
+		for _, h := range running {
+			h.cancel()
+			names = append(names, h.name)
+		}
+		sort.Strings(names)
+		return names
+	})
+}
+
+func runFilter(name string, filter Filter, event *CQEvent) bool {
+	defer recoverPlugin(name)
+	return filter(event)
+}
+
+// recoverPlugin 插件的 filter 或者 handler panic 时记录错误，不影响其他插件
+func recoverPlugin(name string) {
+	if err := recover(); err != nil {
+		logger.Field(name).Errorf("panic: %v\n%s", err, debug.Stack())
+	}
+}
+
+// detach 让 handler 不再阻塞所在会话的后续事件
+// 用于需要长时间等待的 handler，比如会话
+func detach(event *CQEvent) {
+	if done, ok := event.Value(valueDetach).(func()); ok {
+		done()
+	}
+}
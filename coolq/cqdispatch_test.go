@@ -0,0 +1,101 @@
+package coolq
+
+import (
+	"testing"
+	"time"
+)
+
+// 慢的 handler 超时后上下文被取消，返回后才处理同一个会话的后续事件
+func TestDispatchHandlerTimeout(t *testing.T) {
+	c := newClient()
+	c.dispatcher = newDispatcher(DispatchConfig{})
+	c.dispatcher.timeout = 50 * time.Millisecond
+	old := Client
+	Client = c
+	defer func() { Client = old }()
+	returned := make(chan struct{})
+	c.pluginEntries["slow"] = pluginEntry{noFilter: []Handler{Handle(func(ctx *Context) {
+		defer close(returned)
+		select {
+		case <-ctx.Done():
+		case <-time.After(5 * time.Second):
+		}
+	})}}
+	start := time.Now()
+	c.dispatch(&CQEvent{PostType: "message", MessageType: "group", GroupID: 1})
+	select {
+	case <-returned:
+	default:
+		t.Fatal("dispatch should wait until the handler returns")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("handler should be canceled after the timeout, took %v", elapsed)
+	}
+	if stats := c.dispatcher.stats(); stats.SlowEvents != 1 {
+		t.Fatalf("slow events = %d, want 1", stats.SlowEvents)
+	}
+}
+
+// 不响应取消的 handler 仍然阻塞同一个会话，保证顺序
+func TestDispatchKeepsOrder(t *testing.T) {
+	c := newClient()
+	c.dispatcher = newDispatcher(DispatchConfig{})
+	c.dispatcher.timeout = 20 * time.Millisecond
+	finished := false
+	c.pluginEntries["stubborn"] = pluginEntry{noFilter: []Handler{func(ev *CQEvent) {
+		time.Sleep(100 * time.Millisecond)
+		finished = true
+	}}}
+	c.dispatch(&CQEvent{PostType: "message", MessageType: "group", GroupID: 1})
+	if !finished {
+		t.Fatal("dispatch should not return before the handler")
+	}
+}
+
+// detach 之后的 handler 不阻塞后续事件，也不会因为超时被取消
+func TestDispatchDetach(t *testing.T) {
+	c := newClient()
+	c.dispatcher = newDispatcher(DispatchConfig{})
+	c.dispatcher.timeout = 20 * time.Millisecond
+	old := Client
+	Client = c
+	defer func() { Client = old }()
+	release := make(chan struct{})
+	canceled := make(chan bool, 1)
+	c.pluginEntries["session"] = pluginEntry{noFilter: []Handler{Handle(func(ctx *Context) {
+		detach(ctx.Event)
+		<-release
+		canceled <- ctx.Err() != nil
+	})}}
+	start := time.Now()
+	c.dispatch(&CQEvent{PostType: "message", MessageType: "group", GroupID: 1})
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("detached handler should not block dispatch, took %v", elapsed)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	if <-canceled {
+		t.Fatal("detached handler should not be canceled by the dispatch timeout")
+	}
+	if stats := c.dispatcher.stats(); stats.SlowEvents != 0 {
+		t.Fatalf("slow events = %d, want 0", stats.SlowEvents)
+	}
+}
+
+// 快的 handler 完成后立即返回
+func TestDispatchWaitsHandlers(t *testing.T) {
+	c := newClient()
+	c.dispatcher = newDispatcher(DispatchConfig{})
+	handled := false
+	c.pluginEntries["fast"] = pluginEntry{noFilter: []Handler{func(ev *CQEvent) {
+		time.Sleep(10 * time.Millisecond)
+		handled = true
+	}}}
+	c.dispatch(&CQEvent{PostType: "message", MessageType: "private", UserID: 1})
+	if !handled {
+		t.Fatal("dispatch should wait for the handler")
+	}
+	if stats := c.dispatcher.stats(); stats.SlowEvents != 0 {
+		t.Fatalf("slow events = %d, want 0", stats.SlowEvents)
+	}
+}
@@ -0,0 +1,46 @@
+package coolq
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/haruno-bot/haruno/logger"
+)
+
+// eventPostSource http post 上报事件的日志域
+const eventPostSource = "coolq event post"
+
+// SetPostSecret 设置 http post 上报的签名密钥
+func (c *cqclient) SetPostSecret(secret string) {
+	c.postSecret = secret
+}
+
+// EventPostHandler 接收 coolq http api 通过 http post 上报的事件
+// 设置了 secret 时会检查 X-Signature 签名
+func (c *cqclient) EventPostHandler(w http.ResponseWriter, r *http.Request) {
+	raw, err := ioutil.ReadAll(io.LimitReader(r.Body, remoteMaxBodySize))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if c.postSecret != "" {
+		mac := hmac.New(sha1.New, []byte(c.postSecret))
+		mac.Write(raw)
+		expected := "sha1=" + hex.EncodeToString(mac.Sum(nil))
+		if !hmac.Equal([]byte(r.Header.Get("X-Signature")), []byte(expected)) {
+			logger.Field(eventPostSource).Error("invalid signature")
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+	}
+	if c.dispatcher == nil {
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	c.handleEvent(eventPostSource, raw)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,198 @@
+package coolq
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/haruno-bot/haruno/logger"
+)
+
+// 防循环的默认配置
+const (
+	defaultGuardWindow    = 10 * time.Second
+	defaultGuardThreshold = 5
+	defaultGuardCooldown  = 5 * time.Minute
+)
+
+// GuardConfig 防止机器人之间互相触发的配置
+type GuardConfig struct {
+	// Bots 已知的其他机器人的QQ号
+	Bots []int64 `toml:"bots"`
+	// Window 时间窗口（秒），窗口内一来一回的次数达到阈值时熔断
+	Window int `toml:"window"`
+	// Threshold 时间窗口内一来一回的次数阈值
+	Threshold int `toml:"threshold"`
+	// Cooldown 熔断后禁止插件发言的时间（秒）
+	Cooldown int `toml:"cooldown"`
+}
+
+// conversationGuard 单个群（或者私聊）的状态
+type conversationGuard struct {
+	lastSent   time.Time
+	exchanges  []time.Time
+	mutedUntil time.Time
+}
+
+// loopGuard 丢弃机器人自己的消息，并在和其他机器人快速的一来一回时熔断
+type loopGuard struct {
+	mu            sync.Mutex
+	bots          map[int64]bool
+	window        time.Duration
+	threshold     int
+	cooldown      time.Duration
+	conversations map[string]*conversationGuard
+	// lastPrune 上一次清理空闲会话的时间
+	lastPrune time.Time
+}
+
+func newLoopGuard(cfg GuardConfig) *loopGuard {
+	g := &loopGuard{
+		bots:          toSet(cfg.Bots),
+		window:        time.Duration(cfg.Window) * time.Second,
+		threshold:     cfg.Threshold,
+		cooldown:      time.Duration(cfg.Cooldown) * time.Second,
+		conversations: make(map[string]*conversationGuard),
+	}
+	if g.window <= 0 {
+		g.window = defaultGuardWindow
+	}
+	if g.threshold <= 0 {
+		g.threshold = defaultGuardThreshold
+	}
+	if g.cooldown <= 0 {
+		g.cooldown = defaultGuardCooldown
+	}
+	return g
+}
+
+// isSelf 机器人自己发出的消息
+func isSelf(event *CQEvent) bool {
+	if event.PostType == "message_sent" {
+		return true
+	}
+	return event.PostType == "message" && event.SelfID != 0 && event.UserID == event.SelfID
+}
+
+// idle 会话已经没有需要记录的状态：最后一次发言超过时间窗口并且不在熔断中
+func (conv *conversationGuard) idle(now time.Time, window time.Duration) bool {
+	return now.Sub(conv.lastSent) > window && !now.Before(conv.mutedUntil)
+}
+
+// pruneLocked 每个时间窗口清理一次空闲的会话，需要持有 mu
+func (g *loopGuard) pruneLocked(now time.Time) {
+	if now.Sub(g.lastPrune) < g.window {
+		return
+	}
+	g.lastPrune = now
+	for key, conv := range g.conversations {
+		if conv.idle(now, g.window) {
+			delete(g.conversations, key)
+		}
+	}
+}
+
+func (g *loopGuard) conversation(key string) *conversationGuard {
+	g.pruneLocked(time.Now())
+	conv, ok := g.conversations[key]
+	if !ok {
+		conv = new(conversationGuard)
+		g.conversations[key] = conv
+	}
+	return conv
+}
+
+// observe 记录来自其他机器人的消息
+// 在机器人发言后的时间窗口内收到其他机器人的消息视为一次一来一回
+func (g *loopGuard) observe(event *CQEvent) {
+	if event.PostType != "message" || !g.bots[event.UserID] {
+		return
+	}
+	key := conversationKey(event)
+	now := time.Now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	conv := g.conversation(key)
+	if now.Sub(conv.lastSent) > g.window {
+		return
+	}
+	valid := conv.exchanges[:0]
+	for _, t := range conv.exchanges {
+		if now.Sub(t) <= g.window {
+			valid = append(valid, t)
+		}
+	}
+	conv.exchanges = append(valid, now)
+	if len(conv.exchanges) >= g.threshold && now.After(conv.mutedUntil) {
+		conv.mutedUntil = now.Add(g.cooldown)
+		conv.exchanges = conv.exchanges[:0]
+		logger.Field("guard").WithFields(logger.Fields{
+			"user":         event.UserID,
+			"conversation": key,
+		}).Warnf("possible bot loop, plugins are muted for %v", g.cooldown)
+	}
+}
+
+// allowSend 检查是否允许发言，允许时记录发言时间
+func (g *loopGuard) allowSend(key string) bool {
+	now := time.Now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	conv := g.conversation(key)
+	if now.Before(conv.mutedUntil) {
+		return false
+	}
+	conv.lastSent = now
+	return true
+}
+
+// sendTarget 从发送消息的 action 中得到目标会话，不是发送消息时返回空
+func sendTarget(action string, params interface{}) string {
+	switch p := params.(type) {
+	case CQTypeSendGroupMsg:
+		return fmt.Sprintf("group:%d", p.GroupID)
+	case CQTypeSendPrivateMsg:
+		return fmt.Sprintf("private:%d", p.UserID)
+	case CQTypeSendGroupForwardMsg:
+		return fmt.Sprintf("group:%d", p.GroupID)
+	case CQTypeSendPrivateForwardMsg:
+		return fmt.Sprintf("private:%d", p.UserID)
+	}
+	switch action {
+	case ActionSendGroupMsg, ActionSendGroupForwardMsg:
+	case ActionSendPrivateMsg, ActionSendPrivateForwardMsg:
+	case ActionSendMsg:
+	default:
+		return ""
+	}
+	raw, err := json.Marshal(params)
+	if err != nil {
+		return ""
+	}
+	target := struct {
+		MessageType string `json:"message_type"`
+		GroupID     int64  `json:"group_id"`
+		UserID      int64  `json:"user_id"`
+	}{}
+	if err := json.Unmarshal(raw, &target); err != nil {
+		return ""
+	}
+	if action == ActionSendPrivateMsg || action == ActionSendPrivateForwardMsg || target.MessageType == "private" || (target.GroupID == 0 && target.UserID != 0) {
+		return fmt.Sprintf("private:%d", target.UserID)
+	}
+	return fmt.Sprintf("group:%d", target.GroupID)
+}
+
+// guardSend 发送消息之前检查熔断，熔断中的会话不允许发言
+func (c *cqclient) guardSend(action string, params interface{}) bool {
+	key := sendTarget(action, params)
+	if key == "" {
+		return true
+	}
+	if !c.guard.allowSend(key) {
+		logger.Field("guard").Infof("%s to %s is dropped, plugins are muted", action, key)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,41 @@
+package coolq
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoopGuardMute(t *testing.T) {
+	g := newLoopGuard(GuardConfig{Bots: []int64{2}, Threshold: 3})
+	event := &CQEvent{PostType: "message", MessageType: "group", GroupID: 1, UserID: 2}
+	for i := 0; i < 3; i++ {
+		if !g.allowSend("group:1") {
+			t.Fatalf("send %d should be allowed", i)
+		}
+		g.observe(event)
+	}
+	if g.allowSend("group:1") {
+		t.Fatal("conversation should be muted after the threshold")
+	}
+	if !g.allowSend("group:2") {
+		t.Fatal("other conversations should not be muted")
+	}
+}
+
+// 空闲的会话在下一个时间窗口被清理，熔断中的会话保留
+func TestLoopGuardPrune(t *testing.T) {
+	g := newLoopGuard(GuardConfig{})
+	now := time.Now()
+	g.conversations["group:1"] = &conversationGuard{lastSent: now.Add(-2 * g.window)}
+	g.conversations["group:2"] = &conversationGuard{lastSent: now.Add(-2 * g.window), mutedUntil: now.Add(time.Minute)}
+	g.conversations["group:3"] = &conversationGuard{lastSent: now}
+	g.pruneLocked(now)
+	if _, ok := g.conversations["group:1"]; ok {
+		t.Error("idle conversation should be pruned")
+	}
+	for _, key := range []string{"group:2", "group:3"} {
+		if _, ok := g.conversations[key]; !ok {
+			t.Errorf("%s should be kept", key)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package coolq
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/haruno-bot/haruno/clients"
+	"github.com/haruno-bot/haruno/logger"
+)
+
+// ProxyConfig 代理配置
+// 代理地址支持 http、https 和 socks5，用户名和密码写在地址中
+// 为空时使用环境变量中的代理，为 direct 时不使用代理
+type ProxyConfig struct {
+	// Default 默认http客户端和没有单独设置的插件使用的代理
+	Default string `toml:"default"`
+	// Backend 连接 coolq http api（websocket 和 http）使用的代理，后端通常在本机，默认为环境变量中的代理
+	Backend string `toml:"backend"`
+	// Plugins 每个插件单独使用的代理，键为插件的名称（name@version）
+	Plugins map[string]string `toml:"plugins"`
+}
+
+// EgressConfig 插件的出站限制
+// 每个插件的 http 客户端（ctx.HTTP() 或者 PluginHTTPClient）只能访问允许的域名
+type EgressConfig struct {
+	// Default 没有单独设置的插件使用的限制
+	Default clients.EgressPolicy `toml:"default"`
+	// Plugins 每个插件单独的限制，覆盖 Default
+	Plugins map[string]clients.EgressPolicy `toml:"plugins"`
+}
+
+var pluginClients = struct {
+	sync.Mutex
+	proxy   ProxyConfig
+	egress  EgressConfig
+	entries map[string]*clients.HTTPClient
+}{entries: make(map[string]*clients.HTTPClient)}
+
+// SetProxy 设置代理，需要在插件加载和 Client.Initialize 之前调用
+// 同时设置 clients.DefaultHTTPClient 和 coolq 连接的代理
+func SetProxy(cfg ProxyConfig) error {
+	for _, raw := range cfg.Plugins {
+		if _, err := clients.ParseProxy(raw); err != nil {
+			return err
+		}
+	}
+	if err := clients.DefaultHTTPClient.SetProxy(cfg.Default); err != nil {
+		return err
+	}
+	for _, conn := range []*clients.WSClient{Client.apiConn, Client.eventConn} {
+		if err := conn.SetProxy(cfg.Backend); err != nil {
+			return err
+		}
+	}
+	pluginClients.Lock()
+	defer pluginClients.Unlock()
+	pluginClients.proxy = cfg
+	pluginClients.entries = make(map[string]*clients.HTTPClient)
+	return nil
+}
+
+// SetEgress 设置插件的出站限制，需要在插件加载之前调用
+func SetEgress(cfg EgressConfig) {
+	pluginClients.Lock()
+	defer pluginClients.Unlock()
+	pluginClients.egress = cfg
+	pluginClients.entries = make(map[string]*clients.HTTPClient)
+}
+
+func pluginEgressLocked(plugin string) clients.EgressPolicy {
+	if policy, ok := pluginClients.egress.Plugins[plugin]; ok {
+		return policy
+	}
+	return pluginClients.egress.Default
+}
+
+// PluginEgressStats 每个插件的出站请求统计
+func PluginEgressStats() map[string]clients.EgressStats {
+	pluginClients.Lock()
+	defer pluginClients.Unlock()
+	stats := make(map[string]clients.EgressStats, len(pluginClients.entries))
+	for plugin, client := range pluginClients.entries {
+		stats[plugin] = client.EgressStats()
+	}
+	return stats
+}
+
+// backendProxy 连接 coolq http api 使用的代理
+func backendProxy() string {
+	pluginClients.Lock()
+	defer pluginClients.Unlock()
+	return pluginClients.proxy.Backend
+}
+
+// pluginProxy 插件使用的代理
+func pluginProxy(plugin string) string {
+	pluginClients.Lock()
+	defer pluginClients.Unlock()
+	return pluginProxyLocked(plugin)
+}
+
+func pluginProxyLocked(plugin string) string {
+	if raw, ok := pluginClients.proxy.Plugins[plugin]; ok {
+		return raw
+	}
+	return pluginClients.proxy.Default
+}
+
+// PluginHTTPClient 插件专用的http客户端，使用插件的代理配置和出站限制
+// 违反限制的请求会记录在插件的日志中
+func PluginHTTPClient(plugin string) *clients.HTTPClient {
+	pluginClients.Lock()
+	defer pluginClients.Unlock()
+	if client, ok := pluginClients.entries[plugin]; ok {
+		return client
+	}
+	client := clients.NewHTTPClient()
+	// 代理地址在 SetProxy 时已经检查过
+	client.SetProxy(pluginProxyLocked(plugin))
+	client.SetEgress(pluginEgressLocked(plugin))
+	log := logger.Field(plugin)
+	client.OnViolation = func(req *http.Request, err error) {
+		// 不记录完整的地址，参数中可能有密钥
+		log.WithFields(logger.Fields{
+			"method": req.Method,
+			"host":   req.URL.Host,
+			"path":   req.URL.Path,
+		}).Warnf("egress violation: %v", err)
+	}
+	pluginClients.entries[plugin] = client
+	return client
+}
@@ -0,0 +1,47 @@
+package coolq
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// coolq 的 websocket 连接使用 [proxy] 的 backend
+func TestSetProxyBackend(t *testing.T) {
+	connected := make(chan string, 1)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case connected <- r.Method + " " + r.Host:
+		default:
+		}
+		http.Error(w, "forbidden", http.StatusForbidden)
+	}))
+	defer proxy.Close()
+	old := Client
+	Client = newClient()
+	defer func() {
+		Client = old
+		SetProxy(ProxyConfig{})
+	}()
+	if err := SetProxy(ProxyConfig{Backend: "ftp://127.0.0.1"}); err == nil {
+		t.Fatal("invalid backend proxy should be rejected")
+	}
+	if err := SetProxy(ProxyConfig{Backend: proxy.URL}); err != nil {
+		t.Fatal(err)
+	}
+	if backendProxy() != proxy.URL {
+		t.Fatalf("backend proxy = %s", backendProxy())
+	}
+	Client.apiConn.Dial("ws://coolq.invalid:6700/api", nil)
+	defer Client.apiConn.Close(context.Background())
+	select {
+	case got := <-connected:
+		if got != "CONNECT coolq.invalid:6700" {
+			t.Fatalf("proxy received %s", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("websocket connection should go through the backend proxy")
+	}
+}
@@ -0,0 +1,104 @@
+package coolq
+
+import (
+	"fmt"
+	"path/filepath"
+	"plugin"
+	"runtime"
+
+	"github.com/haruno-bot/haruno/logger"
+)
+
+// PluginAPIVersion 插件接口的版本
+// 动态插件需要导出字符串变量 HarunoAPIVersion，加载时会检查是否一致
+const PluginAPIVersion = "1"
+
+// 动态插件导出的符号
+const (
+	symbolInstance   = "Instance"
+	symbolAPIVersion = "HarunoAPIVersion"
+)
+
+// LoadDynamicPlugins 扫描目录下使用 -buildmode=plugin 编译的 .so 文件并注册插件
+// 需要在 RegisterAllPlugins 之前调用
+func LoadDynamicPlugins(dir string) {
+	if dir == "" {
+		return
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.so"))
+	if err != nil {
+		logger.Errorf("Dynamic plugins can't be scanned, reason:\n %v", err)
+		return
+	}
+	registered := make(map[string]bool)
+	for _, plug := range entries {
+		registered[plug.Name()] = true
+	}
+	for _, file := range files {
+		plug, err := openPlugin(file)
+		if err != nil {
+			logger.Errorf("Dynamic plugin %s can't be loaded, reason:\n %v", file, err)
+			continue
+		}
+		name := plug.Name()
+		if registered[name] {
+			logger.Errorf("Dynamic plugin %s can't be loaded, reason:\n name %s conflicts with a registered plugin", file, name)
+			continue
+		}
+		registered[name] = true
+		PluginRegister(plug)
+		logger.Successf("Dynamic plugin %s is found in %s", name, file)
+	}
+}
+
+// symbolLookup 按名称查找插件导出的符号，*plugin.Plugin 实现了这个接口
+type symbolLookup interface {
+	Lookup(name string) (plugin.Symbol, error)
+}
+
+// openPlugin 打开 .so 文件，检查版本并取出导出的 Instance
+func openPlugin(file string) (PluginInterface, error) {
+	p, err := plugin.Open(file)
+	if err != nil {
+		// plugin.Open 的错误没有区分类型，ABI 不一致是最常见的原因
+		return nil, fmt.Errorf("plugin can't be opened, it must be built against the same haruno source and Go toolchain (%s): %v", runtime.Version(), err)
+	}
+	return lookupPlugin(p)
+}
+
+// lookupPlugin 检查导出的 HarunoAPIVersion 并取出导出的 Instance
+func lookupPlugin(p symbolLookup) (PluginInterface, error) {
+	if err := checkAPIVersion(p); err != nil {
+		return nil, err
+	}
+	sym, err := p.Lookup(symbolInstance)
+	if err != nil {
+		return nil, fmt.Errorf("exported variable %s is not found", symbolInstance)
+	}
+	switch instance := sym.(type) {
+	case *PluginInterface:
+		if *instance == nil {
+			return nil, fmt.Errorf("exported %s is nil", symbolInstance)
+		}
+		return *instance, nil
+	case PluginInterface:
+		return instance, nil
+	}
+	return nil, fmt.Errorf("exported %s (%T) does not implement coolq.PluginInterface", symbolInstance, sym)
+}
+
+// checkAPIVersion 检查导出的 HarunoAPIVersion 和 PluginAPIVersion 是否一致
+func checkAPIVersion(p symbolLookup) error {
+	sym, err := p.Lookup(symbolAPIVersion)
+	if err != nil {
+		return fmt.Errorf("exported variable %s is not found, plugin api version %s is required", symbolAPIVersion, PluginAPIVersion)
+	}
+	version, ok := sym.(*string)
+	if !ok {
+		return fmt.Errorf("exported %s must be a string, got %T", symbolAPIVersion, sym)
+	}
+	if *version != PluginAPIVersion {
+		return fmt.Errorf("plugin api version mismatch, plugin = %s, haruno = %s", *version, PluginAPIVersion)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package coolq
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"plugin"
+	"strings"
+	"testing"
+)
+
+// fakeSymbols 模拟动态插件导出的符号
+type fakeSymbols map[string]plugin.Symbol
+
+func (s fakeSymbols) Lookup(name string) (plugin.Symbol, error) {
+	if sym, ok := s[name]; ok {
+		return sym, nil
+	}
+	return nil, errors.New("plugin: symbol " + name + " not found")
+}
+
+func TestLookupPlugin(t *testing.T) {
+	version := PluginAPIVersion
+	other := "0"
+	var instance PluginInterface = newRemotePlugin(RemotePluginConfig{Name: "dynamic@test"})
+	var empty PluginInterface
+	cases := []struct {
+		name    string
+		symbols fakeSymbols
+		err     string
+	}{
+		{"pointer", fakeSymbols{symbolAPIVersion: &version, symbolInstance: &instance}, ""},
+		{"value", fakeSymbols{symbolAPIVersion: &version, symbolInstance: instance}, ""},
+		{"no version", fakeSymbols{symbolInstance: &instance}, "HarunoAPIVersion is not found"},
+		{"version mismatch", fakeSymbols{symbolAPIVersion: &other, symbolInstance: &instance}, "api version mismatch"},
+		{"version not string", fakeSymbols{symbolAPIVersion: new(int), symbolInstance: &instance}, "must be a string"},
+		{"no instance", fakeSymbols{symbolAPIVersion: &version}, "Instance is not found"},
+		{"nil instance", fakeSymbols{symbolAPIVersion: &version, symbolInstance: &empty}, "is nil"},
+		{"wrong type", fakeSymbols{symbolAPIVersion: &version, symbolInstance: new(int)}, "does not implement"},
+	}
+	for _, c := range cases {
+		plug, err := lookupPlugin(c.symbols)
+		if c.err == "" {
+			if err != nil || plug.Name() != "dynamic@test" {
+				t.Errorf("%s: lookupPlugin() = %v, %v", c.name, plug, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: lookupPlugin() error = %v, want %q", c.name, err, c.err)
+		}
+	}
+}
+
+// 无法打开的文件提示需要使用相同的源码和工具链编译
+func TestOpenPluginInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "broken.so")
+	if err := ioutil.WriteFile(file, []byte("not a plugin"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openPlugin(file); err == nil || !strings.Contains(err.Error(), "same haruno source") {
+		t.Errorf("openPlugin() error = %v", err)
+	}
+}
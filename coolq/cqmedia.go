@@ -0,0 +1,413 @@
+package coolq
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/haruno-bot/haruno/clients"
+	"github.com/haruno-bot/haruno/logger"
+)
+
+// 媒体文件的默认配置
+const (
+	defaultMediaMaxSize  = 10 << 20
+	defaultMediaTTLHours = 7 * 24
+	defaultMediaURLTTL   = 60
+	mediaSweepInterval   = time.Hour
+)
+
+// defaultMediaTypes 默认允许下载的类型
+var defaultMediaTypes = []string{"image/", "audio/", "video/"}
+
+// mediaNamePattern 缓存的文件名 sha256.扩展名，清理时只删除这样的文件
+var mediaNamePattern = regexp.MustCompile(`^[0-9a-f]{64}\.[0-9A-Za-z]+$`)
+
+// mediaTempPrefix 下载中的临时文件的前缀
+const mediaTempPrefix = "download-"
+
+// 媒体文件下载的错误
+var (
+	// ErrMediaInUse 媒体文件服务已经开始使用，不能再替换
+	ErrMediaInUse = errors.New("media: service is already in use")
+	// ErrMediaTooLarge 文件超过大小限制
+	ErrMediaTooLarge = errors.New("media: file is too large")
+	// ErrMediaType 文件类型不允许下载
+	ErrMediaType = errors.New("media: content type is not allowed")
+)
+
+// MediaConfig 媒体文件下载和缓存的配置
+type MediaConfig struct {
+	// Dir 缓存目录，默认为数据目录下的 media
+	Dir string `toml:"dir"`
+	// MaxSize 单个文件的最大长度（字节）
+	MaxSize int64 `toml:"maxSize"`
+	// ContentTypes 允许下载的类型（前缀匹配），默认为图片、音频和视频
+	ContentTypes []string `toml:"contentTypes"`
+	// TTL 文件在最后一次使用后保留的时间（小时）
+	TTL int `toml:"ttl"`
+	// URLTTL 同一个地址在这个时间（分钟）之内直接使用下载过的文件，之后重新下载
+	URLTTL int `toml:"urlTTL"`
+	// Base64 发送时使用 base64:// 而不是 file://，后端和晴乃不在同一台机器上时需要开启
+	Base64 bool `toml:"base64"`
+}
+
+// MediaFile 缓存的媒体文件
+type MediaFile struct {
+	// Path 文件的绝对路径
+	Path string `json:"path"`
+	// Hash 文件内容的 sha256
+	Hash        string `json:"hash"`
+	ContentType string `json:"contentType"`
+	Size        int64  `json:"size"`
+	// URL 下载的地址
+	URL string `json:"url"`
+}
+
+// mediaURL 下载过的地址
+type mediaURL struct {
+	// name 文件名
+	name string
+	// fetched 下载的时间
+	fetched time.Time
+}
+
+// MediaService 下载远程的图片、语音等文件，按内容保存在缓存目录中
+type MediaService struct {
+	mu     sync.Mutex
+	cfg    MediaConfig
+	ttl    time.Duration
+	urlTTL time.Duration
+	client *clients.HTTPClient
+	// urls 下载过的地址对应的文件
+	urls  map[string]mediaURL
+	sweep sync.Once
+	// used 已经开始下载文件
+	used  int32
+	stop  chan struct{}
+	close sync.Once
+}
+
+// Media 全局的媒体文件服务
+var Media = newMediaService(MediaConfig{})
+
+func newMediaService(cfg MediaConfig) *MediaService {
+	if cfg.MaxSize <= 0 {
+		cfg.MaxSize = defaultMediaMaxSize
+	}
+	if len(cfg.ContentTypes) == 0 {
+		cfg.ContentTypes = defaultMediaTypes
+	}
+	if cfg.TTL <= 0 {
+		cfg.TTL = defaultMediaTTLHours
+	}
+	if cfg.URLTTL <= 0 {
+		cfg.URLTTL = defaultMediaURLTTL
+	}
+	return &MediaService{
+		cfg:    cfg,
+		ttl:    time.Duration(cfg.TTL) * time.Hour,
+		urlTTL: time.Duration(cfg.URLTTL) * time.Minute,
+		client: clients.NewHTTPClient(),
+		urls:   make(map[string]mediaURL),
+		stop:   make(chan struct{}),
+	}
+}
+
+// SetMedia 设置媒体文件服务，需要在 SetProxy 之后、加载插件之前调用
+// Media 没有加锁，插件开始使用之后不能再替换，此时返回 ErrMediaInUse
+func SetMedia(cfg MediaConfig) error {
+	if atomic.LoadInt32(&Media.used) != 0 {
+		return ErrMediaInUse
+	}
+	media := newMediaService(cfg)
+	// 代理地址在 SetProxy 时已经检查过
+	media.client.SetProxy(pluginProxy(""))
+	Media.Close()
+	Media = media
+	return nil
+}
+
+// Close 停止定时清理
+func (m *MediaService) Close() {
+	m.close.Do(func() {
+		close(m.stop)
+	})
+}
+
+// dir 缓存目录
+func (m *MediaService) dir() string {
+	if m.cfg.Dir != "" {
+		return m.cfg.Dir
+	}
+	storages.Lock()
+	defer storages.Unlock()
+	return path.Join(storages.dataPath, "media")
+}
+
+func (m *MediaService) allowed(contentType string) bool {
+	for _, prefix := range m.cfg.ContentTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// cached 在 urlTTL 之内下载过并且文件还在时返回文件
+// 超过 urlTTL 后重新下载，内容没有变化时仍然使用同一个文件
+func (m *MediaService) cached(url string) *MediaFile {
+	m.mu.Lock()
+	u, ok := m.urls[url]
+	m.mu.Unlock()
+	if !ok || time.Since(u.fetched) > m.urlTTL {
+		return nil
+	}
+	file := filepath.Join(m.dir(), u.name)
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil
+	}
+	// 用修改时间记录最后一次使用的时间
+	now := time.Now()
+	os.Chtimes(file, now, now)
+	return m.fileInfo(file, info.Size(), url)
+}
+
+func (m *MediaService) fileInfo(file string, size int64, url string) *MediaFile {
+	abs, _ := filepath.Abs(file)
+	name := filepath.Base(file)
+	ext := filepath.Ext(name)
+	return &MediaFile{
+		Path:        abs,
+		Hash:        strings.TrimSuffix(name, ext),
+		ContentType: mime.TypeByExtension(ext),
+		Size:        size,
+		URL:         url,
+	}
+}
+
+// Download 下载文件到缓存目录，已经下载过的地址直接返回缓存的文件
+// client 为 nil 时使用服务自己的客户端，需要代理的插件可以传入 ctx.HTTP()
+func (m *MediaService) Download(ctx context.Context, client *clients.HTTPClient, url string) (*MediaFile, error) {
+	m.sweep.Do(func() {
+		atomic.StoreInt32(&m.used, 1)
+		go m.sweepLoop()
+	})
+	if file := m.cached(url); file != nil {
+		return file, nil
+	}
+	if client == nil {
+		client = m.client
+	}
+	req, err := client.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, &clients.HTTPStatusError{URL: url, Status: res.Status, StatusCode: res.StatusCode}
+	}
+	if res.ContentLength > m.cfg.MaxSize {
+		return nil, ErrMediaTooLarge
+	}
+	// 先读出开头判断类型
+	head := make([]byte, 512)
+	n, err := io.ReadFull(res.Body, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	head = head[:n]
+	contentType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if contentType == "" || contentType == "application/octet-stream" {
+		contentType, _, _ = mime.ParseMediaType(http.DetectContentType(head))
+	}
+	if !m.allowed(contentType) {
+		return nil, ErrMediaType
+	}
+	dir := m.dir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempFile(dir, mediaTempPrefix)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	hash := sha256.New()
+	body := io.MultiReader(strings.NewReader(string(head)), res.Body)
+	size, err := io.Copy(io.MultiWriter(tmp, hash), io.LimitReader(body, m.cfg.MaxSize+1))
+	tmp.Close()
+	if err != nil {
+		return nil, err
+	}
+	if size > m.cfg.MaxSize {
+		return nil, ErrMediaTooLarge
+	}
+	name := hex.EncodeToString(hash.Sum(nil)) + mediaExt(contentType)
+	file := filepath.Join(dir, name)
+	// 相同内容的文件只保存一份
+	if _, err := os.Stat(file); err == nil {
+		now := time.Now()
+		os.Chtimes(file, now, now)
+	} else if err := os.Rename(tmp.Name(), file); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	m.urls[url] = mediaURL{name: name, fetched: time.Now()}
+	m.mu.Unlock()
+	return m.fileInfo(file, size, url), nil
+}
+
+// mediaExt 根据类型得到扩展名
+func mediaExt(contentType string) string {
+	switch contentType {
+	case "image/jpeg":
+		return ".jpg"
+	case "image/png":
+		return ".png"
+	case "image/gif":
+		return ".gif"
+	case "image/webp":
+		return ".webp"
+	}
+	exts, _ := mime.ExtensionsByType(contentType)
+	if len(exts) > 0 {
+		return exts[0]
+	}
+	return ".bin"
+}
+
+// Source 下载文件并返回可以用于发送的地址（file:// 或者 base64://）
+func (m *MediaService) Source(ctx context.Context, client *clients.HTTPClient, url string) (string, error) {
+	file, err := m.Download(ctx, client, url)
+	if err != nil {
+		return "", err
+	}
+	return m.FileSource(file)
+}
+
+// FileSource 缓存的文件用于发送的地址
+func (m *MediaService) FileSource(file *MediaFile) (string, error) {
+	if !m.cfg.Base64 {
+		return "file:///" + strings.TrimPrefix(filepath.ToSlash(file.Path), "/"), nil
+	}
+	raw, err := ioutil.ReadFile(file.Path)
+	if err != nil {
+		return "", err
+	}
+	return "base64://" + base64.StdEncoding.EncodeToString(raw), nil
+}
+
+// ImageSection 下载图片并创建图片段落
+func (m *MediaService) ImageSection(ctx context.Context, client *clients.HTTPClient, url string) (Section, error) {
+	src, err := m.Source(ctx, client, url)
+	if err != nil {
+		return Section{}, err
+	}
+	return NewImageSection(src), nil
+}
+
+// RecordSection 下载语音并创建语音段落
+func (m *MediaService) RecordSection(ctx context.Context, client *clients.HTTPClient, url string) (Section, error) {
+	src, err := m.Source(ctx, client, url)
+	if err != nil {
+		return Section{}, err
+	}
+	return NewSection("record", map[string]string{"file": Escape(src)}), nil
+}
+
+// Archive 下载事件消息中的图片和语音，保存到缓存目录
+// 单个文件下载失败时跳过，返回最后一个错误
+func (m *MediaService) Archive(ctx context.Context, client *clients.HTTPClient, event *CQEvent) ([]*MediaFile, error) {
+	msg := NewMessage()
+	if err := Unmarshal([]byte(event.Message), &msg); err != nil {
+		return nil, err
+	}
+	files := make([]*MediaFile, 0)
+	var lastErr error
+	for _, section := range msg {
+		if section.Type != "image" && section.Type != "record" {
+			continue
+		}
+		url := Unescape(section.Data["url"])
+		if url == "" {
+			url = Unescape(section.Data["file"])
+		}
+		if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+			continue
+		}
+		file, err := m.Download(ctx, client, url)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		files = append(files, file)
+	}
+	return files, lastErr
+}
+
+// sweepLoop 定时删除超过保留时间没有使用的文件，调用 Close 后退出
+func (m *MediaService) sweepLoop() {
+	ticker := time.NewTicker(mediaSweepInterval)
+	defer ticker.Stop()
+	for {
+		m.Sweep()
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sweep 删除超过保留时间没有使用的文件
+// 只删除服务自己创建的文件（缓存的文件和残留的临时文件），缓存目录中的其他文件不受影响
+func (m *MediaService) Sweep() {
+	dir := m.dir()
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	deadline := now.Add(-m.ttl)
+	removed := make(map[string]bool)
+	for _, info := range infos {
+		if info.IsDir() || info.ModTime().After(deadline) {
+			continue
+		}
+		if !mediaNamePattern.MatchString(info.Name()) && !strings.HasPrefix(info.Name(), mediaTempPrefix) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, info.Name())); err != nil {
+			logger.Errorf("media: remove expired file error: %v", err)
+			continue
+		}
+		removed[info.Name()] = true
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for url, u := range m.urls {
+		if removed[u.name] || now.Sub(u.fetched) > m.urlTTL {
+			delete(m.urls, url)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package coolq
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var pngHeader = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+// 同一个地址超过 urlTTL 之后重新下载
+func TestMediaURLTTL(t *testing.T) {
+	var requests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(pngHeader)
+	}))
+	defer server.Close()
+	m := newMediaService(MediaConfig{Dir: filepath.Join(storages.dataPath, "media-ttl")})
+	defer m.Close()
+	first, err := m.Download(context.Background(), nil, server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Download(context.Background(), nil, server.URL); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt64(&requests); n != 1 {
+		t.Fatalf("second download should use the cached file, %d requests", n)
+	}
+	m.mu.Lock()
+	u := m.urls[server.URL]
+	u.fetched = time.Now().Add(-m.urlTTL - time.Second)
+	m.urls[server.URL] = u
+	m.mu.Unlock()
+	again, err := m.Download(context.Background(), nil, server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt64(&requests); n != 2 {
+		t.Fatalf("expired url should be downloaded again, %d requests", n)
+	}
+	if again.Path != first.Path {
+		t.Errorf("same content should use the same file: %s, %s", first.Path, again.Path)
+	}
+}
+
+func TestMediaClose(t *testing.T) {
+	m := newMediaService(MediaConfig{Dir: filepath.Join(storages.dataPath, "media-close")})
+	done := make(chan struct{})
+	go func() {
+		m.sweepLoop()
+		close(done)
+	}()
+	m.Close()
+	m.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("sweep loop should exit after Close")
+	}
+}
+
+// 清理只删除服务自己创建的文件
+func TestMediaSweepOwnFiles(t *testing.T) {
+	dir := filepath.Join(storages.dataPath, "media-shared")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	m := newMediaService(MediaConfig{Dir: dir})
+	defer m.Close()
+	cached := strings.Repeat("ab", 32) + ".png"
+	names := []string{cached, mediaTempPrefix + "123", "plugin.json", "deadletter.log", strings.Repeat("ab", 32) + ".png.bak"}
+	old := time.Now().Add(-2 * m.ttl)
+	for _, name := range names {
+		file := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(file, []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(file, old, old)
+	}
+	m.Sweep()
+	for i, name := range names {
+		_, err := os.Stat(filepath.Join(dir, name))
+		if removed := os.IsNotExist(err); removed != (i < 2) {
+			t.Errorf("%s: removed = %v", name, removed)
+		}
+	}
+}
+
+// 开始使用之后不能再替换媒体文件服务
+func TestSetMediaInUse(t *testing.T) {
+	old := Media
+	defer func() { Media = old }()
+	Media = newMediaService(MediaConfig{})
+	if err := SetMedia(MediaConfig{}); err != nil {
+		t.Fatalf("unused service should be replaced: %v", err)
+	}
+	atomic.StoreInt32(&Media.used, 1)
+	if err := SetMedia(MediaConfig{}); err != ErrMediaInUse {
+		t.Fatalf("SetMedia() = %v, want %v", err, ErrMediaInUse)
+	}
+}
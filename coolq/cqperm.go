@@ -0,0 +1,178 @@
+package coolq
+
+import (
+	"sync"
+
+	"github.com/haruno-bot/haruno/logger"
+)
+
+// Role 触发者的权限等级
+type Role int
+
+// 权限等级从低到高
+const (
+	// RoleMember 普通成员（私聊也视为普通成员）
+	RoleMember Role = iota
+	// RoleAdmin 群管理员
+	RoleAdmin
+	// RoleOwner 群主
+	RoleOwner
+	// RoleSuperUser 机器人的超级用户（配置文件中设置）
+	RoleSuperUser
+)
+
+var roleStr = []string{"member", "admin", "owner", "superuser"}
+
+func (r Role) String() string {
+	if r < RoleMember || r > RoleSuperUser {
+		return "unknown"
+	}
+	return roleStr[r]
+}
+
+// GroupPermission 单个群的权限名单
+type GroupPermission struct {
+	// GroupID 群号
+	GroupID int64 `toml:"id"`
+	// Allow 白名单，不为空时只有名单内的用户可以触发需要权限的 handler
+	Allow []int64 `toml:"allow"`
+	// Deny 黑名单，名单内的用户不能触发需要权限的 handler
+	Deny []int64 `toml:"deny"`
+}
+
+// PermissionConfig 权限配置
+type PermissionConfig struct {
+	// SuperUsers 超级用户，拥有所有权限
+	SuperUsers []int64 `toml:"superusers"`
+	// Groups 每个群的白名单和黑名单
+	Groups []GroupPermission `toml:"groups"`
+}
+
+// PermissionProvider 插件可以选择实现的接口
+// 返回的 map 以 Handlers() 中的 key 为键，对应 handler 需要的最低权限
+type PermissionProvider interface {
+	Permissions() map[string]Role
+}
+
+type groupLists struct {
+	allow map[int64]bool
+	deny  map[int64]bool
+}
+
+// permission 权限检查
+type permission struct {
+	mu         sync.RWMutex
+	superUsers map[int64]bool
+	groups     map[int64]*groupLists
+}
+
+func newPermission() *permission {
+	return &permission{
+		superUsers: make(map[int64]bool),
+		groups:     make(map[int64]*groupLists),
+	}
+}
+
+func toSet(ids []int64) map[int64]bool {
+	set := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		set[id] = true
+	}
+	return set
+}
+
+func (p *permission) load(cfg PermissionConfig) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.superUsers = toSet(cfg.SuperUsers)
+	p.groups = make(map[int64]*groupLists, len(cfg.Groups))
+	for _, group := range cfg.Groups {
+		p.groups[group.GroupID] = &groupLists{
+			allow: toSet(group.Allow),
+			deny:  toSet(group.Deny),
+		}
+	}
+}
+
+func (p *permission) isSuperUser(userID int64) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.superUsers[userID]
+}
+
+func (p *permission) superUserList() []int64 {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	ids := make([]int64, 0, len(p.superUsers))
+	for id := range p.superUsers {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// roleOf 根据事件的发送者得到权限等级
+func (p *permission) roleOf(event *CQEvent) Role {
+	if p.isSuperUser(event.UserID) {
+		return RoleSuperUser
+	}
+	if event.MessageType != "group" {
+		return RoleMember
+	}
+	switch event.Sender.Role {
+	case "owner":
+		return RoleOwner
+	case "admin":
+		return RoleAdmin
+	}
+	return RoleMember
+}
+
+// listed 检查群的黑白名单，返回是否通过
+func (p *permission) listed(event *CQEvent) bool {
+	if event.GroupID == 0 {
+		return true
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	lists, ok := p.groups[event.GroupID]
+	if !ok {
+		return true
+	}
+	if lists.deny[event.UserID] {
+		return false
+	}
+	if len(lists.allow) > 0 && !lists.allow[event.UserID] {
+		return false
+	}
+	return true
+}
+
+// check 检查事件的触发者是否满足权限要求
+func (p *permission) check(event *CQEvent, required Role) bool {
+	role := p.roleOf(event)
+	if role == RoleSuperUser {
+		return true
+	}
+	if !p.listed(event) {
+		return false
+	}
+	return role >= required
+}
+
+// guard 为 handler 加上权限检查，没有通过的尝试会记录到日志
+func (p *permission) guard(name string, required Role, handler Handler) Handler {
+	return func(event *CQEvent) {
+		if !p.check(event, required) {
+			logger.Field("permission").Warnf("denied %s: user %d (role %s) in group %d requires %s",
+				name, event.UserID, p.roleOf(event), event.GroupID, required)
+			return
+		}
+		handler(event)
+	}
+}
+
+// Require 为 handler 加上权限要求
+// 只有权限等级不低于 role，并且通过群黑白名单的用户才能触发
+func Require(role Role, handler Handler) Handler {
+	return Client.perm.guard("handler", role, handler)
+}
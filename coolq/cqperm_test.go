@@ -0,0 +1,95 @@
+package coolq
+
+import "testing"
+
+func permEvent(groupID, userID int64, role string) *CQEvent {
+	event := &CQEvent{GroupID: groupID, UserID: userID}
+	if groupID != 0 {
+		event.MessageType = "group"
+	} else {
+		event.MessageType = "private"
+	}
+	event.Sender.Role = role
+	return event
+}
+
+// 权限等级按 member < admin < owner < superuser 排序
+func TestPermissionRoles(t *testing.T) {
+	p := newPermission()
+	p.load(PermissionConfig{SuperUsers: []int64{1}})
+	cases := []struct {
+		event    *CQEvent
+		role     Role
+		required Role
+		ok       bool
+	}{
+		{permEvent(100, 2, "member"), RoleMember, RoleMember, true},
+		{permEvent(100, 2, "member"), RoleMember, RoleAdmin, false},
+		{permEvent(100, 2, "admin"), RoleAdmin, RoleAdmin, true},
+		{permEvent(100, 2, "admin"), RoleAdmin, RoleOwner, false},
+		{permEvent(100, 2, "owner"), RoleOwner, RoleAdmin, true},
+		{permEvent(100, 2, "owner"), RoleOwner, RoleSuperUser, false},
+		// 私聊时忽略群角色
+		{permEvent(0, 2, "owner"), RoleMember, RoleAdmin, false},
+		{permEvent(0, 1, ""), RoleSuperUser, RoleSuperUser, true},
+		{permEvent(100, 1, "member"), RoleSuperUser, RoleOwner, true},
+	}
+	for i, c := range cases {
+		if role := p.roleOf(c.event); role != c.role {
+			t.Errorf("case %d: roleOf() = %s, want %s", i, role, c.role)
+		}
+		if ok := p.check(c.event, c.required); ok != c.ok {
+			t.Errorf("case %d: check(%s) = %v, want %v", i, c.required, ok, c.ok)
+		}
+	}
+}
+
+// 群的黑白名单只作用于对应的群，超级用户不受名单限制
+func TestPermissionGroupLists(t *testing.T) {
+	p := newPermission()
+	p.load(PermissionConfig{
+		SuperUsers: []int64{1},
+		Groups: []GroupPermission{
+			{GroupID: 100, Allow: []int64{2, 3}, Deny: []int64{3}},
+			{GroupID: 200, Deny: []int64{2}},
+		},
+	})
+	cases := []struct {
+		event *CQEvent
+		ok    bool
+	}{
+		{permEvent(100, 2, "member"), true},
+		// 黑名单优先于白名单
+		{permEvent(100, 3, "owner"), false},
+		{permEvent(100, 4, "owner"), false},
+		{permEvent(100, 1, "member"), true},
+		{permEvent(200, 2, "owner"), false},
+		{permEvent(200, 4, "member"), true},
+		{permEvent(200, 1, "member"), true},
+		// 没有配置的群和私聊不限制
+		{permEvent(300, 3, "member"), true},
+		{permEvent(0, 3, ""), true},
+	}
+	for i, c := range cases {
+		if ok := p.check(c.event, RoleMember); ok != c.ok {
+			t.Errorf("case %d: check() = %v, want %v", i, ok, c.ok)
+		}
+	}
+}
+
+// 没有通过检查的 handler 不会执行
+func TestPermissionGuard(t *testing.T) {
+	p := newPermission()
+	p.load(PermissionConfig{SuperUsers: []int64{1}})
+	called := 0
+	handler := p.guard("test", RoleAdmin, func(event *CQEvent) { called++ })
+	handler(permEvent(100, 2, "member"))
+	if called != 0 {
+		t.Error("member should not trigger admin handler")
+	}
+	handler(permEvent(100, 2, "admin"))
+	handler(permEvent(100, 1, "member"))
+	if called != 2 {
+		t.Errorf("called = %d, want 2", called)
+	}
+}
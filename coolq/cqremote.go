@@ -0,0 +1,330 @@
+package coolq
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/haruno-bot/haruno/clients"
+	"github.com/haruno-bot/haruno/logger"
+)
+
+// 远程插件请求相关的http头
+const (
+	// RemoteSignatureHeader 请求的签名 sha256=hex(hmac_sha256(secret, timestamp + "." + body))
+	RemoteSignatureHeader = "X-Haruno-Signature"
+	// RemoteTimestampHeader 签名时的unix时间戳（秒），参与签名
+	RemoteTimestampHeader = "X-Haruno-Timestamp"
+	// RemotePluginHeader 调用 action 的远程插件名称
+	RemotePluginHeader = "X-Haruno-Plugin"
+)
+
+// remoteDefaultTimeout 推送事件的默认超时时间
+const remoteDefaultTimeout = 10 * time.Second
+
+// remoteMaxBodySize 响应和请求体的最大长度
+const remoteMaxBodySize = 1 << 20
+
+// remoteMaxSkew 调用 action 的请求时间戳和本机时间最多相差的时间
+// 超出的请求被拒绝，窗口内的签名只能使用一次
+const remoteMaxSkew = 5 * time.Minute
+
+// RemotePluginConfig 远程（webhook）插件配置
+type RemotePluginConfig struct {
+	// Name 插件名称
+	Name string `toml:"name"`
+	// URL 接收事件的地址
+	URL string `toml:"url"`
+	// Secret 签名密钥，推送事件和调用 action 都使用它签名，不能为空
+	Secret string `toml:"secret"`
+	// Timeout 推送事件的超时时间（秒）
+	Timeout int `toml:"timeout"`
+	// PostTypes 推送的事件类型，为空时推送所有事件
+	PostTypes []string `toml:"postTypes"`
+	// Groups 推送的群，为空时不限制（只限制群事件）
+	Groups []int64 `toml:"groups"`
+	// Actions 允许调用的api，为空时不限制
+	Actions []string `toml:"actions"`
+}
+
+// RemoteAction 远程插件返回或者请求的 action
+type RemoteAction struct {
+	Action string          `json:"action"`
+	Params json.RawMessage `json:"params"`
+}
+
+// RemoteResponse 远程插件对推送事件的响应
+type RemoteResponse struct {
+	Actions []RemoteAction `json:"actions"`
+}
+
+// remotePlugin 通过http推送事件的远程插件
+type remotePlugin struct {
+	cfg       RemotePluginConfig
+	log       logger.LogInterface
+	client    *clients.HTTPClient
+	postTypes map[string]bool
+	groups    map[int64]bool
+	actions   map[string]bool
+	replay    *replayGuard
+}
+
+// replayGuard 记录时间窗口内用过的签名，防止请求被重放
+type replayGuard struct {
+	mu        sync.Mutex
+	seen      map[string]time.Time
+	lastPrune time.Time
+}
+
+func newReplayGuard() *replayGuard {
+	return &replayGuard{seen: make(map[string]time.Time)}
+}
+
+// check 签名在窗口内没有用过时记录下来并返回 true
+// 时间戳只能在本机时间前后 remoteMaxSkew 之内，所以记录保留 2 * remoteMaxSkew 就足够了
+func (g *replayGuard) check(signature string, now time.Time) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if now.Sub(g.lastPrune) >= remoteMaxSkew {
+		for sig, at := range g.seen {
+			if now.Sub(at) > 2*remoteMaxSkew {
+				delete(g.seen, sig)
+			}
+		}
+		g.lastPrune = now
+	}
+	if _, ok := g.seen[signature]; ok {
+		return false
+	}
+	g.seen[signature] = now
+	return true
+}
+
+var remotePlugins = struct {
+	sync.RWMutex
+	entries map[string]*remotePlugin
+}{entries: make(map[string]*remotePlugin)}
+
+func newRemotePlugin(cfg RemotePluginConfig) *remotePlugin {
+	client := clients.NewHTTPClient()
+	client.SetProxy(pluginProxy(cfg.Name))
+	client.DefaultTimeout = remoteDefaultTimeout
+	if cfg.Timeout > 0 {
+		client.DefaultTimeout = time.Duration(cfg.Timeout) * time.Second
+	}
+	return &remotePlugin{
+		cfg:       cfg,
+		log:       logger.Field(cfg.Name),
+		client:    client,
+		postTypes: toStrSet(cfg.PostTypes),
+		groups:    toSet(cfg.Groups),
+		actions:   toStrSet(cfg.Actions),
+		replay:    newReplayGuard(),
+	}
+}
+
+// RegisterRemotePlugins 注册所有的远程插件
+// 需要在 RegisterAllPlugins 之前调用
+func RegisterRemotePlugins(cfgs []RemotePluginConfig) {
+	remotePlugins.Lock()
+	defer remotePlugins.Unlock()
+	for _, cfg := range cfgs {
+		plug := newRemotePlugin(cfg)
+		remotePlugins.entries[cfg.Name] = plug
+		PluginRegister(plug)
+	}
+}
+
+// sign 计算签名，时间戳和请求体用 "." 连接
+func sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// verify 检查调用 action 的请求的时间戳和签名，并拒绝重放的请求
+func (p *remotePlugin) verify(header http.Header, body []byte, now time.Time) error {
+	timestamp := header.Get(RemoteTimestampHeader)
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp %q", timestamp)
+	}
+	skew := now.Sub(time.Unix(unix, 0))
+	if skew > remoteMaxSkew || skew < -remoteMaxSkew {
+		return fmt.Errorf("timestamp is out of range: %v", skew)
+	}
+	signature := header.Get(RemoteSignatureHeader)
+	if !hmac.Equal([]byte(signature), []byte(sign(p.cfg.Secret, timestamp, body))) {
+		return errors.New("invalid signature")
+	}
+	if !p.replay.check(signature, now) {
+		return errors.New("replayed request")
+	}
+	return nil
+}
+
+// Name 插件名称
+func (p *remotePlugin) Name() string {
+	return p.cfg.Name
+}
+
+// Load 检查配置
+func (p *remotePlugin) Load() error {
+	if p.cfg.URL == "" {
+		return fmt.Errorf("remote plugin %s: url is not set", p.cfg.Name)
+	}
+	if p.cfg.Secret == "" {
+		return fmt.Errorf("remote plugin %s: secret is not set", p.cfg.Name)
+	}
+	return nil
+}
+
+// Filters 按配置过滤推送的事件
+func (p *remotePlugin) Filters() map[string]Filter {
+	return map[string]Filter{
+		"event": p.filter,
+	}
+}
+
+// Handlers 把事件推送到远程地址
+func (p *remotePlugin) Handlers() map[string]Handler {
+	return map[string]Handler{
+		"event": p.push,
+	}
+}
+
+// Loaded 加载完成
+func (p *remotePlugin) Loaded() {
+}
+
+func (p *remotePlugin) filter(event *CQEvent) bool {
+	if len(p.postTypes) > 0 && !p.postTypes[event.PostType] {
+		return false
+	}
+	if len(p.groups) > 0 && event.GroupID != 0 && !p.groups[event.GroupID] {
+		return false
+	}
+	return true
+}
+
+func (p *remotePlugin) push(event *CQEvent) {
+	body := event.Raw()
+	req, err := p.client.NewRequest(http.MethodPost, p.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		p.log.Errorf("push event error: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(RemoteTimestampHeader, timestamp)
+	req.Header.Set(RemoteSignatureHeader, sign(p.cfg.Secret, timestamp, body))
+	res, err := p.client.Do(req)
+	if err != nil {
+		p.log.Errorf("push event error: %v", err)
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNoContent {
+		return
+	}
+	if res.StatusCode != http.StatusOK {
+		p.log.Errorf("push event error: unexpected status %s", res.Status)
+		return
+	}
+	raw, err := ioutil.ReadAll(io.LimitReader(res.Body, remoteMaxBodySize))
+	if err != nil {
+		p.log.Errorf("read response error: %v", err)
+		return
+	}
+	if len(bytes.TrimSpace(raw)) == 0 {
+		return
+	}
+	response := new(RemoteResponse)
+	if err := json.Unmarshal(raw, response); err != nil {
+		p.log.Errorf("invalid response: %v", err)
+		return
+	}
+	for _, action := range response.Actions {
+		p.call(action)
+	}
+}
+
+// call 执行远程插件的 action
+func (p *remotePlugin) call(action RemoteAction) (*CQResponse, error) {
+	if len(p.actions) > 0 && !p.actions[action.Action] {
+		err := fmt.Errorf("action is not allowed: %s", action.Action)
+		p.log.Error(err)
+		return nil, err
+	}
+	var params interface{} = map[string]interface{}{}
+	if len(action.Params) > 0 {
+		params = action.Params
+	}
+	res, err := Client.CallAction(action.Action, params)
+	if err != nil {
+		p.log.Errorf("call action %s error: %v", action.Action, err)
+	}
+	return res, err
+}
+
+// RemoteActionHandler 远程插件调用 action 的入口
+// 请求头需要带上插件名称 X-Haruno-Plugin、时间戳 X-Haruno-Timestamp 和签名 X-Haruno-Signature
+// 时间戳和本机相差超过 5 分钟或者签名已经用过的请求会被拒绝
+// 请求体为一个 action 或者 action 的数组，异步执行，立即返回 202
+func RemoteActionHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.Header.Get(RemotePluginHeader)
+	remotePlugins.RLock()
+	plug := remotePlugins.entries[name]
+	remotePlugins.RUnlock()
+	if plug == nil || plug.cfg.Secret == "" {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, remoteMaxBodySize))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if err := plug.verify(r.Header, body, time.Now()); err != nil {
+		plug.log.Errorf("call action denied: %v", err)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	actions := make([]RemoteAction, 0)
+	body = bytes.TrimSpace(body)
+	if strings.HasPrefix(string(body), "[") {
+		err = json.Unmarshal(body, &actions)
+	} else {
+		action := RemoteAction{}
+		err = json.Unmarshal(body, &action)
+		actions = append(actions, action)
+	}
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	go func() {
+		for _, action := range actions {
+			plug.call(action)
+		}
+	}()
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":  "async",
+		"actions": len(actions),
+	})
+}
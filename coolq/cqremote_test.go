@@ -0,0 +1,107 @@
+package coolq
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func signedHeader(secret string, at time.Time, body []byte) http.Header {
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	header := make(http.Header)
+	header.Set(RemoteTimestampHeader, timestamp)
+	header.Set(RemoteSignatureHeader, sign(secret, timestamp, body))
+	return header
+}
+
+func TestRemoteVerify(t *testing.T) {
+	p := newRemotePlugin(RemotePluginConfig{Name: "remote@test", Secret: "secret"})
+	body := []byte(`{"action":"send_group_msg"}`)
+	now := time.Now()
+	cases := []struct {
+		name   string
+		header http.Header
+		ok     bool
+	}{
+		{"valid", signedHeader("secret", now, body), true},
+		{"replayed", signedHeader("secret", now, body), false},
+		{"skew", signedHeader("secret", now.Add(-remoteMaxSkew-time.Minute), body), false},
+		{"future", signedHeader("secret", now.Add(remoteMaxSkew+time.Minute), body), false},
+		{"wrong secret", signedHeader("other", now.Add(time.Second), body), false},
+		{"no timestamp", http.Header{RemoteSignatureHeader: []string{sign("secret", "", body)}}, false},
+	}
+	for _, c := range cases {
+		err := p.verify(c.header, body, now)
+		if (err == nil) != c.ok {
+			t.Errorf("%s: verify() = %v, want ok %v", c.name, err, c.ok)
+		}
+	}
+	// 时间戳不同的签名不算重放
+	if err := p.verify(signedHeader("secret", now.Add(-time.Second), body), body, now); err != nil {
+		t.Errorf("new timestamp should be accepted: %v", err)
+	}
+	// 修改时间戳会让签名失效
+	header := signedHeader("secret", now, body)
+	header.Set(RemoteTimestampHeader, strconv.FormatInt(now.Unix()+1, 10))
+	if err := p.verify(header, body, now); err == nil {
+		t.Error("signature should cover the timestamp")
+	}
+}
+
+func TestReplayGuardPrune(t *testing.T) {
+	g := newReplayGuard()
+	now := time.Now()
+	if !g.check("a", now) || g.check("a", now) {
+		t.Fatal("signature should be accepted once")
+	}
+	later := now.Add(3 * remoteMaxSkew)
+	if !g.check("b", later) {
+		t.Fatal("new signature should be accepted")
+	}
+	if _, ok := g.seen["a"]; ok {
+		t.Error("expired signature should be pruned")
+	}
+}
+
+// 过期的请求被拒绝，不会执行 action
+func TestRemoteActionHandlerStale(t *testing.T) {
+	p := newRemotePlugin(RemotePluginConfig{Name: "remote@stale", Secret: "secret"})
+	remotePlugins.Lock()
+	remotePlugins.entries[p.cfg.Name] = p
+	remotePlugins.Unlock()
+	defer func() {
+		remotePlugins.Lock()
+		delete(remotePlugins.entries, p.cfg.Name)
+		remotePlugins.Unlock()
+	}()
+	body := `{"action":"send_group_msg"}`
+	req := httptest.NewRequest(http.MethodPost, "/api/actions", strings.NewReader(body))
+	req.Header = signedHeader("secret", time.Now().Add(-time.Hour), []byte(body))
+	req.Header.Set(RemotePluginHeader, p.cfg.Name)
+	rec := httptest.NewRecorder()
+	RemoteActionHandler(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
+
+// 没有设置密钥的远程插件不能加载
+func TestRemoteLoad(t *testing.T) {
+	cases := []struct {
+		cfg RemotePluginConfig
+		ok  bool
+	}{
+		{RemotePluginConfig{Name: "remote@ok", URL: "http://127.0.0.1:9000", Secret: "secret"}, true},
+		{RemotePluginConfig{Name: "remote@nosecret", URL: "http://127.0.0.1:9000"}, false},
+		{RemotePluginConfig{Name: "remote@nourl", Secret: "secret"}, false},
+	}
+	for _, c := range cases {
+		err := newRemotePlugin(c.cfg).Load()
+		if (err == nil) != c.ok {
+			t.Errorf("%s: Load() = %v, want ok %v", c.cfg.Name, err, c.ok)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package coolq
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/haruno-bot/haruno/logger"
+)
+
+// 失败重试的默认配置
+const (
+	defaultRetryAttempts   = 3
+	defaultRetryBackoff    = time.Second
+	defaultRetryMaxBackoff = 30 * time.Second
+	defaultDeadLetterFile  = "deadletter.log"
+	// retryNotifyInterval 两次通知管理员的最小间隔
+	retryNotifyInterval = time.Minute
+)
+
+// RetryConfig 调用api失败时的重试配置
+type RetryConfig struct {
+	// MaxAttempts 最多尝试的次数（包括第一次）
+	MaxAttempts int `toml:"maxAttempts"`
+	// Backoff 第一次重试前等待的时间（毫秒），之后每次翻倍
+	Backoff int `toml:"backoff"`
+	// MaxBackoff 重试前最多等待的时间（毫秒）
+	MaxBackoff int `toml:"maxBackoff"`
+	// DeadLetter 最终失败的消息记录的文件，默认为数据目录下的 deadletter.log
+	DeadLetter string `toml:"deadLetter"`
+	// Notify 最终失败时私聊通知超级用户
+	Notify bool `toml:"notify"`
+}
+
+// deadLetter 最终失败的 action，按行写入 json
+type deadLetter struct {
+	Time     int64       `json:"time"`
+	Action   string      `json:"action"`
+	Params   interface{} `json:"params"`
+	Error    string      `json:"error"`
+	Attempts int         `json:"attempts"`
+}
+
+// retrier 判断是否重试，记录最终失败的 action
+type retrier struct {
+	mu         sync.Mutex
+	cfg        RetryConfig
+	backoff    time.Duration
+	maxBackoff time.Duration
+	lastNotify time.Time
+	suppressed int
+}
+
+func newRetrier(cfg RetryConfig) *retrier {
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = defaultRetryAttempts
+	}
+	r := &retrier{
+		cfg:        cfg,
+		backoff:    time.Duration(cfg.Backoff) * time.Millisecond,
+		maxBackoff: time.Duration(cfg.MaxBackoff) * time.Millisecond,
+	}
+	if r.backoff <= 0 {
+		r.backoff = defaultRetryBackoff
+	}
+	if r.maxBackoff <= 0 {
+		r.maxBackoff = defaultRetryMaxBackoff
+	}
+	if r.maxBackoff < r.backoff {
+		r.maxBackoff = r.backoff
+	}
+	return r
+}
+
+// retryable 判断失败的调用是否可以重试
+// 连接不可用时请求没有发出，总是可以重试
+// 超时和 retcode 为 1（异步执行）的请求可能已经执行，只重试幂等的 action，发送消息不重试以免重复发送
+// 后端返回的其他错误不重试
+func retryable(action string, params interface{}, err error) bool {
+	if e, ok := err.(*APIError); ok {
+		return e.RetCode == retCodeAsync && sendTarget(action, params) == ""
+	}
+	switch err {
+	case ErrAPIDisconnected:
+		return true
+	case ErrAPITimeout:
+		return sendTarget(action, params) == ""
+	}
+	return false
+}
+
+// delay 第 attempt 次尝试失败后重试前等待的时间
+func (r *retrier) delay(attempt int) time.Duration {
+	d := r.backoff
+	for i := 1; i < attempt && d < r.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > r.maxBackoff {
+		d = r.maxBackoff
+	}
+	return d
+}
+
+// shouldRetry 第 attempt 次尝试失败后是否重试
+func (r *retrier) shouldRetry(action string, params interface{}, err error, attempt int) bool {
+	return attempt < r.cfg.MaxAttempts && retryable(action, params, err)
+}
+
+// deadLetterFile 死信文件的位置
+func (r *retrier) deadLetterFile() string {
+	if r.cfg.DeadLetter != "" {
+		return r.cfg.DeadLetter
+	}
+	storages.Lock()
+	defer storages.Unlock()
+	return path.Join(storages.dataPath, defaultDeadLetterFile)
+}
+
+// recordFailure 记录最终失败的 action，需要时通知超级用户
+func (c *cqclient) recordFailure(action string, params interface{}, err error, attempts int) {
+	r := c.retrier
+	logger.Errorf("action %s failed after %d attempt(s): %v", action, attempts, err)
+	letter := &deadLetter{
+		Time:     time.Now().Unix(),
+		Action:   action,
+		Params:   params,
+		Error:    err.Error(),
+		Attempts: attempts,
+	}
+	if werr := r.write(letter); werr != nil {
+		logger.Errorf("write dead letter error: %v", werr)
+	}
+	// 熔断是主动丢弃的，不需要通知
+	if !r.cfg.Notify || err == ErrAPIMuted {
+		return
+	}
+	r.mu.Lock()
+	now := time.Now()
+	if now.Sub(r.lastNotify) < retryNotifyInterval {
+		r.suppressed++
+		r.mu.Unlock()
+		return
+	}
+	suppressed := r.suppressed
+	r.lastNotify = now
+	r.suppressed = 0
+	r.mu.Unlock()
+	text := fmt.Sprintf("[Haruno] %s 调用失败（尝试 %d 次）：%v", action, attempts, err)
+	if suppressed > 0 {
+		text += fmt.Sprintf("\n另有 %d 条失败没有通知", suppressed)
+	}
+	text += fmt.Sprintf("\n详情见 %s", r.deadLetterFile())
+	for _, id := range c.perm.superUserList() {
+		c.Send(&SendRequest{
+			MessageType: "private",
+			TargetID:    id,
+			Message:     text,
+			AutoEscape:  true,
+			Priority:    true,
+			notice:      true,
+		})
+	}
+}
+
+func (r *retrier) write(letter *deadLetter) error {
+	raw, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+	file := r.deadLetterFile()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+		return err
+	}
+	fp, err := os.OpenFile(file, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	_, err = fp.Write(append(raw, '\n'))
+	return err
+}
+
+// callWithRetry 调用api，可以重试的失败按配置重试
+func (c *cqclient) callWithRetry(action string, params interface{}) (*CQResponse, int, error) {
+	attempt := 0
+	for {
+		attempt++
+		res, err := c.APICall(action, params)
+		if err == nil || !c.retrier.shouldRetry(action, params, err, attempt) {
+			return res, attempt, err
+		}
+		timer := time.NewTimer(c.retrier.delay(attempt))
+		select {
+		case <-c.ctx.Done():
+			timer.Stop()
+			return res, attempt, err
+		case <-timer.C:
+		}
+	}
+}
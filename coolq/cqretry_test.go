@@ -0,0 +1,105 @@
+package coolq
+
+import (
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestRetryable(t *testing.T) {
+	send := CQTypeSendGroupMsg{GroupID: 1, Message: "hello"}
+	other := map[string]interface{}{"group_id": 1}
+	tests := []struct {
+		name   string
+		action string
+		params interface{}
+		err    error
+		want   bool
+	}{
+		{"send disconnected", ActionSendGroupMsg, send, ErrAPIDisconnected, true},
+		{"other disconnected", ActionSetGroupBan, other, ErrAPIDisconnected, true},
+		{"send timeout", ActionSendGroupMsg, send, ErrAPITimeout, false},
+		{"other timeout", ActionSetGroupBan, other, ErrAPITimeout, true},
+		{"send api error", ActionSendGroupMsg, send, &APIError{Action: ActionSendGroupMsg, RetCode: 100}, false},
+		{"other api error", ActionSetGroupBan, other, &APIError{Action: ActionSetGroupBan, RetCode: 102}, false},
+		{"send async", ActionSendGroupMsg, send, &APIError{Action: ActionSendGroupMsg, RetCode: retCodeAsync}, false},
+		{"other async", ActionSetGroupBan, other, &APIError{Action: ActionSetGroupBan, RetCode: retCodeAsync}, true},
+		{"send muted", ActionSendGroupMsg, send, ErrAPIMuted, false},
+		{"send queue full", ActionSendGroupMsg, send, ErrSendQueueFull, false},
+	}
+	for _, tt := range tests {
+		if got := retryable(tt.action, tt.params, tt.err); got != tt.want {
+			t.Errorf("%s: retryable = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// retcode 为 1 时返回错误，交给重试判断
+func TestAPIAwaitAsync(t *testing.T) {
+	c := new(cqclient)
+	ch := make(chan *CQResponse, 1)
+	ch <- &CQResponse{Status: "async", RetCode: retCodeAsync}
+	_, err := c.apiAwait(ActionSetGroupBan, 1, ch)
+	if e, ok := err.(*APIError); !ok || e.RetCode != retCodeAsync {
+		t.Fatalf("async response: got %v, want an APIError with retcode 1", err)
+	}
+	ch <- &CQResponse{Status: "ok"}
+	if _, err := c.apiAwait(ActionSetGroupBan, 2, ch); err != nil {
+		t.Fatalf("ok response: %v", err)
+	}
+}
+
+func TestRequeueOrder(t *testing.T) {
+	s := newSender(SenderConfig{QueueSize: 10})
+	first := &sendJob{key: "group:1", action: "first"}
+	second := &sendJob{key: "group:1", action: "second"}
+	third := &sendJob{key: "group:1", action: "third", priority: true}
+	for _, job := range []*sendJob{second, third} {
+		if err := s.enqueue(job, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 重试的消息保持原来的优先级，排在同一个目标的消息之前
+	if err := s.enqueue(first, true); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.high) != 1 || s.high[0] != third {
+		t.Fatalf("retry should not enter the high queue: %v", s.high)
+	}
+	if len(s.normal) != 2 || s.normal[0] != first || s.normal[1] != second {
+		t.Fatalf("retry should be at the head of its target: %v", s.normal)
+	}
+}
+
+func TestQueueFullRecorded(t *testing.T) {
+	deadLetter := path.Join(storages.dataPath, "queue-full.log")
+	c := &cqclient{
+		sender:  newSender(SenderConfig{QueueSize: 1}),
+		retrier: newRetrier(RetryConfig{DeadLetter: deadLetter}),
+	}
+	var errs []error
+	for i := 0; i < 2; i++ {
+		c.enqueue(&sendJob{
+			key:    "group:1",
+			action: ActionSendGroupMsg,
+			params: CQTypeSendGroupMsg{GroupID: 1},
+			done: func(res *CQResponse, err error) {
+				errs = append(errs, err)
+			},
+		})
+	}
+	if len(errs) != 1 || errs[0] != ErrSendQueueFull {
+		t.Fatalf("dropped job should fail with ErrSendQueueFull: %v", errs)
+	}
+	raw, err := ioutil.ReadFile(deadLetter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(raw), ErrSendQueueFull.Error()) {
+		t.Fatalf("dead letter should record the dropped job: %s", raw)
+	}
+	if stats := c.sender.stats(); stats.Dropped != 1 || stats.Queued != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
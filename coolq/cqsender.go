@@ -0,0 +1,544 @@
+package coolq
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/haruno-bot/haruno/logger"
+)
+
+// ErrSendQueueFull 发送队列已满
+var ErrSendQueueFull = errors.New("coolq: send queue is full")
+
+// 发送队列的默认配置
+const (
+	defaultSendQueueSize    = 1024
+	defaultSendGlobalRate   = 5
+	defaultSendGlobalBurst  = 10
+	defaultSendTargetRate   = 1
+	defaultSendTargetBurst  = 3
+	defaultSendIntervalMs   = 100
+	defaultSendIdleWaitTime = time.Second
+	// senderPruneInterval 清理空闲令牌桶的间隔
+	senderPruneInterval = time.Minute
+)
+
+// SenderConfig 发送队列配置
+// 速率的单位为 条/秒
+type SenderConfig struct {
+	// QueueSize 队列的最大长度
+	QueueSize int `toml:"queueSize"`
+	// GlobalRate, GlobalBurst 所有消息共享的速率和突发数量
+	GlobalRate  float64 `toml:"globalRate"`
+	GlobalBurst int     `toml:"globalBurst"`
+	// GroupRate, GroupBurst 每个群的速率和突发数量
+	GroupRate  float64 `toml:"groupRate"`
+	GroupBurst int     `toml:"groupBurst"`
+	// PrivateRate, PrivateBurst 每个私聊对象的速率和突发数量
+	PrivateRate  float64 `toml:"privateRate"`
+	PrivateBurst int     `toml:"privateBurst"`
+	// Interval 任意两条消息之间的最小间隔（毫秒）
+	Interval int `toml:"interval"`
+	// Split 长消息拆分配置
+	Split SplitConfig `toml:"split"`
+}
+
+// SenderStats 发送队列的运行状态
+type SenderStats struct {
+	Queued  int   `json:"queued"`
+	Sent    int64 `json:"sent"`
+	Failed  int64 `json:"failed"`
+	Dropped int64 `json:"dropped"`
+}
+
+// SendRequest 发送消息的请求
+type SendRequest struct {
+	// MessageType group 或者 private
+	MessageType string
+	// TargetID 群号或者QQ号
+	TargetID int64
+	// Message 消息内容
+	Message string
+	// AutoEscape 是否作为纯文本发送
+	AutoEscape bool
+	// Priority 重要消息，插队到普通消息之前
+	Priority bool
+	// Callback 发送完成的回调，成功时 err 为 nil
+	Callback func(messageID int64, err error)
+	// notice 发送失败的通知，失败时不再记录和通知
+	notice bool
+}
+
+// tokenBucket 令牌桶
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// ready 返回还需要等待多久才有令牌，0 表示现在就有
+func (b *tokenBucket) ready(now time.Time) time.Duration {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		return 0
+	}
+	if b.rate <= 0 {
+		return defaultSendIdleWaitTime
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+func (b *tokenBucket) take() {
+	b.tokens--
+}
+
+// full 令牌已经补满，和新建的令牌桶没有区别
+func (b *tokenBucket) full(now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst
+}
+
+// sendJob 发送队列中的元素
+type sendJob struct {
+	key    string
+	action string
+	params interface{}
+	done   func(*CQResponse, error)
+	// priority 放进优先队列
+	priority bool
+	// attempt 已经尝试的次数
+	attempt int
+	// quiet 最终失败时不记录死信，由 done 自己处理
+	quiet bool
+}
+
+// sender 发送队列
+// 每个群（或者私聊对象）和全局各有一个令牌桶，同一个目标的消息按顺序发送
+type sender struct {
+	mu      sync.Mutex
+	cfg     SenderConfig
+	high    []*sendJob
+	normal  []*sendJob
+	global  *tokenBucket
+	buckets map[string]*tokenBucket
+	// lastPrune 上一次清理令牌桶的时间
+	lastPrune time.Time
+	interval  time.Duration
+	lastSent  time.Time
+	wake      chan struct{}
+	sent      int64
+	failed    int64
+	dropped   int64
+}
+
+func newSender(cfg SenderConfig) *sender {
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = defaultSendQueueSize
+	}
+	if cfg.GlobalRate <= 0 {
+		cfg.GlobalRate = defaultSendGlobalRate
+	}
+	if cfg.GlobalBurst <= 0 {
+		cfg.GlobalBurst = defaultSendGlobalBurst
+	}
+	if cfg.GroupRate <= 0 {
+		cfg.GroupRate = defaultSendTargetRate
+	}
+	if cfg.GroupBurst <= 0 {
+		cfg.GroupBurst = defaultSendTargetBurst
+	}
+	if cfg.PrivateRate <= 0 {
+		cfg.PrivateRate = defaultSendTargetRate
+	}
+	if cfg.PrivateBurst <= 0 {
+		cfg.PrivateBurst = defaultSendTargetBurst
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultSendIntervalMs
+	}
+	return &sender{
+		cfg:      cfg,
+		high:     make([]*sendJob, 0),
+		normal:   make([]*sendJob, 0),
+		global:   newTokenBucket(cfg.GlobalRate, cfg.GlobalBurst),
+		buckets:  make(map[string]*tokenBucket),
+		interval: time.Duration(cfg.Interval) * time.Millisecond,
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+// enqueue 放进队列，队列满时返回 ErrSendQueueFull
+// head 为 true 时放在同一个目标的消息之前，用于重试，保证同一个目标的消息按顺序发送
+func (s *sender) enqueue(job *sendJob, head bool) error {
+	s.mu.Lock()
+	if len(s.high)+len(s.normal) >= s.cfg.QueueSize {
+		s.mu.Unlock()
+		atomic.AddInt64(&s.dropped, 1)
+		return ErrSendQueueFull
+	}
+	queue := &s.normal
+	if job.priority {
+		queue = &s.high
+	}
+	pos := len(*queue)
+	if head {
+		pos = 0
+		for i, queued := range *queue {
+			if queued.key == job.key {
+				pos = i
+				break
+			}
+		}
+	}
+	*queue = append(*queue, nil)
+	copy((*queue)[pos+1:], (*queue)[pos:])
+	(*queue)[pos] = job
+	s.mu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (s *sender) bucket(key string) *tokenBucket {
+	b, ok := s.buckets[key]
+	if !ok {
+		if len(key) > 6 && key[:6] == "group:" {
+			b = newTokenBucket(s.cfg.GroupRate, s.cfg.GroupBurst)
+		} else {
+			b = newTokenBucket(s.cfg.PrivateRate, s.cfg.PrivateBurst)
+		}
+		s.buckets[key] = b
+	}
+	return b
+}
+
+// pruneLocked 定时删除已经补满并且没有排队消息的令牌桶，需要持有 mu
+func (s *sender) pruneLocked(now time.Time) {
+	if now.Sub(s.lastPrune) < senderPruneInterval {
+		return
+	}
+	s.lastPrune = now
+	queued := make(map[string]bool)
+	for _, queue := range [][]*sendJob{s.high, s.normal} {
+		for _, job := range queue {
+			queued[job.key] = true
+		}
+	}
+	for key, b := range s.buckets {
+		if !queued[key] && b.full(now) {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+// next 取出下一个可以发送的消息
+// 没有可以发送的消息时返回需要等待的时间
+func (s *sender) next(now time.Time) (*sendJob, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pruneLocked(now)
+	if len(s.high)+len(s.normal) == 0 {
+		return nil, 0
+	}
+	if wait := s.interval - now.Sub(s.lastSent); wait > 0 {
+		return nil, wait
+	}
+	if wait := s.global.ready(now); wait > 0 {
+		return nil, wait
+	}
+	minWait := time.Duration(0)
+	blocked := make(map[string]bool)
+	for _, queue := range []*[]*sendJob{&s.high, &s.normal} {
+		for i, job := range *queue {
+			if blocked[job.key] {
+				continue
+			}
+			wait := s.bucket(job.key).ready(now)
+			if wait == 0 {
+				*queue = append((*queue)[:i], (*queue)[i+1:]...)
+				s.bucket(job.key).take()
+				s.global.take()
+				s.lastSent = now
+				return job, 0
+			}
+			// 同一个目标的消息按顺序发送
+			blocked[job.key] = true
+			if minWait == 0 || wait < minWait {
+				minWait = wait
+			}
+		}
+	}
+	return nil, minWait
+}
+
+// run 按照速率限制发送队列中的消息
+func (s *sender) run(c *cqclient) {
+	for {
+		job, wait := s.next(time.Now())
+		if job != nil {
+			c.deliver(job)
+			continue
+		}
+		if wait == 0 {
+			wait = defaultSendIdleWaitTime
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-c.ctx.Done():
+			timer.Stop()
+			return
+		case <-s.wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+func (s *sender) stats() SenderStats {
+	s.mu.Lock()
+	queued := len(s.high) + len(s.normal)
+	s.mu.Unlock()
+	return SenderStats{
+		Queued:  queued,
+		Sent:    atomic.LoadInt64(&s.sent),
+		Failed:  atomic.LoadInt64(&s.failed),
+		Dropped: atomic.LoadInt64(&s.dropped),
+	}
+}
+
+// deliver 发送消息，按顺序写入连接，异步等待响应
+func (c *cqclient) deliver(job *sendJob) {
+	job.attempt++
+	echo, ch, err := c.apiSubmit(job.action, job.params)
+	if err != nil {
+		c.finishSend(job, nil, err)
+		return
+	}
+	go func() {
+		res, err := c.apiAwait(job.action, echo, ch)
+		c.finishSend(job, res, err)
+	}()
+}
+
+// enqueue 放进发送队列，队列满时和发送失败一样处理
+func (c *cqclient) enqueue(job *sendJob) {
+	if err := c.sender.enqueue(job, false); err != nil {
+		c.dropSend(job, err)
+	}
+}
+
+// requeue 重试时放回队列，排在同一个目标的消息之前
+func (c *cqclient) requeue(job *sendJob) {
+	if err := c.sender.enqueue(job, true); err != nil {
+		c.dropSend(job, err)
+	}
+}
+
+// dropSend 没有放进队列的消息，记录失败并回调
+func (c *cqclient) dropSend(job *sendJob, err error) {
+	if !job.quiet {
+		c.recordFailure(job.action, job.params, err, job.attempt)
+	}
+	job.done(nil, err)
+}
+
+// finishSend 发送完成，可以重试的失败等待一段时间后重新放进队列
+func (c *cqclient) finishSend(job *sendJob, res *CQResponse, err error) {
+	if err != nil && c.retrier.shouldRetry(job.action, job.params, err, job.attempt) {
+		delay := c.retrier.delay(job.attempt)
+		logger.Infof("%s to %s failed (%v), retry in %v", job.action, job.key, err, delay)
+		time.AfterFunc(delay, func() {
+			c.requeue(job)
+		})
+		return
+	}
+	if err != nil {
+		atomic.AddInt64(&c.sender.failed, 1)
+		if !job.quiet {
+			c.recordFailure(job.action, job.params, err, job.attempt)
+		}
+	} else {
+		atomic.AddInt64(&c.sender.sent, 1)
+	}
+	job.done(res, err)
+}
+
+// messageID 从发送消息的响应中取出 message_id
+func messageID(res *CQResponse) int64 {
+	if res == nil {
+		return 0
+	}
+	data, ok := res.Data.(map[string]interface{})
+	if !ok {
+		return 0
+	}
+	id, _ := data["message_id"].(float64)
+	return int64(id)
+}
+
+// Send 把消息放进发送队列
+// 超长的消息会被拆分成多条，或者使用合并转发发送
+// 发送的结果通过 req.Callback 返回，拆分时返回第一条消息的 message_id
+func (c *cqclient) Send(req *SendRequest) {
+	done := func(id int64, err error) {
+		if req.Callback != nil {
+			req.Callback(id, err)
+			return
+		}
+		if err != nil {
+			logger.Errorf("send %s message to %d failed: %v", req.MessageType, req.TargetID, err)
+		}
+	}
+	parts := c.splitter.split(req.Message, req.AutoEscape)
+	if len(parts) > 1 && c.splitter.cfg.Forward {
+		job, err := newForwardJob(req, c.splitter.forwardNodes(parts, c.SelfID()))
+		if err != nil {
+			done(0, err)
+			return
+		}
+		job.quiet = true
+		job.done = func(res *CQResponse, err error) {
+			// 后端不支持合并转发时退回拆分发送
+			if _, ok := err.(*APIError); ok {
+				logger.Infof("forward message to %s failed (%v), send in %d parts", job.key, err, len(parts))
+				c.sendParts(req, markPages(parts), done)
+				return
+			}
+			if err != nil && !req.notice {
+				c.recordFailure(job.action, job.params, err, job.attempt)
+			}
+			done(messageID(res), err)
+		}
+		c.enqueue(job)
+		return
+	}
+	c.sendParts(req, markPages(parts), done)
+}
+
+// sendParts 按顺序发送拆分后的消息，全部完成后回调一次
+func (c *cqclient) sendParts(req *SendRequest, parts []string, done func(int64, error)) {
+	var mu sync.Mutex
+	remain := len(parts)
+	ids := make([]int64, len(parts))
+	var firstErr error
+	for i, part := range parts {
+		idx := i
+		job, err := newSendJob(req, part)
+		if err != nil {
+			done(0, err)
+			return
+		}
+		job.quiet = req.notice
+		job.done = func(res *CQResponse, err error) {
+			mu.Lock()
+			ids[idx] = messageID(res)
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+			remain--
+			finished := remain == 0
+			mu.Unlock()
+			if finished {
+				done(ids[0], firstErr)
+			}
+		}
+		c.enqueue(job)
+	}
+}
+
+// newSendJob 创建发送一条消息的任务
+func newSendJob(req *SendRequest, message string) (*sendJob, error) {
+	job := &sendJob{priority: req.Priority}
+	switch req.MessageType {
+	case "group":
+		job.key = fmt.Sprintf("group:%d", req.TargetID)
+		job.action = ActionSendGroupMsg
+		job.params = CQTypeSendGroupMsg{
+			GroupID:    req.TargetID,
+			Message:    message,
+			AutoEscape: req.AutoEscape,
+		}
+	case "private":
+		job.key = fmt.Sprintf("private:%d", req.TargetID)
+		job.action = ActionSendPrivateMsg
+		job.params = CQTypeSendPrivateMsg{
+			UserID:     req.TargetID,
+			Message:    message,
+			AutoEscape: req.AutoEscape,
+		}
+	default:
+		return nil, fmt.Errorf("coolq: unknown message type %s", req.MessageType)
+	}
+	return job, nil
+}
+
+// newForwardJob 创建发送合并转发消息的任务
+func newForwardJob(req *SendRequest, nodes []CQTypeForwardNode) (*sendJob, error) {
+	job := &sendJob{priority: req.Priority}
+	switch req.MessageType {
+	case "group":
+		job.key = fmt.Sprintf("group:%d", req.TargetID)
+		job.action = ActionSendGroupForwardMsg
+		job.params = CQTypeSendGroupForwardMsg{
+			GroupID:  req.TargetID,
+			Messages: nodes,
+		}
+	case "private":
+		job.key = fmt.Sprintf("private:%d", req.TargetID)
+		job.action = ActionSendPrivateForwardMsg
+		job.params = CQTypeSendPrivateForwardMsg{
+			UserID:   req.TargetID,
+			Messages: nodes,
+		}
+	default:
+		return nil, fmt.Errorf("coolq: unknown message type %s", req.MessageType)
+	}
+	return job, nil
+}
+
+// CallAction 调用api并等待响应
+// 发送消息的 action 会经过发送队列，其他的直接调用
+// 可以重试的失败会按照重试配置重试
+func (c *cqclient) CallAction(action string, params interface{}) (*CQResponse, error) {
+	key := sendTarget(action, params)
+	if key == "" {
+		res, _, err := c.callWithRetry(action, params)
+		return res, err
+	}
+	type result struct {
+		res *CQResponse
+		err error
+	}
+	ch := make(chan result, 1)
+	c.enqueue(&sendJob{
+		key:    key,
+		action: action,
+		params: params,
+		done: func(res *CQResponse, err error) {
+			ch <- result{res, err}
+		},
+	})
+	r := <-ch
+	return r.res, r.err
+}
@@ -0,0 +1,78 @@
+package coolq
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(2, 2)
+	b.last = now
+	for i := 0; i < 2; i++ {
+		if wait := b.ready(now); wait != 0 {
+			t.Fatalf("token %d: wait %v", i, wait)
+		}
+		b.take()
+	}
+	if wait := b.ready(now); wait != 500*time.Millisecond {
+		t.Fatalf("empty bucket: wait %v, want 500ms", wait)
+	}
+	if b.full(now) {
+		t.Fatal("empty bucket should not be full")
+	}
+	// 1 秒后补满，不会超过 burst
+	later := now.Add(time.Second)
+	if !b.full(later) {
+		t.Fatal("bucket should be full after a second")
+	}
+	b.ready(now.Add(time.Hour))
+	if b.tokens != b.burst {
+		t.Fatalf("tokens = %v, want %v", b.tokens, b.burst)
+	}
+}
+
+func TestSenderPerTargetOrder(t *testing.T) {
+	s := newSender(SenderConfig{GroupRate: 1, GroupBurst: 1, GlobalBurst: 10, Interval: 1})
+	jobs := []*sendJob{
+		{key: "group:1", action: "a1"},
+		{key: "group:1", action: "a2"},
+		{key: "group:2", action: "b1"},
+	}
+	for _, job := range jobs {
+		if err := s.enqueue(job, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	got := make([]string, 0)
+	for i := 0; i < 3; i++ {
+		job, _ := s.next(now)
+		if job != nil {
+			got = append(got, job.action)
+		}
+		now = now.Add(10 * time.Millisecond)
+	}
+	// group:1 的第二条需要等待令牌，group:2 不受影响
+	if len(got) != 2 || got[0] != "a1" || got[1] != "b1" {
+		t.Fatalf("sent %v, want [a1 b1]", got)
+	}
+}
+
+// 补满并且没有排队消息的令牌桶被清理
+func TestSenderPruneBuckets(t *testing.T) {
+	s := newSender(SenderConfig{})
+	s.bucket("group:1").take()
+	s.bucket("group:2")
+	s.bucket("group:3").take()
+	s.normal = append(s.normal, &sendJob{key: "group:3"})
+	s.pruneLocked(time.Now())
+	if _, ok := s.buckets["group:2"]; ok {
+		t.Error("full idle bucket should be pruned")
+	}
+	for _, key := range []string{"group:1", "group:3"} {
+		if _, ok := s.buckets[key]; !ok {
+			t.Errorf("%s should be kept", key)
+		}
+	}
+}
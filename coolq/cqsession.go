@@ -0,0 +1,156 @@
+package coolq
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultSessionTimeout 会话默认的等待时间
+const defaultSessionTimeout = 60 * time.Second
+
+// 会话相关的错误
+var (
+	// ErrSessionTimeout 等待下一条消息超时
+	ErrSessionTimeout = errors.New("session: wait for next message timeout")
+	// ErrSessionCanceled 用户发送了取消词
+	ErrSessionCanceled = errors.New("session: canceled by user")
+	// ErrSessionBusy 同一个用户在同一个会话中已经有会话在等待
+	ErrSessionBusy = errors.New("session: another session is waiting")
+	// ErrSessionUnsupported 事件不是群消息或者私聊消息
+	ErrSessionUnsupported = errors.New("session: event is not a group or private message")
+)
+
+// sessionKey 会话的标识
+// 同一个用户在同一个群（或者私聊）里只对应一个会话
+func sessionKey(event *CQEvent) string {
+	if event.PostType != "message" {
+		return ""
+	}
+	switch event.MessageType {
+	case "group":
+		return fmt.Sprintf("group:%d:%d", event.GroupID, event.UserID)
+	case "private":
+		return fmt.Sprintf("private:%d", event.UserID)
+	}
+	return ""
+}
+
+type sessionWaiter struct {
+	ch chan *CQEvent
+}
+
+// sessionManager 管理所有正在等待下一条消息的会话
+type sessionManager struct {
+	mu      sync.Mutex
+	waiting map[string]*sessionWaiter
+}
+
+func newSessionManager() *sessionManager {
+	return &sessionManager{
+		waiting: make(map[string]*sessionWaiter),
+	}
+}
+
+// deliver 把消息交给正在等待的会话
+// 如果有会话接收了这条消息则返回 true，此时消息不再经过插件的 filter
+func (m *sessionManager) deliver(event *CQEvent) bool {
+	key := sessionKey(event)
+	if key == "" {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	waiter, ok := m.waiting[key]
+	if !ok {
+		return false
+	}
+	delete(m.waiting, key)
+	waiter.ch <- event
+	return true
+}
+
+// wait 等待和 event 同一个会话的下一条消息
+func (m *sessionManager) wait(event *CQEvent, timeout time.Duration, cancelWords []string) (*CQEvent, error) {
+	key := sessionKey(event)
+	if key == "" {
+		return nil, ErrSessionUnsupported
+	}
+	if timeout <= 0 {
+		timeout = defaultSessionTimeout
+	}
+	waiter := &sessionWaiter{ch: make(chan *CQEvent, 1)}
+	m.mu.Lock()
+	if _, ok := m.waiting[key]; ok {
+		m.mu.Unlock()
+		return nil, ErrSessionBusy
+	}
+	m.waiting[key] = waiter
+	m.mu.Unlock()
+	// 等待期间不阻塞同一个群（或者私聊）中其他人的事件
+	detach(event)
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	var next *CQEvent
+	select {
+	case next = <-waiter.ch:
+	case <-timer.C:
+		m.mu.Lock()
+		if m.waiting[key] == waiter {
+			delete(m.waiting, key)
+			m.mu.Unlock()
+			return nil, ErrSessionTimeout
+		}
+		m.mu.Unlock()
+		// 超时的同时消息已经被投递
+		next = <-waiter.ch
+	}
+	text := strings.TrimSpace(next.RawMessage)
+	for _, word := range cancelWords {
+		if text == word {
+			return next, ErrSessionCanceled
+		}
+	}
+	return next, nil
+}
+
+// Session 会话
+// 用于在 handler 中等待同一个用户在同一个群（或者私聊）中的下一条消息
+type Session struct {
+	// Event 发起会话的事件
+	Event *CQEvent
+	// Timeout 每次等待的超时时间
+	Timeout time.Duration
+	// CancelWords 取消词，用户发送取消词时会话返回 ErrSessionCanceled
+	CancelWords []string
+}
+
+// NewSession 以触发事件创建一个会话
+func NewSession(event *CQEvent, cancelWords ...string) *Session {
+	return &Session{
+		Event:       event,
+		Timeout:     defaultSessionTimeout,
+		CancelWords: cancelWords,
+	}
+}
+
+// Next 等待下一条消息
+func (s *Session) Next() (*CQEvent, error) {
+	return Client.WaitNext(s.Event, s.Timeout, s.CancelWords...)
+}
+
+// Prompt 发送提示消息后等待下一条消息
+func (s *Session) Prompt(message string) (*CQEvent, error) {
+	switch s.Event.MessageType {
+	case "group":
+		Client.SendGroupMsg(s.Event.GroupID, message)
+	case "private":
+		Client.SendPrivateMsg(s.Event.UserID, message)
+	default:
+		return nil, ErrSessionUnsupported
+	}
+	return s.Next()
+}
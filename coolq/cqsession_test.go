@@ -0,0 +1,122 @@
+package coolq
+
+import (
+	"testing"
+	"time"
+)
+
+func sessionEvent(groupID, userID int64, text string) *CQEvent {
+	event := &CQEvent{PostType: "message", GroupID: groupID, UserID: userID, RawMessage: text}
+	if groupID != 0 {
+		event.MessageType = "group"
+	} else {
+		event.MessageType = "private"
+	}
+	return event
+}
+
+type sessionResult struct {
+	event *CQEvent
+	err   error
+}
+
+// startWait 在后台等待 event 的下一条消息，返回前确保会话已经开始等待
+func startWait(t *testing.T, m *sessionManager, event *CQEvent, timeout time.Duration, cancelWords ...string) <-chan sessionResult {
+	t.Helper()
+	done := make(chan sessionResult, 1)
+	go func() {
+		next, err := m.wait(event, timeout, cancelWords)
+		done <- sessionResult{next, err}
+	}()
+	key := sessionKey(event)
+	for i := 0; i < 1000; i++ {
+		m.mu.Lock()
+		_, ok := m.waiting[key]
+		m.mu.Unlock()
+		if ok {
+			return done
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("session is not waiting")
+	return nil
+}
+
+func TestSessionTimeout(t *testing.T) {
+	m := newSessionManager()
+	event := sessionEvent(100, 2, "start")
+	start := time.Now()
+	if _, err := m.wait(event, 20*time.Millisecond, nil); err != ErrSessionTimeout {
+		t.Fatalf("wait() error = %v, want %v", err, ErrSessionTimeout)
+	}
+	if time.Since(start) < 20*time.Millisecond {
+		t.Error("wait() returned before timeout")
+	}
+	// 超时后不再接收消息
+	if m.deliver(sessionEvent(100, 2, "late")) {
+		t.Error("timed out session should not receive messages")
+	}
+}
+
+func TestSessionCancel(t *testing.T) {
+	m := newSessionManager()
+	done := startWait(t, m, sessionEvent(0, 2, "start"), time.Second, "取消", "cancel")
+	if !m.deliver(sessionEvent(0, 2, " 取消 ")) {
+		t.Fatal("message should be delivered to the session")
+	}
+	res := <-done
+	if res.err != ErrSessionCanceled {
+		t.Fatalf("wait() error = %v, want %v", res.err, ErrSessionCanceled)
+	}
+	if res.event == nil || res.event.UserID != 2 {
+		t.Errorf("canceled session should return the cancel message, got %v", res.event)
+	}
+}
+
+// 其他用户以及同一个用户在其他群的消息不会交给会话
+func TestSessionOtherUser(t *testing.T) {
+	m := newSessionManager()
+	done := startWait(t, m, sessionEvent(100, 2, "start"), time.Second)
+	for _, event := range []*CQEvent{
+		sessionEvent(100, 3, "other user"),
+		sessionEvent(200, 2, "other group"),
+		sessionEvent(0, 2, "private"),
+	} {
+		if m.deliver(event) {
+			t.Errorf("%q should not be delivered", event.RawMessage)
+		}
+	}
+	if !m.deliver(sessionEvent(100, 2, "answer")) {
+		t.Fatal("answer should be delivered")
+	}
+	res := <-done
+	if res.err != nil || res.event.RawMessage != "answer" {
+		t.Errorf("wait() = %v, %v, want answer", res.event, res.err)
+	}
+}
+
+// 只有其他用户回复时会话仍然超时
+func TestSessionOtherUserTimeout(t *testing.T) {
+	m := newSessionManager()
+	done := startWait(t, m, sessionEvent(100, 2, "start"), 50*time.Millisecond)
+	if m.deliver(sessionEvent(100, 3, "other user")) {
+		t.Error("other user's message should not be delivered")
+	}
+	if res := <-done; res.err != ErrSessionTimeout {
+		t.Errorf("wait() error = %v, want %v", res.err, ErrSessionTimeout)
+	}
+}
+
+func TestSessionBusy(t *testing.T) {
+	m := newSessionManager()
+	event := sessionEvent(100, 2, "start")
+	done := startWait(t, m, event, time.Second)
+	if _, err := m.wait(event, time.Second, nil); err != ErrSessionBusy {
+		t.Errorf("wait() error = %v, want %v", err, ErrSessionBusy)
+	}
+	if _, err := m.wait(&CQEvent{PostType: "notice"}, time.Second, nil); err != ErrSessionUnsupported {
+		t.Errorf("wait() error = %v, want %v", err, ErrSessionUnsupported)
+	}
+	m.deliver(sessionEvent(100, 2, "answer"))
+	<-done
+}
@@ -0,0 +1,212 @@
+package coolq
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// 长消息拆分的默认配置
+const (
+	defaultSplitMaxLength = 1500
+	defaultSplitMaxLines  = 40
+	// pageMarkerReserve 为页码 "\n(12/34)" 预留的长度
+	pageMarkerReserve = 12
+)
+
+// 转发消息的 action，需要后端支持（比如 go-cqhttp）
+const (
+	// ActionSendGroupForwardMsg 发送群合并转发消息
+	ActionSendGroupForwardMsg = "send_group_forward_msg"
+	// ActionSendPrivateForwardMsg 发送私聊合并转发消息
+	ActionSendPrivateForwardMsg = "send_private_forward_msg"
+)
+
+// SplitConfig 长消息拆分配置
+type SplitConfig struct {
+	// MaxLength 单条消息的最大长度（字符数，每个cq码算一个字符）
+	MaxLength int `toml:"maxLength"`
+	// MaxLines 单条消息的最大行数
+	MaxLines int `toml:"maxLines"`
+	// Forward 超长的消息使用合并转发发送，后端不支持时退回拆分发送
+	Forward bool `toml:"forward"`
+	// ForwardName 合并转发消息中显示的名字
+	ForwardName string `toml:"forwardName"`
+}
+
+// CQTypeForwardNode 合并转发消息的节点
+type CQTypeForwardNode struct {
+	Type string                 `json:"type"`
+	Data map[string]interface{} `json:"data"`
+}
+
+// CQTypeSendGroupForwardMsg ActionSendGroupForwardMsg动作数据格式
+type CQTypeSendGroupForwardMsg struct {
+	GroupID  int64               `json:"group_id"`
+	Messages []CQTypeForwardNode `json:"messages"`
+}
+
+// CQTypeSendPrivateForwardMsg ActionSendPrivateForwardMsg动作数据格式
+type CQTypeSendPrivateForwardMsg struct {
+	UserID   int64               `json:"user_id"`
+	Messages []CQTypeForwardNode `json:"messages"`
+}
+
+// 断开位置的优先级
+const (
+	breakNone = iota
+	breakSegment
+	breakLine
+	breakParagraph
+)
+
+// splitAtom 拆分的最小单位，cq码和转义字符不会被拆开
+type splitAtom struct {
+	text   string
+	size   int
+	lines  int
+	isCode bool
+}
+
+// tokenize 把消息拆成最小单位
+// plain 为 true 时消息按纯文本处理，不识别cq码
+func tokenize(msg string, plain bool) []splitAtom {
+	atoms := make([]splitAtom, 0, len(msg))
+	for i := 0; i < len(msg); {
+		if !plain && msg[i] == '[' && strings.HasPrefix(msg[i:], "[CQ:") {
+			if end := strings.IndexByte(msg[i:], ']'); end > 0 {
+				atoms = append(atoms, splitAtom{text: msg[i : i+end+1], size: 1, isCode: true})
+				i += end + 1
+				continue
+			}
+		}
+		if !plain && msg[i] == '&' {
+			if end := strings.IndexByte(msg[i:], ';'); end > 0 && end <= 5 {
+				atoms = append(atoms, splitAtom{text: msg[i : i+end+1], size: 1})
+				i += end + 1
+				continue
+			}
+		}
+		_, width := utf8.DecodeRuneInString(msg[i:])
+		atom := splitAtom{text: msg[i : i+width], size: 1}
+		if msg[i] == '\n' {
+			atom.lines = 1
+		}
+		atoms = append(atoms, atom)
+		i += width
+	}
+	return atoms
+}
+
+// splitter 把超长的消息拆分成多条
+type splitter struct {
+	cfg SplitConfig
+}
+
+func newSplitter(cfg SplitConfig) *splitter {
+	if cfg.MaxLength <= 0 {
+		cfg.MaxLength = defaultSplitMaxLength
+	}
+	if cfg.MaxLines <= 0 {
+		cfg.MaxLines = defaultSplitMaxLines
+	}
+	if cfg.MaxLength <= pageMarkerReserve {
+		cfg.MaxLength = pageMarkerReserve + 1
+	}
+	return &splitter{cfg: cfg}
+}
+
+// split 在段落、行和cq码的边界拆分消息
+func (s *splitter) split(msg string, plain bool) []string {
+	atoms := tokenize(msg, plain)
+	size, lines := 0, 1
+	for _, atom := range atoms {
+		size += atom.size
+		lines += atom.lines
+	}
+	if size <= s.cfg.MaxLength && lines <= s.cfg.MaxLines {
+		return []string{msg}
+	}
+	maxLength := s.cfg.MaxLength - pageMarkerReserve
+	maxLines := s.cfg.MaxLines - 1
+	if maxLines < 1 {
+		maxLines = 1
+	}
+	parts := make([]string, 0)
+	for len(atoms) > 0 {
+		cut, best, bestLevel := 0, 0, breakNone
+		size, lines = 0, 1
+		for cut < len(atoms) {
+			atom := atoms[cut]
+			if cut > 0 && (size+atom.size > maxLength || lines+atom.lines > maxLines) {
+				break
+			}
+			size += atom.size
+			lines += atom.lines
+			cut++
+			// 记录最后一个优先级最高的断开位置
+			level := breakNone
+			if atom.lines > 0 {
+				level = breakLine
+				if cut >= 2 && atoms[cut-2].lines > 0 {
+					level = breakParagraph
+				}
+			} else if cut < len(atoms) && atom.isCode != atoms[cut].isCode {
+				level = breakSegment
+			}
+			if level >= bestLevel && level != breakNone {
+				best, bestLevel = cut, level
+			}
+		}
+		if cut < len(atoms) && best > 0 {
+			cut = best
+		}
+		parts = appendPart(parts, atoms[:cut])
+		atoms = atoms[cut:]
+	}
+	return parts
+}
+
+// markPages 多于一条时给每一条加上页码
+func markPages(parts []string) []string {
+	if len(parts) <= 1 {
+		return parts
+	}
+	marked := make([]string, len(parts))
+	for i, part := range parts {
+		marked[i] = fmt.Sprintf("%s\n(%d/%d)", part, i+1, len(parts))
+	}
+	return marked
+}
+
+func appendPart(parts []string, atoms []splitAtom) []string {
+	buff := new(strings.Builder)
+	for _, atom := range atoms {
+		buff.WriteString(atom.text)
+	}
+	part := strings.Trim(buff.String(), "\r\n")
+	if part == "" {
+		return parts
+	}
+	return append(parts, part)
+}
+
+// forwardNodes 把拆分的消息包装成合并转发的节点
+func (s *splitter) forwardNodes(parts []string, selfID int64) []CQTypeForwardNode {
+	name := s.cfg.ForwardName
+	if name == "" {
+		name = "Haruno"
+	}
+	nodes := make([]CQTypeForwardNode, 0, len(parts))
+	for _, part := range parts {
+		nodes = append(nodes, CQTypeForwardNode{
+			Type: "node",
+			Data: map[string]interface{}{
+				"name":    name,
+				"uin":     selfID,
+				"content": part,
+			},
+		})
+	}
+	return nodes
+}
@@ -0,0 +1,64 @@
+package coolq
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	atoms := tokenize("a&amp;[CQ:at,qq=1]中\n", false)
+	want := []splitAtom{
+		{text: "a", size: 1},
+		{text: "&amp;", size: 1},
+		{text: "[CQ:at,qq=1]", size: 1, isCode: true},
+		{text: "中", size: 1},
+		{text: "\n", size: 1, lines: 1},
+	}
+	if !reflect.DeepEqual(atoms, want) {
+		t.Errorf("tokenize = %+v, want %+v", atoms, want)
+	}
+	// 没有结束的cq码和转义按普通字符处理
+	if atoms := tokenize("[CQ:face&x", false); len(atoms) != 10 {
+		t.Errorf("unterminated code should be split into 10 atoms, got %d", len(atoms))
+	}
+	// 纯文本不识别cq码
+	for _, atom := range tokenize("[CQ:at,qq=1]&amp;", true) {
+		if atom.isCode || len(atom.text) != 1 {
+			t.Errorf("plain text atom %+v should be a single character", atom)
+		}
+	}
+}
+
+func TestSplit(t *testing.T) {
+	s := newSplitter(SplitConfig{MaxLength: 10 + pageMarkerReserve})
+	cases := []struct {
+		name string
+		msg  string
+		want []string
+	}{
+		{"short", "hello\nworld", []string{"hello\nworld"}},
+		{"paragraph", "aaaa\n\nbbbb\ncccc\ndddddddddd", []string{"aaaa", "bbbb\ncccc", "dddddddddd"}},
+		{"code", strings.Repeat("x", 8) + "[CQ:face,id=1]" + strings.Repeat("y", 14),
+			[]string{"xxxxxxxx[CQ:face,id=1]", "yyyyyyyyyy", "yyyy"}},
+	}
+	for _, c := range cases {
+		if got := s.split(c.msg, false); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: split = %q, want %q", c.name, got, c.want)
+		}
+	}
+	lines := newSplitter(SplitConfig{MaxLines: 3})
+	if got, want := lines.split("a\nb\nc\nd", false), []string{"a", "b", "c\nd"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("split by lines = %q, want %q", got, want)
+	}
+}
+
+func TestMarkPages(t *testing.T) {
+	if got := markPages([]string{"a"}); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Errorf("single part should not be marked: %q", got)
+	}
+	want := []string{"a\n(1/2)", "b\n(2/2)"}
+	if got := markPages([]string{"a", "b"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("markPages = %q, want %q", got, want)
+	}
+}
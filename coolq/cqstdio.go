@@ -0,0 +1,521 @@
+package coolq
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/haruno-bot/haruno/logger"
+)
+
+// StdioProtocolVersion 外部插件协议的版本
+const StdioProtocolVersion = "1.0"
+
+// 外部插件崩溃后重启的等待时间
+const (
+	stdioMinBackoff = time.Second
+	stdioMaxBackoff = time.Minute
+	// 运行超过这个时间后认为插件已经稳定，重置等待时间
+	stdioStableTime = time.Minute
+)
+
+// JSON-RPC 错误码
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcActionFailed   = -32000
+	rpcAPIUnavailable = -32001
+)
+
+var errStdioNotRunning = errors.New("stdio plugin: process is not running")
+
+// StdioPluginConfig 外部插件配置
+type StdioPluginConfig struct {
+	// Name 插件名称
+	Name string `toml:"name"`
+	// Command 插件可执行文件
+	Command string `toml:"command"`
+	// Args 启动参数
+	Args []string `toml:"args"`
+	// Env 额外的环境变量，形如 KEY=VALUE
+	Env []string `toml:"env"`
+	// Dir 工作目录
+	Dir string `toml:"dir"`
+	// PostTypes 推送的事件类型，为空时推送所有事件
+	PostTypes []string `toml:"postTypes"`
+	// Groups 推送的群，为空时不限制（只限制群事件）
+	Groups []int64 `toml:"groups"`
+	// Actions 允许调用的api，为空时不限制
+	Actions []string `toml:"actions"`
+}
+
+type rpcError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+func (err *rpcError) Error() string {
+	return err.Message
+}
+
+// rpcMessage JSON-RPC 2.0 消息，请求、通知和响应共用
+type rpcMessage struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+// stdioPlugin 通过标准输入输出通信的外部插件
+type stdioPlugin struct {
+	cfg       StdioPluginConfig
+	log       logger.LogInterface
+	postTypes map[string]bool
+	groups    map[int64]bool
+	actions   map[string]bool
+	mu        sync.Mutex
+	wmu       sync.Mutex
+	stdin     io.WriteCloser
+	cmd       *exec.Cmd
+	ready     bool
+	seq       int64
+	pending   map[int64]chan *rpcMessage
+	started   bool
+	stopOnce  sync.Once
+	// stopping 晴乃退出时关闭，不再重启插件进程
+	stopping chan struct{}
+	// exited supervise 退出时关闭
+	exited chan struct{}
+}
+
+var stdioPlugins = struct {
+	sync.Mutex
+	entries []*stdioPlugin
+}{}
+
+func toStrSet(strs []string) map[string]bool {
+	set := make(map[string]bool, len(strs))
+	for _, str := range strs {
+		set[str] = true
+	}
+	return set
+}
+
+func newStdioPlugin(cfg StdioPluginConfig) *stdioPlugin {
+	return &stdioPlugin{
+		cfg:       cfg,
+		log:       logger.Field(cfg.Name),
+		postTypes: toStrSet(cfg.PostTypes),
+		groups:    toSet(cfg.Groups),
+		actions:   toStrSet(cfg.Actions),
+		pending:   make(map[int64]chan *rpcMessage),
+		stopping:  make(chan struct{}),
+		exited:    make(chan struct{}),
+	}
+}
+
+// RegisterStdioPlugins 注册所有的外部插件
+// 需要在 RegisterAllPlugins 之前调用
+func RegisterStdioPlugins(cfgs []StdioPluginConfig) {
+	stdioPlugins.Lock()
+	defer stdioPlugins.Unlock()
+	for _, cfg := range cfgs {
+		plug := newStdioPlugin(cfg)
+		stdioPlugins.entries = append(stdioPlugins.entries, plug)
+		PluginRegister(plug)
+	}
+}
+
+// stopStdioPlugins 同时停止所有的外部插件，返回第一个错误
+func stopStdioPlugins(ctx context.Context) error {
+	stdioPlugins.Lock()
+	entries := stdioPlugins.entries
+	stdioPlugins.Unlock()
+	errs := make([]error, len(entries))
+	var wg sync.WaitGroup
+	for i, plug := range entries {
+		wg.Add(1)
+		go func(i int, plug *stdioPlugin) {
+			defer wg.Done()
+			errs[i] = plug.stop(ctx)
+		}(i, plug)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Name 插件名称
+func (p *stdioPlugin) Name() string {
+	return p.cfg.Name
+}
+
+// Load 检查可执行文件并启动插件进程
+func (p *stdioPlugin) Load() error {
+	if _, err := exec.LookPath(p.cfg.Command); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.started = true
+	p.mu.Unlock()
+	go p.supervise()
+	return nil
+}
+
+// Filters 按配置过滤推送的事件
+func (p *stdioPlugin) Filters() map[string]Filter {
+	return map[string]Filter{
+		"event": p.filter,
+	}
+}
+
+// Handlers 把事件推送给插件进程
+func (p *stdioPlugin) Handlers() map[string]Handler {
+	return map[string]Handler{
+		"event": p.push,
+	}
+}
+
+// Loaded 加载完成
+func (p *stdioPlugin) Loaded() {
+}
+
+func (p *stdioPlugin) filter(event *CQEvent) bool {
+	if len(p.postTypes) > 0 && !p.postTypes[event.PostType] {
+		return false
+	}
+	if len(p.groups) > 0 && event.GroupID != 0 && !p.groups[event.GroupID] {
+		return false
+	}
+	return true
+}
+
+func (p *stdioPlugin) push(event *CQEvent) {
+	p.mu.Lock()
+	ready := p.ready
+	p.mu.Unlock()
+	if !ready {
+		return
+	}
+	err := p.write(&rpcMessage{
+		JSONRPC: "2.0",
+		Method:  "event",
+		Params:  event.Raw(),
+	})
+	if err != nil {
+		p.log.Errorf("push event error: %v", err)
+	}
+}
+
+// supervise 启动插件进程，崩溃后按指数退避重启，直到插件被停止
+func (p *stdioPlugin) supervise() {
+	defer close(p.exited)
+	backoff := stdioMinBackoff
+	for {
+		start := time.Now()
+		err := p.run()
+		select {
+		case <-p.stopping:
+			p.log.Infof("process stopped (%v)", err)
+			return
+		default:
+		}
+		if time.Since(start) > stdioStableTime {
+			backoff = stdioMinBackoff
+		}
+		p.log.Errorf("process exited (%v), restart after %v", err, backoff)
+		select {
+		case <-p.stopping:
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > stdioMaxBackoff {
+			backoff = stdioMaxBackoff
+		}
+	}
+}
+
+func (p *stdioPlugin) run() error {
+	cmd := exec.Command(p.cfg.Command, p.cfg.Args...)
+	cmd.Dir = p.cfg.Dir
+	cmd.Env = append(os.Environ(), p.cfg.Env...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	// 标准错误输出使用自己的管道，继承了管道的子进程不会让 cmd.Wait 一直等待
+	stderr, stderrW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	cmd.Stderr = stderrW
+	// 持有锁启动并设置 stdin，stop 要么看到可以关闭的 stdin，要么让这里不再启动
+	p.mu.Lock()
+	select {
+	case <-p.stopping:
+		p.mu.Unlock()
+		stderr.Close()
+		stderrW.Close()
+		return errStdioNotRunning
+	default:
+	}
+	err = cmd.Start()
+	stderrW.Close()
+	if err != nil {
+		p.mu.Unlock()
+		stderr.Close()
+		return err
+	}
+	p.cmd = cmd
+	p.stdin = stdin
+	p.mu.Unlock()
+	p.log.Infof("process started, pid = %d", cmd.Process.Pid)
+	go func() {
+		defer stderr.Close()
+		p.pipeStderr(stderr)
+	}()
+	go p.initialize()
+	p.readLoop(stdout)
+	p.reset()
+	stdin.Close()
+	return cmd.Wait()
+}
+
+// stop 关闭插件的标准输入并等待进程退出，ctx 结束时强制结束进程
+func (p *stdioPlugin) stop(ctx context.Context) error {
+	p.stopOnce.Do(func() {
+		close(p.stopping)
+	})
+	p.mu.Lock()
+	started := p.started
+	stdin := p.stdin
+	p.ready = false
+	p.mu.Unlock()
+	if !started {
+		return nil
+	}
+	if stdin != nil {
+		stdin.Close()
+	}
+	select {
+	case <-p.exited:
+		return nil
+	case <-ctx.Done():
+	}
+	p.mu.Lock()
+	if p.cmd != nil {
+		p.log.Warn("process did not exit in time, kill it")
+		p.cmd.Process.Kill()
+	}
+	p.mu.Unlock()
+	<-p.exited
+	return ctx.Err()
+}
+
+// reset 进程退出后清理状态，正在等待的请求全部失败
+func (p *stdioPlugin) reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stdin = nil
+	p.cmd = nil
+	p.ready = false
+	for id, ch := range p.pending {
+		close(ch)
+		delete(p.pending, id)
+	}
+}
+
+func (p *stdioPlugin) pipeStderr(stderr io.Reader) {
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		p.log.Warn(scanner.Text())
+	}
+}
+
+// initialize 握手，成功之后才开始推送事件
+func (p *stdioPlugin) initialize() {
+	res, err := p.call("initialize", map[string]interface{}{
+		"protocol": StdioProtocolVersion,
+		"name":     p.cfg.Name,
+	})
+	if err != nil {
+		p.log.Errorf("initialize error: %v", err)
+		return
+	}
+	if res.Error != nil {
+		p.log.Errorf("initialize error: %s", res.Error.Message)
+		return
+	}
+	p.mu.Lock()
+	p.ready = true
+	p.mu.Unlock()
+	p.log.Success("initialized")
+}
+
+// call 向插件发送请求并等待响应
+func (p *stdioPlugin) call(method string, params interface{}) (*rpcMessage, error) {
+	rawParams, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	p.seq++
+	id := p.seq
+	ch := make(chan *rpcMessage, 1)
+	p.pending[id] = ch
+	p.mu.Unlock()
+	rawID, _ := json.Marshal(id)
+	err = p.write(&rpcMessage{
+		JSONRPC: "2.0",
+		ID:      rawID,
+		Method:  method,
+		Params:  rawParams,
+	})
+	if err != nil {
+		p.mu.Lock()
+		delete(p.pending, id)
+		p.mu.Unlock()
+		return nil, err
+	}
+	timer := time.NewTimer(timeForWait * time.Second)
+	defer timer.Stop()
+	select {
+	case res, ok := <-ch:
+		if !ok {
+			return nil, errStdioNotRunning
+		}
+		return res, nil
+	case <-timer.C:
+		p.mu.Lock()
+		delete(p.pending, id)
+		p.mu.Unlock()
+		return nil, ErrAPITimeout
+	}
+}
+
+func (p *stdioPlugin) write(msg *rpcMessage) error {
+	raw, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	stdin := p.stdin
+	p.mu.Unlock()
+	if stdin == nil {
+		return errStdioNotRunning
+	}
+	p.wmu.Lock()
+	defer p.wmu.Unlock()
+	_, err = stdin.Write(append(raw, '\n'))
+	return err
+}
+
+// readLoop 读取插件的输出，每一行是一个 JSON-RPC 消息
+func (p *stdioPlugin) readLoop(stdout io.Reader) {
+	reader := bufio.NewReader(stdout)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 1 {
+			p.handleLine(line)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (p *stdioPlugin) handleLine(line []byte) {
+	msg := new(rpcMessage)
+	if err := json.Unmarshal(line, msg); err != nil {
+		p.log.Errorf("invalid message: %v", err)
+		p.reply(nil, nil, &rpcError{Code: rpcParseError, Message: err.Error()})
+		return
+	}
+	// 插件对请求的响应
+	if msg.Method == "" {
+		var id int64
+		if err := json.Unmarshal(msg.ID, &id); err != nil {
+			return
+		}
+		p.mu.Lock()
+		ch, ok := p.pending[id]
+		delete(p.pending, id)
+		p.mu.Unlock()
+		if ok {
+			ch <- msg
+		}
+		return
+	}
+	// 插件调用api
+	go p.handleRequest(msg)
+}
+
+func (p *stdioPlugin) handleRequest(msg *rpcMessage) {
+	if msg.JSONRPC != "2.0" {
+		p.reply(msg.ID, nil, &rpcError{Code: rpcInvalidRequest, Message: "jsonrpc must be 2.0"})
+		return
+	}
+	if len(p.actions) > 0 && !p.actions[msg.Method] {
+		p.reply(msg.ID, nil, &rpcError{Code: rpcMethodNotFound, Message: "action is not allowed: " + msg.Method})
+		return
+	}
+	var params interface{} = map[string]interface{}{}
+	if len(msg.Params) > 0 {
+		params = msg.Params
+	}
+	res, err := Client.CallAction(msg.Method, params)
+	if err != nil {
+		if apiErr, ok := err.(*APIError); ok {
+			p.reply(msg.ID, nil, &rpcError{
+				Code:    rpcActionFailed,
+				Message: apiErr.Error(),
+				Data:    map[string]interface{}{"retcode": apiErr.RetCode},
+			})
+			return
+		}
+		p.reply(msg.ID, nil, &rpcError{Code: rpcAPIUnavailable, Message: err.Error()})
+		return
+	}
+	p.reply(msg.ID, res.Data, nil)
+}
+
+// reply 响应插件的请求，没有 id 的通知不需要响应（解析错误除外）
+func (p *stdioPlugin) reply(id json.RawMessage, result interface{}, rpcErr *rpcError) {
+	if id == nil {
+		if rpcErr == nil || rpcErr.Code != rpcParseError {
+			return
+		}
+		id = json.RawMessage("null")
+	}
+	if rpcErr == nil && result == nil {
+		result = json.RawMessage("null")
+	}
+	msg := &rpcMessage{
+		JSONRPC: "2.0",
+		ID:      id,
+		Result:  result,
+		Error:   rpcErr,
+	}
+	if err := p.write(msg); err != nil {
+		p.log.Errorf("reply error: %v", err)
+	}
+}
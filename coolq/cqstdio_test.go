@@ -0,0 +1,76 @@
+package coolq
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func startStdioPlugin(t *testing.T, command string, args ...string) *stdioPlugin {
+	t.Helper()
+	p := newStdioPlugin(StdioPluginConfig{Name: "stdio@test", Command: command, Args: args})
+	if err := p.Load(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		p.mu.Lock()
+		running := p.cmd != nil
+		p.mu.Unlock()
+		if running {
+			return p
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("process did not start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// 插件读到 EOF 后退出，不会被重新启动
+func TestStdioStopGraceful(t *testing.T) {
+	p := startStdioPlugin(t, "sh", "-c", "cat > /dev/null")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := p.stop(ctx); err != nil {
+		t.Fatalf("stop() = %v", err)
+	}
+	select {
+	case <-p.exited:
+	default:
+		t.Fatal("supervise should exit after stop")
+	}
+}
+
+// 继承了标准错误输出的子进程不会阻塞插件的退出
+func TestStdioStopInheritedStderr(t *testing.T) {
+	p := startStdioPlugin(t, "sh", "-c", "sleep 10 > /dev/null & cat > /dev/null")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := p.stop(ctx); err != nil {
+		t.Fatalf("stop() = %v", err)
+	}
+}
+
+// 不理会 EOF 的插件在 ctx 结束时被强制结束
+func TestStdioStopKill(t *testing.T) {
+	p := startStdioPlugin(t, "sleep", "60")
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := p.stop(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("stop() = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("stop took %v", elapsed)
+	}
+}
+
+func TestStdioStopNotStarted(t *testing.T) {
+	p := newStdioPlugin(StdioPluginConfig{Name: "stdio@test", Command: "sh"})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := p.stop(ctx); err != nil {
+		t.Fatalf("stop() = %v", err)
+	}
+}
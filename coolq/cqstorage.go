@@ -0,0 +1,190 @@
+package coolq
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"sync"
+
+	"github.com/BurntSushi/toml"
+)
+
+// ErrStorageKeyNotFound 存储中不存在这个key
+var ErrStorageKeyNotFound = errors.New("storage: key not found")
+
+// defaultDataPath 插件数据的默认目录
+const defaultDataPath = "data"
+
+var unsafeFileChars = regexp.MustCompile(`[^0-9A-Za-z._-]`)
+
+// Storage 插件的持久化键值存储
+// 数据以json格式保存在数据目录下以插件名称命名的文件里
+type Storage struct {
+	mu   sync.Mutex
+	file string
+	data map[string]json.RawMessage
+}
+
+var storages = struct {
+	sync.Mutex
+	dataPath string
+	entries  map[string]*Storage
+}{
+	dataPath: defaultDataPath,
+	entries:  make(map[string]*Storage),
+}
+
+// SetDataPath 设置插件数据目录
+func SetDataPath(p string) {
+	storages.Lock()
+	defer storages.Unlock()
+	if p == "" {
+		p = defaultDataPath
+	}
+	storages.dataPath = p
+}
+
+// GetStorage 获取插件的存储
+func GetStorage(plugin string) *Storage {
+	storages.Lock()
+	defer storages.Unlock()
+	if s, ok := storages.entries[plugin]; ok {
+		return s
+	}
+	filename := unsafeFileChars.ReplaceAllString(plugin, "_") + ".json"
+	s := &Storage{file: path.Join(storages.dataPath, filename)}
+	storages.entries[plugin] = s
+	return s
+}
+
+// load 第一次使用时从文件读取
+// 读取失败时不记录数据，下次使用时重新读取，避免用空数据覆盖原来的文件
+func (s *Storage) load() error {
+	if s.data != nil {
+		return nil
+	}
+	data := make(map[string]json.RawMessage)
+	raw, err := ioutil.ReadFile(s.file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(bytes.TrimSpace(raw)) > 0 {
+		if err := json.Unmarshal(raw, &data); err != nil {
+			return err
+		}
+	}
+	s.data = data
+	return nil
+}
+
+// save 先写临时文件再替换，避免写到一半时数据损坏
+func (s *Storage) save() error {
+	raw, err := json.MarshalIndent(s.data, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(s.file), 0700); err != nil {
+		return err
+	}
+	tmp := s.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, raw, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.file)
+}
+
+// Get 读取key对应的值到v，不存在时返回 ErrStorageKeyNotFound
+func (s *Storage) Get(key string, v interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return err
+	}
+	raw, ok := s.data[key]
+	if !ok {
+		return ErrStorageKeyNotFound
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// Set 保存key对应的值，v 需要能序列化成json
+func (s *Storage) Set(key string, v interface{}) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return err
+	}
+	s.data[key] = raw
+	return s.save()
+}
+
+// Delete 删除key
+func (s *Storage) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return err
+	}
+	if _, ok := s.data[key]; !ok {
+		return nil
+	}
+	delete(s.data, key)
+	return s.save()
+}
+
+// Keys 所有的key，按字典序排列
+func (s *Storage) Keys() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(s.data))
+	for key := range s.data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// pluginConfigs 配置文件中每个插件的配置 [plugins."插件名称"]
+var pluginConfigs = struct {
+	sync.RWMutex
+	entries map[string]map[string]interface{}
+}{entries: make(map[string]map[string]interface{})}
+
+// SetPluginConfigs 设置所有插件的配置
+func SetPluginConfigs(cfgs map[string]map[string]interface{}) {
+	pluginConfigs.Lock()
+	defer pluginConfigs.Unlock()
+	pluginConfigs.entries = cfgs
+	if pluginConfigs.entries == nil {
+		pluginConfigs.entries = make(map[string]map[string]interface{})
+	}
+}
+
+// PluginConfig 把插件的配置解析到v，v 使用 toml 标签
+// 配置文件中没有这个插件的配置时 v 保持不变
+func PluginConfig(plugin string, v interface{}) error {
+	pluginConfigs.RLock()
+	cfg, ok := pluginConfigs.entries[plugin]
+	pluginConfigs.RUnlock()
+	if !ok {
+		return nil
+	}
+	buff := new(bytes.Buffer)
+	if err := toml.NewEncoder(buff).Encode(cfg); err != nil {
+		return err
+	}
+	_, err := toml.Decode(buff.String(), v)
+	return err
+}
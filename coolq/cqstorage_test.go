@@ -0,0 +1,74 @@
+package coolq
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestStorageRoundTrip(t *testing.T) {
+	s := &Storage{file: path.Join(storages.dataPath, "roundtrip.json")}
+	if err := s.Get("missing", new(int)); err != ErrStorageKeyNotFound {
+		t.Fatalf("Get(missing) = %v, want %v", err, ErrStorageKeyNotFound)
+	}
+	if err := s.Set("b", 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("a", 1); err != nil {
+		t.Fatal(err)
+	}
+	reloaded := &Storage{file: s.file}
+	var v int
+	if err := reloaded.Get("b", &v); err != nil || v != 2 {
+		t.Fatalf("Get(b) = %d, %v", v, err)
+	}
+	if err := reloaded.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+	if keys, err := reloaded.Keys(); err != nil || len(keys) != 1 || keys[0] != "a" {
+		t.Fatalf("Keys() = %v, %v", keys, err)
+	}
+}
+
+// 损坏的文件每次都返回错误，不会被空数据覆盖
+func TestStorageCorruptFile(t *testing.T) {
+	file := path.Join(storages.dataPath, "corrupt.json")
+	content := []byte(`{"a": 1,`)
+	if err := ioutil.WriteFile(file, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	s := &Storage{file: file}
+	for i := 0; i < 2; i++ {
+		if err := s.Get("a", new(int)); err == nil || err == ErrStorageKeyNotFound {
+			t.Fatalf("Get #%d should return the decode error, got %v", i, err)
+		}
+	}
+	if err := s.Set("b", 2); err == nil {
+		t.Fatal("Set should fail while the file can not be decoded")
+	}
+	raw, err := ioutil.ReadFile(file)
+	if err != nil || string(raw) != string(content) {
+		t.Fatalf("corrupt file should be kept, got %q, %v", raw, err)
+	}
+}
+
+// 读取失败（不是文件不存在）时每次都返回错误
+func TestStorageReadError(t *testing.T) {
+	file := path.Join(storages.dataPath, "unreadable.json")
+	if err := os.Mkdir(file, 0700); err != nil {
+		t.Fatal(err)
+	}
+	s := &Storage{file: file}
+	for i := 0; i < 2; i++ {
+		if _, err := s.Keys(); err == nil {
+			t.Fatalf("Keys #%d should return the read error", i)
+		}
+	}
+	if err := s.Set("a", 1); err == nil {
+		t.Fatal("Set should fail while the file can not be read")
+	}
+	if info, err := os.Stat(file); err != nil || !info.IsDir() {
+		t.Fatalf("unreadable path should be kept: %v", err)
+	}
+}
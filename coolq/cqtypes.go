@@ -2,10 +2,12 @@ package coolq
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"regexp"
 	"strings"
+	"sync"
 )
 
 // Number number
@@ -41,6 +43,13 @@ func Escape(txt string) string {
 	return txt
 }
 
+// Unescape cq码反转义，和 Escape 相反
+func Unescape(txt string) string {
+	return unescaper.Replace(txt)
+}
+
+var unescaper = strings.NewReplacer("&#91;", "[", "&#93;", "]", "&#44;", ",", "&amp;", "&")
+
 // Marshal 序列化成一个包含cq码的信息
 func Marshal(msg Message) []byte {
 	buff := new(bytes.Buffer)
@@ -111,7 +120,8 @@ func Unmarshal(raw []byte, msg *Message) error {
 				Data: map[string]string{},
 			}
 			for i := 1; i < fieldLen; i++ {
-				pair := strings.Split(payloads[i], "=")
+				// 值中可能包含 = （例如链接的参数）
+				pair := strings.SplitN(payloads[i], "=", 2)
 				section.Data[pair[0]] = strings.Join(pair[1:], "")
 			}
 			*msg = AddSection(*msg, section)
@@ -168,18 +178,80 @@ type QAnonymous struct {
 	Flag string `json:"flag"`
 }
 
+// QSender 消息发送者信息
+// Role 只在群消息中有效: owner, admin, member
+type QSender struct {
+	UserID   int64  `json:"user_id"`
+	Nickname string `json:"nickname"`
+	Card     string `json:"card"`
+	Sex      string `json:"sex"`
+	Age      int64  `json:"age"`
+	Role     string `json:"role"`
+}
+
 // CQEvent coolq事件上报格式
 type CQEvent struct {
 	Anonymous   QAnonymous `json:"anonymous"`
+	Comment     string     `json:"comment"`
+	Flag        string     `json:"flag"`
 	Font        int64      `json:"font"`
 	GroupID     int64      `json:"group_id"`
 	Message     string     `json:"message"`
 	MessageID   int64      `json:"message_id"`
 	MessageType string     `json:"message_type"`
+	NoticeType  string     `json:"notice_type"`
+	OperatorID  int64      `json:"operator_id"`
 	PostType    string     `json:"post_type"`
 	RawMessage  string     `json:"raw_message"`
+	RequestType string     `json:"request_type"`
 	SelfID      int64      `json:"self_id"`
+	Sender      QSender    `json:"sender"`
 	SubType     string     `json:"sub_type"`
 	Time        int64      `json:"time"`
 	UserID      int64      `json:"user_id"`
+	raw         []byte
+	values      *eventValues
+}
+
+// eventValues filter 和 handler 之间传递的值
+type eventValues struct {
+	mu sync.Mutex
+	m  map[string]interface{}
+}
+
+// clone 复制一份事件，每一对 filter 和 handler 使用各自的复制
+// 避免不同的 filter 保存的值相互覆盖
+func (event *CQEvent) clone() *CQEvent {
+	ev := *event
+	ev.values = &eventValues{m: make(map[string]interface{})}
+	return &ev
+}
+
+// SetValue 在事件上保存一个值，供之后的 filter 和 handler 使用
+func (event *CQEvent) SetValue(key string, val interface{}) {
+	if event.values == nil {
+		event.values = &eventValues{m: make(map[string]interface{})}
+	}
+	event.values.mu.Lock()
+	defer event.values.mu.Unlock()
+	event.values.m[key] = val
+}
+
+// Value 获取事件上保存的值，不存在时返回 nil
+func (event *CQEvent) Value(key string) interface{} {
+	if event.values == nil {
+		return nil
+	}
+	event.values.mu.Lock()
+	defer event.values.mu.Unlock()
+	return event.values.m[key]
+}
+
+// Raw 事件上报的原始json数据
+func (event *CQEvent) Raw() json.RawMessage {
+	if event.raw != nil {
+		return event.raw
+	}
+	raw, _ := json.Marshal(event)
+	return raw
 }
@@ -0,0 +1,206 @@
+// Package filters 可以组合的插件过滤器
+// 所有的函数都返回 coolq.Filter，可以直接在插件的 Filters() 中使用
+package filters
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/haruno-bot/haruno/coolq"
+)
+
+func toSet(ids []int64) map[int64]bool {
+	set := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		set[id] = true
+	}
+	return set
+}
+
+// text 事件的消息文本
+func text(event *coolq.CQEvent) string {
+	if event.RawMessage != "" {
+		return event.RawMessage
+	}
+	return event.Message
+}
+
+// And 所有的过滤器都通过时通过
+func And(filters ...coolq.Filter) coolq.Filter {
+	return func(event *coolq.CQEvent) bool {
+		for _, filter := range filters {
+			if !filter(event) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Or 任意一个过滤器通过时通过
+func Or(filters ...coolq.Filter) coolq.Filter {
+	return func(event *coolq.CQEvent) bool {
+		for _, filter := range filters {
+			if filter(event) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Not 过滤器不通过时通过
+func Not(filter coolq.Filter) coolq.Filter {
+	return func(event *coolq.CQEvent) bool {
+		return !filter(event)
+	}
+}
+
+// IsGroup 群消息，设置了群号时只通过这些群的消息
+func IsGroup(ids ...int64) coolq.Filter {
+	groups := toSet(ids)
+	return func(event *coolq.CQEvent) bool {
+		if event.PostType != "message" || event.MessageType != "group" {
+			return false
+		}
+		return len(groups) == 0 || groups[event.GroupID]
+	}
+}
+
+// IsPrivate 私聊消息
+func IsPrivate() coolq.Filter {
+	return func(event *coolq.CQEvent) bool {
+		return event.PostType == "message" && event.MessageType == "private"
+	}
+}
+
+// FromUser 来自这些用户的事件
+func FromUser(ids ...int64) coolq.Filter {
+	users := toSet(ids)
+	return func(event *coolq.CQEvent) bool {
+		return users[event.UserID]
+	}
+}
+
+// Prefix 消息以任意一个前缀开头
+func Prefix(prefixes ...string) coolq.Filter {
+	return func(event *coolq.CQEvent) bool {
+		if event.PostType != "message" {
+			return false
+		}
+		msg := text(event)
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(msg, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Keyword 消息包含任意一个关键词
+func Keyword(words ...string) coolq.Filter {
+	return func(event *coolq.CQEvent) bool {
+		if event.PostType != "message" {
+			return false
+		}
+		msg := text(event)
+		for _, word := range words {
+			if strings.Contains(msg, word) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Regex 消息匹配正则表达式
+// 匹配的分组可以在 handler 中使用 Captures 和 NamedCaptures 获取
+// pattern 不合法时会 panic
+func Regex(pattern string) coolq.Filter {
+	re := regexp.MustCompile(pattern)
+	return func(event *coolq.CQEvent) bool {
+		if event.PostType != "message" {
+			return false
+		}
+		matches := re.FindStringSubmatch(text(event))
+		if matches == nil {
+			return false
+		}
+		named := make(map[string]string)
+		for i, name := range re.SubexpNames() {
+			if name != "" {
+				named[name] = matches[i]
+			}
+		}
+		event.SetValue(coolq.ValueCaptures, matches)
+		event.SetValue(coolq.ValueNamedCaptures, named)
+		return true
+	}
+}
+
+// Captures Regex 的匹配结果，第0个为整个匹配
+// 没有经过 Regex 时返回 nil
+func Captures(event *coolq.CQEvent) []string {
+	matches, _ := event.Value(coolq.ValueCaptures).([]string)
+	return matches
+}
+
+// NamedCaptures Regex 命名分组的匹配结果
+// 没有经过 Regex 时返回 nil
+func NamedCaptures(event *coolq.CQEvent) map[string]string {
+	named, _ := event.Value(coolq.ValueNamedCaptures).(map[string]string)
+	return named
+}
+
+// AtMe 消息中@了机器人
+// 机器人的QQ号从上报的事件中得到
+func AtMe() coolq.Filter {
+	return func(event *coolq.CQEvent) bool {
+		if event.PostType != "message" {
+			return false
+		}
+		selfID := event.SelfID
+		if selfID == 0 {
+			selfID = coolq.Client.SelfID()
+		}
+		if selfID == 0 {
+			return false
+		}
+		at := fmt.Sprintf("[CQ:at,qq=%d", selfID)
+		return strings.Contains(event.Message, at+"]") || strings.Contains(event.Message, at+",")
+	}
+}
+
+// HasImage 消息中包含图片
+func HasImage() coolq.Filter {
+	return func(event *coolq.CQEvent) bool {
+		return event.PostType == "message" && strings.Contains(event.Message, "[CQ:image,")
+	}
+}
+
+// NoticeType 通知事件，设置了类型时只通过这些类型的通知
+func NoticeType(types ...string) coolq.Filter {
+	return func(event *coolq.CQEvent) bool {
+		if event.PostType != "notice" {
+			return false
+		}
+		if len(types) == 0 {
+			return true
+		}
+		for _, t := range types {
+			if event.NoticeType == t {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// FromRole 触发者的权限等级不低于 role
+func FromRole(role coolq.Role) coolq.Filter {
+	return func(event *coolq.CQEvent) bool {
+		return coolq.Client.RoleOf(event) >= role
+	}
+}
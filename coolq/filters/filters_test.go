@@ -0,0 +1,80 @@
+package filters
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/haruno-bot/haruno/coolq"
+)
+
+func groupMsg(groupID, userID int64, msg string) *coolq.CQEvent {
+	return &coolq.CQEvent{
+		PostType:    "message",
+		MessageType: "group",
+		GroupID:     groupID,
+		UserID:      userID,
+		SelfID:      10000,
+		Message:     msg,
+		RawMessage:  msg,
+	}
+}
+
+func TestFilters(t *testing.T) {
+	private := &coolq.CQEvent{PostType: "message", MessageType: "private", UserID: 2, Message: "/help"}
+	notice := &coolq.CQEvent{PostType: "notice", NoticeType: "group_increase", GroupID: 1}
+	cases := []struct {
+		name   string
+		filter coolq.Filter
+		event  *coolq.CQEvent
+		want   bool
+	}{
+		{"group", IsGroup(), groupMsg(1, 2, "hi"), true},
+		{"group id", IsGroup(1, 3), groupMsg(1, 2, "hi"), true},
+		{"other group", IsGroup(3), groupMsg(1, 2, "hi"), false},
+		{"private is not group", IsGroup(), private, false},
+		{"private", IsPrivate(), private, true},
+		{"from user", FromUser(2), private, true},
+		{"from other user", FromUser(3), private, false},
+		{"prefix", Prefix("!", "/"), private, true},
+		{"no prefix", Prefix("!"), private, false},
+		{"keyword", Keyword("foo", "el"), private, true},
+		{"keyword on notice", Keyword(""), notice, false},
+		{"at me", AtMe(), groupMsg(1, 2, "[CQ:at,qq=10000] hi"), true},
+		{"at me with name", AtMe(), groupMsg(1, 2, "[CQ:at,qq=10000,name=haruno] hi"), true},
+		{"at another", AtMe(), groupMsg(1, 2, "[CQ:at,qq=100001] hi"), false},
+		{"image", HasImage(), groupMsg(1, 2, "[CQ:image,file=a.png]"), true},
+		{"no image", HasImage(), groupMsg(1, 2, "image"), false},
+		{"notice", NoticeType(), notice, true},
+		{"notice type", NoticeType("group_decrease", "group_increase"), notice, true},
+		{"other notice type", NoticeType("group_decrease"), notice, false},
+		{"message is not notice", NoticeType(), private, false},
+		{"and", And(IsPrivate(), Prefix("/")), private, true},
+		{"and fails", And(IsPrivate(), Prefix("!")), private, false},
+		{"or", Or(IsGroup(), Prefix("/")), private, true},
+		{"or fails", Or(IsGroup(), Prefix("!")), private, false},
+		{"not", Not(IsGroup()), private, true},
+	}
+	for _, c := range cases {
+		if got := c.filter(c.event); got != c.want {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestRegexCaptures(t *testing.T) {
+	filter := Regex(`^/roll (?P<count>\d+)d(?P<sides>\d+)$`)
+	event := groupMsg(1, 2, "/roll 2d6")
+	if !filter(event) {
+		t.Fatal("message should match")
+	}
+	if got, want := Captures(event), []string{"/roll 2d6", "2", "6"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Captures = %q, want %q", got, want)
+	}
+	if got, want := NamedCaptures(event), map[string]string{"count": "2", "sides": "6"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("NamedCaptures = %v, want %v", got, want)
+	}
+	other := groupMsg(1, 2, "/roll d6")
+	if filter(other) || Captures(other) != nil || NamedCaptures(other) != nil {
+		t.Error("unmatched message should have no captures")
+	}
+}
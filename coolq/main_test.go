@@ -0,0 +1,23 @@
+package coolq
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/haruno-bot/haruno/logger"
+)
+
+// TestMain 日志和数据写入临时目录，日志目录只能是相对路径
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir(".", "test-")
+	if err != nil {
+		panic(err)
+	}
+	logger.Service.SetLogsPath(dir)
+	logger.Service.Initialize()
+	storages.dataPath = dir
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
@@ -12,6 +12,7 @@ import (
 
 	"github.com/BurntSushi/toml"
 	"github.com/gorilla/mux"
+	"github.com/haruno-bot/haruno/clients"
 	"github.com/haruno-bot/haruno/coolq"
 	"github.com/haruno-bot/haruno/logger"
 	"github.com/haruno-bot/haruno/plugins"
@@ -19,13 +20,34 @@ import (
 )
 
 type config struct {
-	Version    string `toml:"version"`
-	LogsPath   string `toml:"logsPath"`
-	ServerPort int    `toml:"serverPort"`
-	CQWSURL    string `toml:"cqWSURL"`
-	CQHTTPURL  string `toml:"cqHTTPURL"`
-	CQToken    string `toml:"cqToken"`
-	WebRoot    string `toml:"webroot"`
+	Version     string `toml:"version"`
+	LogsPath    string `toml:"logsPath"`
+	LogLevel    string `toml:"logLevel"`
+	LogFormat   string `toml:"logFormat"`
+	PluginsPath string `toml:"pluginsPath"`
+	DataPath    string `toml:"dataPath"`
+	ServerPort  int    `toml:"serverPort"`
+	CQWSURL     string `toml:"cqWSURL"`
+	CQHTTPURL   string `toml:"cqHTTPURL"`
+	CQToken     string `toml:"cqToken"`
+	CQSecret    string `toml:"cqSecret"`
+	WebRoot     string `toml:"webroot"`
+
+	LogRotate     logger.RotateConfig        `toml:"logRotate"`
+	Dispatch      coolq.DispatchConfig       `toml:"dispatch"`
+	Dedup         coolq.DedupConfig          `toml:"dedup"`
+	Guard         coolq.GuardConfig          `toml:"guard"`
+	Sender        coolq.SenderConfig         `toml:"sender"`
+	Retry         coolq.RetryConfig          `toml:"retry"`
+	Websocket     coolq.WebsocketConfig      `toml:"websocket"`
+	Proxy         coolq.ProxyConfig          `toml:"proxy"`
+	Media         coolq.MediaConfig          `toml:"media"`
+	Egress        coolq.EgressConfig         `toml:"egress"`
+	Permission    coolq.PermissionConfig     `toml:"permission"`
+	StdioPlugins  []coolq.StdioPluginConfig  `toml:"stdioPlugins"`
+	RemotePlugins []coolq.RemotePluginConfig `toml:"remotePlugins"`
+
+	Plugins map[string]map[string]interface{} `toml:"plugins"`
 }
 
 // haruno 晴乃机器人
@@ -56,10 +78,37 @@ func (bot *haruno) Initialize() {
 	os.Setenv("CQHTTPURL", bot.c.CQHTTPURL)
 	os.Setenv("CQWSURL", bot.c.CQWSURL)
 	os.Setenv("CQTOKEN", bot.c.CQToken)
+	if err := logger.Service.SetLevel(bot.c.LogLevel); err != nil {
+		logger.Logger.Fatalln("Haruno Initialize fialed:", err)
+	}
+	if err := logger.Service.SetFormat(bot.c.LogFormat); err != nil {
+		logger.Logger.Fatalln("Haruno Initialize fialed:", err)
+	}
+	logger.Service.SetRotate(bot.c.LogRotate)
 	logger.Service.SetLogsPath(bot.c.LogsPath)
 	logger.Service.Initialize()
+	coolq.SetDataPath(bot.c.DataPath)
+	coolq.SetPluginConfigs(bot.c.Plugins)
+	if err := coolq.SetProxy(bot.c.Proxy); err != nil {
+		logger.Logger.Fatalln("Haruno Initialize fialed:", err)
+	}
+	coolq.SetEgress(bot.c.Egress)
+	if err := coolq.SetMedia(bot.c.Media); err != nil {
+		logger.Logger.Fatalln("Haruno Initialize fialed:", err)
+	}
 	plugins.SetupPlugins()
+	coolq.LoadDynamicPlugins(bot.c.PluginsPath)
+	coolq.RegisterStdioPlugins(bot.c.StdioPlugins)
+	coolq.RegisterRemotePlugins(bot.c.RemotePlugins)
+	coolq.Client.SetDispatch(bot.c.Dispatch)
+	coolq.Client.SetDedup(bot.c.Dedup)
+	coolq.Client.SetGuard(bot.c.Guard)
+	coolq.Client.SetSender(bot.c.Sender)
+	coolq.Client.SetRetry(bot.c.Retry)
+	coolq.Client.SetWebsocket(bot.c.Websocket)
+	coolq.Client.SetPostSecret(bot.c.CQSecret)
 	coolq.Client.Initialize(bot.c.CQToken)
+	coolq.Client.SetPermission(bot.c.Permission)
 	go coolq.Client.Connect(bot.c.CQWSURL, bot.c.CQHTTPURL)
 	go coolq.Client.RegisterAllPlugins()
 }
@@ -71,6 +120,12 @@ type Status struct {
 	Success int    `json:"success"`
 	Fails   int    `json:"fails"`
 	Start   int64  `json:"start"`
+
+	Dispatch coolq.DispatchStats            `json:"dispatch"`
+	Dedup    coolq.DedupStats               `json:"dedup"`
+	Sender   coolq.SenderStats              `json:"sender"`
+	Conns    map[string]coolq.ConnStats     `json:"conns"`
+	Egress   map[string]clients.EgressStats `json:"egress"`
 }
 
 func statusHandler(w http.ResponseWriter, r *http.Request) {
@@ -81,6 +136,11 @@ func statusHandler(w http.ResponseWriter, r *http.Request) {
 	status.Version = bot.c.Version
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	status.Go = runtime.NumGoroutine()
+	status.Dispatch = coolq.Client.DispatchStats()
+	status.Dedup = coolq.Client.DedupStats()
+	status.Sender = coolq.Client.SenderStats()
+	status.Conns = coolq.Client.ConnStats()
+	status.Egress = coolq.PluginEgressStats()
 	json.NewEncoder(w).Encode(status)
 }
 
@@ -100,6 +160,9 @@ func (bot *haruno) Run() {
 	r.Methods(http.MethodGet).Path("/status").HandlerFunc(statusHandler)
 	r.Methods(http.MethodGet).Path("/logs/-/type=websocket").HandlerFunc(logger.WSLogHandler)
 	r.Methods(http.MethodGet).Path("/logs/-/type=plain").HandlerFunc(logger.RawLogHandler)
+	r.Methods(http.MethodGet).Path("/logs/-/type=search").HandlerFunc(logger.SearchLogHandler)
+	r.Methods(http.MethodPost).Path("/api/actions").HandlerFunc(coolq.RemoteActionHandler)
+	r.Methods(http.MethodPost).Path("/coolq/event").HandlerFunc(coolq.Client.EventPostHandler)
 
 	srv := &http.Server{
 		Addr:         fmt.Sprintf("127.0.0.1:%d", bot.c.ServerPort),
@@ -127,6 +190,9 @@ func (bot *haruno) Run() {
 	defer cancel()
 
 	srv.Shutdown(ctx)
+	if err := coolq.Client.Shutdown(ctx); err != nil {
+		logger.Logger.Println("coolq client shutdown error:", err)
+	}
 
 	logger.Logger.Println("haruno is shutting down")
 
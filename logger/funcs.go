@@ -2,7 +2,27 @@ package logger
 
 // Field 设置logger的域
 func Field(name string) LogInterface {
-	return &loggerWithField{field: name, service: &Service}
+	return Service.Field(name)
+}
+
+// WithField 返回带上键值的logger
+func WithField(key string, value interface{}) LogInterface {
+	return Service.WithField(key, value)
+}
+
+// WithFields 返回带上多个键值的logger
+func WithFields(fields Fields) LogInterface {
+	return Service.WithFields(fields)
+}
+
+// Debug 调试log
+func Debug(text string) {
+	Service.Debug(text)
+}
+
+// Debugf 格式化调试log
+func Debugf(format string, args ...interface{}) {
+	Service.Debugf(format, args...)
 }
 
 // Success 成功log
@@ -25,6 +45,16 @@ func Infof(format string, args ...interface{}) {
 	Service.Infof(format, args...)
 }
 
+// Warn 警告log
+func Warn(text string) {
+	Service.Warn(text)
+}
+
+// Warnf 格式化警告log
+func Warnf(format string, args ...interface{}) {
+	Service.Warnf(format, args...)
+}
+
 // Error 错误log
 func Error(a interface{}) {
 	Service.Error(a)
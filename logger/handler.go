@@ -3,9 +3,10 @@ package logger
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
-	"path"
+	"strconv"
 	"strings"
 	"time"
 
@@ -23,84 +24,190 @@ const (
 var upgrader = websocket.Upgrader{}
 
 // WSLogHandler 广播log
+// 连接时先发送最近的日志，参数 level 和 field.<key>=<value> 可以过滤日志
+// 读取太慢的连接会被断开
 func WSLogHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseLogFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, RequestParamError, http.StatusBadRequest)
+		return
+	}
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		Service.Errorf("Logger WSLogHandler error: %v", err)
 		return
 	}
-	var welMsg = NewLog(LogTypeInfo, "Logger服务连接成功!")
-	Service.setConn(conn, true)
-	quit := make(chan int)
-	setupPong(conn, quit)
-	conn.WriteJSON(welMsg)
-	for {
-		if !Service.conns[conn] {
-			close(quit)
-			return
+	defer conn.Close()
+	sub := Service.hub.subscribe(filter)
+	defer Service.hub.unsubscribe(sub)
+	// 读取控制消息，连接断开时取消订阅
+	conn.SetReadDeadline(time.Now().Add(pongWaitTime * 3))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongWaitTime * 3))
+	})
+	go func() {
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				Service.hub.unsubscribe(sub)
+				return
+			}
 		}
+	}()
+	ticker := time.NewTicker(pongWaitTime)
+	defer ticker.Stop()
+	// 所有的写入都在这个 goroutine 中
+	write := func(lg *Log) error {
+		conn.SetWriteDeadline(time.Now().Add(pongWaitTime))
+		return conn.WriteJSON(lg)
+	}
+	if err := write(NewLog(LogTypeInfo, "Logger服务连接成功!")); err != nil {
+		return
+	}
+	for {
 		select {
-		case <-quit:
+		case <-sub.done:
+			if sub.evicted {
+				msg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "too slow")
+				conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(pongWaitTime))
+			}
 			return
-		case lg := <-Service.logChan:
-			for c, ok := range Service.conns {
-				if !ok {
-					continue
-				}
-				err := c.WriteJSON(lg)
-				if err != nil {
-					Service.setConn(c, false)
-				}
+		case lg := <-sub.queue:
+			if err := write(lg); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(pongWaitTime)); err != nil {
+				return
 			}
 		}
-
 	}
 }
 
-// RawLogHandler 获取log文件
+// RawLogHandler 获取某一天的log文件
+// type 为空或者 info 时返回普通日志，为 error 时返回错误日志
+// 支持单个范围的 Range 请求
 func RawLogHandler(w http.ResponseWriter, r *http.Request) {
 	query := r.URL.Query()
 	date := query.Get("date")
-	logType := query.Get("type")
 	tim, err := time.Parse(logDateFormat, date)
 	if date == "" || err != nil {
-		http.Error(w, RequestParamError, 404)
+		http.Error(w, RequestParamError, http.StatusBadRequest)
 		return
 	}
-	logfileName := fmt.Sprintf("%s.log", tim.Format(logDateFormat))
-	if len(logType) != 0 {
-		if strings.ToLower(logType) == "error" {
-			logfileName = fmt.Sprintf("%s-%s.log", tim.Format(logDateFormat), logType)
-		} else {
-			http.Error(w, RequestParamError, 404)
-			return
-		}
-	}
-	logfilePath := path.Join(Service.LogsPath(), logfileName)
-	stat, err := os.Stat(logfilePath)
-	if err != nil && os.IsNotExist(err) {
-		http.Error(w, FileNotFoundError, 404)
+	scope := ""
+	switch strings.ToLower(query.Get("type")) {
+	case "", "info":
+	case "error":
+		scope = "error"
+	default:
+		http.Error(w, RequestParamError, http.StatusBadRequest)
 		return
 	}
-	if stat.Size() == 0 {
-		http.Error(w, LogFileEmptyMsg, 200)
+	dir := Service.LogsPath()
+	date = tim.Format(logDateFormat)
+	// 当天切分出来的文件按顺序拼接，压缩的文件解压后返回
+	fp, size, err := openLogParts(dir, date, scope)
+	if os.IsNotExist(err) {
+		http.Error(w, FileNotFoundError, http.StatusNotFound)
 		return
 	}
-	fp, err := os.OpenFile(logfilePath, os.O_RDONLY, 0600)
 	if err != nil {
 		Logger.Println(err)
-		http.Error(w, InnerServerError, 500)
+		http.Error(w, InnerServerError, http.StatusInternalServerError)
 		return
 	}
-	defer fp.Close()
-	w.Header().Add("Content-Type", "text/plain; charset=utf-8")
-	w.Header().Add("Content-Length", fmt.Sprintf("%d", stat.Size()))
-	buff := make([]byte, 100)
-	for {
-		cnt, err := fp.Read(buff)
-		w.Write(buff[:cnt])
-		if err == io.EOF {
+	defer func() {
+		fp.Close()
+	}()
+	if size == 0 {
+		http.Error(w, LogFileEmptyMsg, http.StatusOK)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Accept-Ranges", "bytes")
+	rangeHeader := r.Header.Get("Range")
+	if strings.Contains(rangeHeader, ",") {
+		// 不支持多个范围，返回整个文件
+		rangeHeader = ""
+	}
+	if rangeHeader != "" && size < 0 {
+		// 有压缩的文件时先解压一遍得到长度
+		if size, err = io.Copy(ioutil.Discard, fp); err != nil {
+			Logger.Println(err)
+			http.Error(w, InnerServerError, http.StatusInternalServerError)
 			return
 		}
+		fp.Close()
+		if fp, _, err = openLogParts(dir, date, scope); err != nil {
+			Logger.Println(err)
+			http.Error(w, InnerServerError, http.StatusInternalServerError)
+			return
+		}
+	}
+	var reader io.Reader = fp
+	status := http.StatusOK
+	if size > 0 {
+		// 读取时可能又写入了新的日志
+		reader = io.LimitReader(fp, size)
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	if rangeHeader != "" {
+		start, length, ok := parseRange(rangeHeader, size)
+		if !ok {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			http.Error(w, RequestParamError, http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		if _, err := io.CopyN(ioutil.Discard, fp, start); err != nil {
+			Logger.Println(err)
+			http.Error(w, InnerServerError, http.StatusInternalServerError)
+			return
+		}
+		reader = io.LimitReader(fp, length)
+		status = http.StatusPartialContent
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, size))
+		w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	}
+	w.WriteHeader(status)
+	if _, err := io.Copy(w, reader); err != nil {
+		Logger.Println(err)
+	}
+}
+
+// parseRange 解析单个范围的 Range，返回开始位置和长度
+func parseRange(header string, size int64) (int64, int64, bool) {
+	if !strings.HasPrefix(header, "bytes=") {
+		return 0, 0, false
+	}
+	spec := strings.TrimSpace(strings.TrimPrefix(header, "bytes="))
+	dash := strings.IndexByte(spec, '-')
+	if dash < 0 {
+		return 0, 0, false
+	}
+	first, last := spec[:dash], spec[dash+1:]
+	if first == "" {
+		// 最后 n 个字节
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, n, true
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false
+	}
+	end := size - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+			return 0, 0, false
+		}
+		if end >= size {
+			end = size - 1
+		}
 	}
+	return start, end - start + 1, true
 }
@@ -0,0 +1,29 @@
+package logger
+
+import "testing"
+
+func TestParseRange(t *testing.T) {
+	cases := []struct {
+		header        string
+		start, length int64
+		ok            bool
+	}{
+		{"bytes=0-99", 0, 100, true},
+		{"bytes=100-", 100, 900, true},
+		{"bytes=-100", 900, 100, true},
+		{"bytes=-2000", 0, 1000, true},
+		{"bytes=900-2000", 900, 100, true},
+		{"bytes=1000-", 0, 0, false},
+		{"bytes=50-10", 0, 0, false},
+		{"bytes=-0", 0, 0, false},
+		{"bytes=abc", 0, 0, false},
+		{"items=0-10", 0, 0, false},
+	}
+	for _, c := range cases {
+		start, length, ok := parseRange(c.header, 1000)
+		if ok != c.ok || start != c.start || length != c.length {
+			t.Errorf("parseRange(%q) = %d, %d, %v, want %d, %d, %v",
+				c.header, start, length, ok, c.start, c.length, c.ok)
+		}
+	}
+}
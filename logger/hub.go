@@ -0,0 +1,142 @@
+package logger
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// subscriberQueueSize 每个订阅者的队列大小，队列满时断开这个订阅者
+const subscriberQueueSize = 256
+
+// logFilter 订阅者的过滤条件
+type logFilter struct {
+	level  int
+	fields map[string]string
+}
+
+// parseLogFilter 从请求参数中解析过滤条件：level 最小级别，field.<key>=<value> 键值
+func parseLogFilter(query url.Values) (logFilter, error) {
+	filter := logFilter{level: LevelDebug}
+	if raw := query.Get("level"); raw != "" {
+		level, err := ParseLevel(raw)
+		if err != nil {
+			return filter, err
+		}
+		filter.level = level
+	}
+	for key, values := range query {
+		if strings.HasPrefix(key, "field.") && len(values) > 0 {
+			if filter.fields == nil {
+				filter.fields = make(map[string]string)
+			}
+			filter.fields[strings.TrimPrefix(key, "field.")] = values[0]
+		}
+	}
+	return filter, nil
+}
+
+func (f logFilter) match(lg *Log) bool {
+	if levelOf(lg.Type) < f.level {
+		return false
+	}
+	for k, v := range f.fields {
+		val, ok := lg.Fields[k]
+		if !ok || fmt.Sprint(val) != v {
+			return false
+		}
+	}
+	return true
+}
+
+// subscriber websocket 的订阅者
+type subscriber struct {
+	queue  chan *Log
+	filter logFilter
+	// done 取消订阅或者因为太慢被断开时关闭
+	done chan struct{}
+	once sync.Once
+	// evicted 因为太慢被断开，只在关闭 done 之前写入，读取前需要等待 done
+	evicted bool
+}
+
+func (sub *subscriber) close(evicted bool) {
+	sub.once.Do(func() {
+		sub.evicted = evicted
+		close(sub.done)
+	})
+}
+
+// logHub 把日志广播给所有的订阅者，并保留最近的日志在连接时重放
+type logHub struct {
+	mu   sync.Mutex
+	ring [maxQueueSize]*Log
+	// next ring 中下一条日志的位置，total 收到的日志总数
+	next  int
+	total int
+	subs  map[*subscriber]struct{}
+}
+
+// publish 广播日志，不会阻塞
+func (h *logHub) publish(lg *Log) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.ring[h.next] = lg
+	h.next = (h.next + 1) % maxQueueSize
+	h.total++
+	for sub := range h.subs {
+		if !sub.filter.match(lg) {
+			continue
+		}
+		select {
+		case sub.queue <- lg:
+		default:
+			// 队列满了说明客户端读取太慢，断开连接
+			delete(h.subs, sub)
+			sub.close(true)
+		}
+	}
+}
+
+// recentLocked 最近的日志，按时间顺序
+func (h *logHub) recentLocked() []*Log {
+	count := h.total
+	if count > maxQueueSize {
+		count = maxQueueSize
+	}
+	logs := make([]*Log, 0, count)
+	for i := 0; i < count; i++ {
+		logs = append(logs, h.ring[(h.next-count+i+maxQueueSize)%maxQueueSize])
+	}
+	return logs
+}
+
+// subscribe 订阅日志，最近的日志会先放进队列
+func (h *logHub) subscribe(filter logFilter) *subscriber {
+	sub := &subscriber{
+		queue:  make(chan *Log, subscriberQueueSize),
+		filter: filter,
+		done:   make(chan struct{}),
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, lg := range h.recentLocked() {
+		if filter.match(lg) {
+			sub.queue <- lg
+		}
+	}
+	if h.subs == nil {
+		h.subs = make(map[*subscriber]struct{})
+	}
+	h.subs[sub] = struct{}{}
+	return sub
+}
+
+// unsubscribe 取消订阅
+func (h *logHub) unsubscribe(sub *subscriber) {
+	h.mu.Lock()
+	delete(h.subs, sub)
+	h.mu.Unlock()
+	sub.close(false)
+}
@@ -0,0 +1,87 @@
+package logger
+
+import (
+	"net/url"
+	"sync"
+	"testing"
+)
+
+func TestHubReplay(t *testing.T) {
+	var h logHub
+	for i := 0; i < maxQueueSize+5; i++ {
+		h.publish(NewLog(LogTypeInfo, "info"))
+	}
+	h.publish(NewLog(LogTypeError, "error"))
+	sub := h.subscribe(logFilter{level: LevelDebug})
+	defer h.unsubscribe(sub)
+	if n := len(sub.queue); n != maxQueueSize {
+		t.Fatalf("replayed %d logs, want %d", n, maxQueueSize)
+	}
+	errSub := h.subscribe(logFilter{level: LevelError})
+	defer h.unsubscribe(errSub)
+	if n := len(errSub.queue); n != 1 {
+		t.Fatalf("replayed %d error logs, want 1", n)
+	}
+}
+
+func TestParseLogFilter(t *testing.T) {
+	query, _ := url.ParseQuery("level=warn&field.plugin=echo")
+	filter, err := parseLogFilter(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lg := NewLog(LogTypeWarn, "warn")
+	lg.Fields = Fields{"plugin": "echo"}
+	if !filter.match(lg) {
+		t.Error("warn log with the field should match")
+	}
+	if filter.match(NewLog(LogTypeInfo, "info")) {
+		t.Error("info log should not match level=warn")
+	}
+	lg = NewLog(LogTypeError, "error")
+	lg.Fields = Fields{"plugin": "other"}
+	if filter.match(lg) {
+		t.Error("log with another field value should not match")
+	}
+	if _, err := parseLogFilter(url.Values{"level": {"verbose"}}); err == nil {
+		t.Error("unknown level should be rejected")
+	}
+}
+
+func TestHubEvict(t *testing.T) {
+	var h logHub
+	sub := h.subscribe(logFilter{level: LevelDebug})
+	for i := 0; i <= subscriberQueueSize; i++ {
+		h.publish(NewLog(LogTypeInfo, "info"))
+	}
+	<-sub.done
+	if !sub.evicted {
+		t.Fatal("slow subscriber should be evicted")
+	}
+	if len(h.subs) != 0 {
+		t.Fatal("evicted subscriber should be removed")
+	}
+}
+
+// 连接断开取消订阅和因为太慢被断开同时发生，使用 -race 运行
+func TestHubUnsubscribeRace(t *testing.T) {
+	for i := 0; i < 50; i++ {
+		var h logHub
+		sub := h.subscribe(logFilter{level: LevelDebug})
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j <= subscriberQueueSize; j++ {
+				h.publish(NewLog(LogTypeInfo, "info"))
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			h.unsubscribe(sub)
+		}()
+		<-sub.done
+		_ = sub.evicted
+		wg.Wait()
+	}
+}
@@ -5,12 +5,11 @@ import (
 	"os"
 	"path"
 	"regexp"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
-
-	"github.com/gorilla/websocket"
 )
 
 // Logger 应用使用的 logger 实例
@@ -25,17 +24,72 @@ const LogTypeError = 1
 // LogTypeSuccess 成功类型
 const LogTypeSuccess = 2
 
-// maxQueueSize 队列最大大小
+// LogTypeDebug 调试类型
+const LogTypeDebug = 3
+
+// LogTypeWarn 警告类型
+const LogTypeWarn = 4
+
+// 日志级别，低于最小级别的日志不会记录
+// 成功和信息同为 LevelInfo
+const (
+	LevelDebug = iota - 1
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// 日志文件的格式
+const (
+	// FormatText logrus 的文本格式
+	FormatText = "text"
+	// FormatJSON 每行一个json
+	FormatJSON = "json"
+)
+
+// maxQueueSize 保留的最近日志的数量
 // == 用户首次通过websocket链接能看到的最大的日志数量
 const maxQueueSize = 10
 
-var logTypeStr = []string{"info", "error", "success"}
+var logTypeStr = []string{"info", "error", "success", "debug", "warn"}
+
+// levelOf 日志类型对应的级别
+func levelOf(ltype int) int {
+	switch ltype {
+	case LogTypeDebug:
+		return LevelDebug
+	case LogTypeWarn:
+		return LevelWarn
+	case LogTypeError:
+		return LevelError
+	}
+	return LevelInfo
+}
+
+// ParseLevel 解析日志级别 debug、info、warn 或者 error，为空时是 info
+func ParseLevel(name string) (int, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return LevelDebug, nil
+	case "", "info", "success":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return LevelInfo, fmt.Errorf("logger: unknown level %s", name)
+}
+
+// Fields 结构化日志的键值
+type Fields map[string]interface{}
 
 // Log log消息格式(json)
 type Log struct {
-	Time int64  `json:"time"`
-	Type int    `json:"type"`
-	Text string `json:"text"`
+	Time   int64  `json:"time"`
+	Type   int    `json:"type"`
+	Text   string `json:"text"`
+	Fields Fields `json:"fields,omitempty"`
 }
 
 // NewLog 创建一个新的Log实例
@@ -50,68 +104,126 @@ func NewLog(ltype int, text string) *Log {
 
 // LogInterface 基础的logger接口
 type LogInterface interface {
+	Debug(string)
+	Debugf(string, ...interface{})
 	Success(string)
 	Successf(string, ...interface{})
 	Info(string)
 	Infof(string, ...interface{})
+	Warn(string)
+	Warnf(string, ...interface{})
 	Error(a interface{})
 	Errorf(string, ...interface{})
+	// WithField 返回带上键值的logger，键值会写入日志文件
+	WithField(key string, value interface{}) LogInterface
+	// WithFields 返回带上多个键值的logger
+	WithFields(fields Fields) LogInterface
 }
 
+// loggerWithField 带键值的logger
+// field 不为空时日志文本以 "field: " 开头，网页上只显示文本
 type loggerWithField struct {
 	field   string
+	fields  Fields
 	service *loggerService
-	LogInterface
+}
+
+func (logger *loggerWithField) add(ltype int, text string) {
+	if logger.field != "" {
+		text = fmt.Sprintf("%s: %s", logger.field, text)
+	}
+	lg := NewLog(ltype, text)
+	lg.Fields = logger.fields
+	logger.service.Add(lg)
+}
+
+// Debug 调试log
+func (logger *loggerWithField) Debug(text string) {
+	logger.add(LogTypeDebug, text)
+}
+
+// Debugf 格式化调试log
+func (logger *loggerWithField) Debugf(format string, args ...interface{}) {
+	logger.add(LogTypeDebug, fmt.Sprintf(format, args...))
 }
 
 // Success 成功log
 func (logger *loggerWithField) Success(text string) {
-	logger.service.Successf("%s: %s", logger.field, text)
+	logger.add(LogTypeSuccess, text)
 }
 
 // Success 格式化成功log
 func (logger *loggerWithField) Successf(format string, args ...interface{}) {
-	logger.service.Successf("%s: %s", logger.field, fmt.Sprintf(format, args...))
+	logger.add(LogTypeSuccess, fmt.Sprintf(format, args...))
 }
 
 // Info 信息log
 func (logger *loggerWithField) Info(text string) {
-	logger.service.Infof("%s: %s", logger.field, text)
+	logger.add(LogTypeInfo, text)
 }
 
 // Infof 格式化信息log
 func (logger *loggerWithField) Infof(format string, args ...interface{}) {
-	logger.service.Infof("%s: %s", logger.field, fmt.Sprintf(format, args...))
+	logger.add(LogTypeInfo, fmt.Sprintf(format, args...))
+}
+
+// Warn 警告log
+func (logger *loggerWithField) Warn(text string) {
+	logger.add(LogTypeWarn, text)
+}
+
+// Warnf 格式化警告log
+func (logger *loggerWithField) Warnf(format string, args ...interface{}) {
+	logger.add(LogTypeWarn, fmt.Sprintf(format, args...))
 }
 
 // Error 错误log
 func (logger *loggerWithField) Error(a interface{}) {
 	switch a.(type) {
 	case error:
-		logger.service.Errorf("%s: %v", logger.field, a.(error))
+		logger.add(LogTypeError, a.(error).Error())
 	case string:
-		logger.service.Errorf("%s: %s", logger.field, a.(string))
+		logger.add(LogTypeError, a.(string))
 	}
 }
 
 // Errorf 格式化错误log
 func (logger *loggerWithField) Errorf(format string, args ...interface{}) {
-	logger.service.Errorf("%s: %s", logger.field, fmt.Sprintf(format, args...))
+	logger.add(LogTypeError, fmt.Sprintf(format, args...))
+}
+
+// WithField 返回带上键值的logger
+func (logger *loggerWithField) WithField(key string, value interface{}) LogInterface {
+	return logger.WithFields(Fields{key: value})
+}
+
+// WithFields 返回带上多个键值的logger
+func (logger *loggerWithField) WithFields(fields Fields) LogInterface {
+	merged := make(Fields, len(logger.fields)+len(fields))
+	for k, v := range logger.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &loggerWithField{field: logger.field, fields: merged, service: logger.service}
 }
 
 type loggerService struct {
-	conns    map[*websocket.Conn]bool
 	success  int
 	fails    int
 	logsPath string
-	logChan  chan *Log
-	logLT    string
-	fpSI     *os.File
-	fpE      *os.File
+	level    int
+	format   string
+	mu       sync.Mutex
+	hub      logHub
+	rotate   RotateConfig
+	fileSI   *logFile
+	fileE    *logFile
+	cleanMu  sync.Mutex
 	logS     *logrus.Entry
 	logI     *logrus.Entry
 	logE     *logrus.Entry
-	wscLock  sync.Mutex
 	LogInterface
 }
 
@@ -127,6 +239,48 @@ func (logger *loggerService) SetLogsPath(p string) {
 	logger.logsPath = p
 }
 
+// SetLevel 设置最小的日志级别 debug、info、warn 或者 error，默认为 info
+func (logger *loggerService) SetLevel(name string) error {
+	level, err := ParseLevel(name)
+	if err != nil {
+		return err
+	}
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	logger.level = level
+	if level <= LevelDebug {
+		Logger.Logger.SetLevel(logrus.DebugLevel)
+	} else {
+		Logger.Logger.SetLevel(logrus.InfoLevel)
+	}
+	return nil
+}
+
+// Level 最小的日志级别
+func (logger *loggerService) Level() int {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	return logger.level
+}
+
+// SetFormat 设置日志文件的格式 text 或者 json，需要在 Initialize 之前调用
+func (logger *loggerService) SetFormat(format string) error {
+	switch format {
+	case "":
+		format = FormatText
+	case FormatText, FormatJSON:
+	default:
+		return fmt.Errorf("logger: unknown format %s", format)
+	}
+	logger.format = format
+	return nil
+}
+
+// SetRotate 设置日志文件的切分和保留，需要在 Initialize 之前调用
+func (logger *loggerService) SetRotate(cfg RotateConfig) {
+	logger.rotate = cfg
+}
+
 // LogsPath 获取logs文件的绝对路径
 func (logger *loggerService) LogsPath() string {
 	pwd, _ := os.Getwd()
@@ -145,89 +299,96 @@ func (logger *loggerService) LogFile(scope string) string {
 
 // Success 获取成功计数
 func (logger *loggerService) SuccessCnt() int {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
 	return logger.success
 }
 
 // Success 获取失败计数
 func (logger *loggerService) FailCnt() int {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
 	return logger.fails
 }
 
-func (logger *loggerService) sLogFiles() {
-	var err error
-	var newfp *os.File
-	var oldfp *os.File
-	logfileN := logger.LogFile("")
-	if logfileN != logger.logLT {
-		logger.logLT = logfileN
-
-		oldfp = logger.fpSI
-		newfp, err = os.OpenFile(logfileN, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
-		if err != nil {
-			Logger.Fatalln(err)
-		}
-		if oldfp != nil {
-			err = oldfp.Close()
-			if err != nil {
-				Logger.Fatalln(err)
-			}
-		}
-		logger.logS.Logger.SetOutput(newfp)
-		logger.logI.Logger.SetOutput(newfp)
-		logger.fpSI = newfp
-
-		oldfp = logger.fpE
-		newfp, err = os.OpenFile(logger.LogFile("error"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
-		if err != nil {
-			Logger.Fatalln(err)
-		}
-		if oldfp != nil {
-			err = oldfp.Close()
-			if err != nil {
-				Logger.Fatalln(err)
-			}
-		}
-		logger.logE.Logger.SetOutput(newfp)
-		logger.fpE = newfp
-	}
-}
+// crlfReplacer 把换行转义成可见的 \r \n
+var crlfReplacer = strings.NewReplacer("\r", "\\r", "\n", "\\n")
 
 func escapeCRLF(s string) string {
-	cr, _ := regexp.Compile(`\r`)
-	lf, _ := regexp.Compile(`\n`)
-	s = cr.ReplaceAllString(s, "\\r")
-	s = lf.ReplaceAllString(s, "\\n")
-	return s
+	return crlfReplacer.Replace(s)
 }
 
+// hostPattern 匹配 ipv4 地址和可选的端口
+var hostPattern = regexp.MustCompile(`(\d+)\.\d+\.\d+\.(\d+)(?::(\d+))?`)
+
+// escapeHost 隐藏 ip 中间的两段，只有原来带端口时才保留端口
 func escapeHost(s string) string {
-	host, _ := regexp.Compile(`(\d+)\.\d+\.\d+\.(\d+)(?:\:(\d+))?`)
-	s = host.ReplaceAllString(s, "$1.*.*.$2:$3")
-	return s
+	return hostPattern.ReplaceAllStringFunc(s, func(host string) string {
+		m := hostPattern.FindStringSubmatch(host)
+		escaped := m[1] + ".*.*." + m[2]
+		if m[3] != "" {
+			escaped += ":" + m[3]
+		}
+		return escaped
+	})
 }
 
-// Add 往队列里加入一个新的log
+// reservedFields 日志文件中晴乃自己使用的键
+// 同名的键值加上 "fields." 前缀，避免覆盖
+var reservedFields = map[string]bool{"type": true, "name": true}
+
+// escapeFields 隐藏键值中的ip，并给和保留的键同名的键加上前缀
+func escapeFields(fields Fields) Fields {
+	if len(fields) == 0 {
+		return nil
+	}
+	escaped := make(Fields, len(fields))
+	for k, v := range fields {
+		if str, ok := v.(string); ok {
+			v = escapeHost(str)
+		} else if err, ok := v.(error); ok {
+			// error 在 json 中会变成 {}
+			v = escapeHost(err.Error())
+		}
+		if reservedFields[k] {
+			k = "fields." + k
+		}
+		escaped[k] = v
+	}
+	return escaped
+}
+
+// Add 往队列里加入一个新的log，低于最小级别的log会被忽略
 func (logger *loggerService) Add(lg *Log) {
-	logger.sLogFiles()
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	if levelOf(lg.Type) < logger.level {
+		return
+	}
 	lg.Text = escapeHost(lg.Text)
+	lg.Fields = escapeFields(lg.Fields)
 	logMsg := escapeCRLF(lg.Text)
+	fields := logrus.Fields(lg.Fields)
 	switch lg.Type {
 	case LogTypeSuccess:
 		logger.success++
-		Logger.WithField("type", "success").Println(logMsg)
-		logger.logS.Println(lg.Text)
+		Logger.WithField("type", "success").WithFields(fields).Println(logMsg)
+		logger.logS.WithFields(fields).Println(lg.Text)
 	case LogTypeError:
 		logger.fails++
-		Logger.WithField("type", "error").Errorln(logMsg)
-		logger.logE.Println(lg.Text)
+		Logger.WithField("type", "error").WithFields(fields).Errorln(logMsg)
+		logger.logE.WithFields(fields).Errorln(lg.Text)
+	case LogTypeDebug:
+		Logger.WithField("type", "debug").WithFields(fields).Debugln(logMsg)
+		logger.logI.WithField("type", "debug").WithFields(fields).Debugln(lg.Text)
+	case LogTypeWarn:
+		Logger.WithField("type", "warn").WithFields(fields).Warnln(logMsg)
+		logger.logI.WithField("type", "warn").WithFields(fields).Warnln(lg.Text)
 	default:
-		Logger.WithField("type", "info").Println(logMsg)
-		logger.logI.Println(lg.Text)
-	}
-	logger.logChan <- lg
-	if len(logger.logChan) >= maxQueueSize {
-		<-logger.logChan
+		Logger.WithField("type", "info").WithFields(fields).Println(logMsg)
+		logger.logI.WithFields(fields).Println(lg.Text)
 	}
+	logger.hub.publish(lg)
 }
 
 // AddLog 往队列里加入一个新的log
@@ -235,9 +396,29 @@ func (logger *loggerService) AddLog(ltype int, text string) {
 	logger.Add(NewLog(ltype, text))
 }
 
-// Field 设置logger的域
+// Field 设置logger的域，日志文本以 "域: " 开头，域同时保存在键值 field 中
 func (logger *loggerService) Field(name string) LogInterface {
-	return &loggerWithField{field: name, service: logger}
+	return &loggerWithField{field: name, fields: Fields{"field": name}, service: logger}
+}
+
+// WithField 返回带上键值的logger
+func (logger *loggerService) WithField(key string, value interface{}) LogInterface {
+	return logger.WithFields(Fields{key: value})
+}
+
+// WithFields 返回带上多个键值的logger
+func (logger *loggerService) WithFields(fields Fields) LogInterface {
+	return (&loggerWithField{service: logger}).WithFields(fields)
+}
+
+// Debug 调试log
+func (logger *loggerService) Debug(text string) {
+	logger.AddLog(LogTypeDebug, text)
+}
+
+// Debugf 格式化调试log
+func (logger *loggerService) Debugf(format string, args ...interface{}) {
+	logger.AddLog(LogTypeDebug, fmt.Sprintf(format, args...))
 }
 
 // Success 成功log
@@ -260,6 +441,16 @@ func (logger *loggerService) Infof(format string, args ...interface{}) {
 	logger.AddLog(LogTypeInfo, fmt.Sprintf(format, args...))
 }
 
+// Warn 警告log
+func (logger *loggerService) Warn(text string) {
+	logger.AddLog(LogTypeWarn, text)
+}
+
+// Warnf 格式化警告log
+func (logger *loggerService) Warnf(format string, args ...interface{}) {
+	logger.AddLog(LogTypeWarn, fmt.Sprintf(format, args...))
+}
+
 // Error 错误log
 func (logger *loggerService) Error(a interface{}) {
 	switch a.(type) {
@@ -275,42 +466,6 @@ func (logger *loggerService) Errorf(format string, args ...interface{}) {
 	logger.AddLog(LogTypeError, fmt.Sprintf(format, args...))
 }
 
-func (logger *loggerService) setConn(conn *websocket.Conn, state bool) {
-	logger.wscLock.Lock()
-	defer logger.wscLock.Unlock()
-	logger.conns[conn] = state
-}
-
-func (logger *loggerService) delConn(conn *websocket.Conn) {
-	logger.wscLock.Lock()
-	defer logger.wscLock.Unlock()
-	delete(logger.conns, conn)
-}
-
-func setupPong(conn *websocket.Conn, quit chan int) {
-	pongTicker := time.NewTicker(pongWaitTime)
-	pongMsg := []byte("")
-	go func() {
-		defer pongTicker.Stop()
-		defer conn.Close()
-		defer Service.delConn(conn)
-		for {
-			if Service.conns[conn] != true {
-				close(quit)
-			}
-			select {
-			case <-quit:
-				return
-			case <-pongTicker.C:
-				conn.SetWriteDeadline(time.Now().Add(pongWaitTime))
-				if err := conn.WriteMessage(websocket.PongMessage, pongMsg); err != nil {
-					close(quit)
-				}
-			}
-		}
-	}()
-}
-
 // Initialize 初始化logger服务
 func (logger *loggerService) Initialize() {
 	// 建立日志目录
@@ -331,10 +486,6 @@ func (logger *loggerService) Initialize() {
 			Logger.Println("logsPath created successfully.")
 		}
 	}
-	// 创建连接池
-	logger.conns = make(map[*websocket.Conn]bool)
-	// 创建log管道
-	logger.logChan = make(chan *Log, maxQueueSize)
 	// 创建 logrus success 实例
 	logger.logS = logrus.New().WithFields(logrus.Fields{
 		"name": "haruno",
@@ -350,8 +501,20 @@ func (logger *loggerService) Initialize() {
 		"name": "haruno",
 		"type": "error",
 	})
-	logger.logS.Logger.SetFormatter(&logrus.TextFormatter{})
-	logger.logI.Logger.SetFormatter(&logrus.TextFormatter{})
-	logger.logE.Logger.SetFormatter(&logrus.TextFormatter{})
-	logger.sLogFiles()
+	var formatter logrus.Formatter = &logrus.TextFormatter{}
+	if logger.format == FormatJSON {
+		formatter = &logrus.JSONFormatter{}
+	}
+	for _, entry := range []*logrus.Entry{logger.logS, logger.logI, logger.logE} {
+		entry.Logger.SetFormatter(formatter)
+		// 级别在 Add 中过滤
+		entry.Logger.SetLevel(logrus.DebugLevel)
+	}
+	logger.fileSI = &logFile{service: logger}
+	logger.fileE = &logFile{service: logger, scope: "error"}
+	logger.logS.Logger.SetOutput(logger.fileSI)
+	logger.logI.Logger.SetOutput(logger.fileSI)
+	logger.logE.Logger.SetOutput(logger.fileE)
+	// 清理之前运行留下的日志
+	logger.archive("")
 }
@@ -0,0 +1,91 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+// newTestService 日志写入 out 的 loggerService
+func newTestService(out *bytes.Buffer) *loggerService {
+	newEntry := func(ltype string) *logrus.Entry {
+		l := logrus.New()
+		l.Out = out
+		l.Formatter = new(logrus.JSONFormatter)
+		return l.WithFields(logrus.Fields{"name": "haruno", "type": ltype})
+	}
+	Logger.Logger.Out = ioutil.Discard
+	return &loggerService{
+		logS: newEntry("success"),
+		logI: newEntry("info"),
+		logE: newEntry("error"),
+	}
+}
+
+// 带域的logger在文本前面加上域
+func TestFieldPrefix(t *testing.T) {
+	out := new(bytes.Buffer)
+	svc := newTestService(out)
+	sub := svc.hub.subscribe(logFilter{level: LevelDebug})
+	defer svc.hub.unsubscribe(sub)
+	svc.Field("echo@1.0.0").WithField("group", 1).Info("hello")
+	lg := <-sub.queue
+	if lg.Text != "echo@1.0.0: hello" {
+		t.Errorf("text = %q, want the field prefix", lg.Text)
+	}
+	if lg.Fields["field"] != "echo@1.0.0" || lg.Fields["group"] != 1 {
+		t.Errorf("fields = %v", lg.Fields)
+	}
+	svc.WithField("group", 1).Info("hello")
+	if lg := <-sub.queue; lg.Text != "hello" {
+		t.Errorf("text = %q, want no prefix", lg.Text)
+	}
+}
+
+// 和保留的键同名的键值不会覆盖 type 和 name
+func TestReservedFields(t *testing.T) {
+	out := new(bytes.Buffer)
+	svc := newTestService(out)
+	svc.WithFields(Fields{"type": "user", "name": "alice", "host": "10.1.2.3"}).Warn("warn")
+	entry := make(map[string]interface{})
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatalf("invalid json %q: %v", out.String(), err)
+	}
+	want := map[string]interface{}{
+		"type":        "warn",
+		"name":        "haruno",
+		"fields.type": "user",
+		"fields.name": "alice",
+		"host":        "10.*.*.3",
+	}
+	for k, v := range want {
+		if entry[k] != v {
+			t.Errorf("%s = %v, want %v", k, entry[k], v)
+		}
+	}
+}
+
+func TestEscapeHost(t *testing.T) {
+	cases := []struct {
+		in, want string
+	}{
+		{"10.1.2.3", "10.*.*.3"},
+		{"connect to 192.168.1.20:8080 failed", "connect to 192.*.*.20:8080 failed"},
+		{"ws://127.0.0.1:6700/event, 10.0.0.1", "ws://127.*.*.1:6700/event, 10.*.*.1"},
+		{"no address here", "no address here"},
+	}
+	for _, c := range cases {
+		if got := escapeHost(c.in); got != c.want {
+			t.Errorf("escapeHost(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestEscapeCRLF(t *testing.T) {
+	if got := escapeCRLF("a\r\nb\nc"); got != `a\r\nb\nc` {
+		t.Errorf("escapeCRLF() = %q", got)
+	}
+}
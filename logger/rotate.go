@@ -0,0 +1,353 @@
+package logger
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RotateConfig 日志文件的切分和保留配置
+type RotateConfig struct {
+	// MaxSize 单个日志文件的最大长度（MB），超过后切分成 日期.序号.log，为 0 时只按日期切分
+	MaxSize int64 `toml:"maxSize"`
+	// MaxAge 日志保留的天数，为 0 时不删除
+	MaxAge int `toml:"maxAge"`
+	// MaxTotalSize 日志目录的最大长度（MB），超过后从最旧的文件开始删除，为 0 时不限制
+	MaxTotalSize int64 `toml:"maxTotalSize"`
+	// Compress 使用 gzip 压缩切分出来的日志文件
+	Compress bool `toml:"compress"`
+}
+
+// logNamePattern 日志文件名：日期[-error][.序号].log[.gz]
+var logNamePattern = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2})(?:-(error))?(?:\.(\d+))?\.log(\.gz)?$`)
+
+// logName 解析后的日志文件名
+type logName struct {
+	name  string
+	date  string
+	scope string
+	// index 切分的序号，当天正在写入（或者最后写入）的文件为 0
+	index int
+	gzip  bool
+}
+
+func parseLogName(name string) (logName, bool) {
+	m := logNamePattern.FindStringSubmatch(name)
+	if m == nil {
+		return logName{}, false
+	}
+	index, _ := strconv.Atoi(m[3])
+	return logName{name: name, date: m[1], scope: m[2], index: index, gzip: m[4] != ""}, true
+}
+
+// logFileName 日志文件名
+func logFileName(date, scope string, index int) string {
+	name := date
+	if scope != "" {
+		name += "-" + scope
+	}
+	if index > 0 {
+		name += fmt.Sprintf(".%d", index)
+	}
+	return name + ".log"
+}
+
+// logParts 某一天日志的所有文件，按写入的顺序排列
+func logParts(dir, date, scope string) []logName {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	indexes := make(map[int]logName)
+	for _, info := range infos {
+		n, ok := parseLogName(info.Name())
+		if !ok || n.date != date || n.scope != scope {
+			continue
+		}
+		// 压缩过程中可能同时存在压缩前后的文件，压缩的文件已经完整
+		if prev, ok := indexes[n.index]; ok && prev.gzip {
+			continue
+		}
+		indexes[n.index] = n
+	}
+	parts := make([]logName, 0, len(indexes))
+	for _, n := range indexes {
+		parts = append(parts, n)
+	}
+	sort.SliceStable(parts, func(i, j int) bool {
+		a, b := parts[i].index, parts[j].index
+		// 序号为 0 的文件最后写入
+		if a == 0 || b == 0 {
+			return b == 0 && a != 0
+		}
+		return a < b
+	})
+	return parts
+}
+
+// logFile 按日期和大小切分的日志文件
+type logFile struct {
+	service *loggerService
+	scope   string
+	mu      sync.Mutex
+	fp      *os.File
+	date    string
+	size    int64
+}
+
+// Write 写入日志，日期改变或者超过最大长度时切分
+// 同一个文件会被多个 logrus 实例使用（成功和信息日志共用一个文件），它们的锁互不相关，所以自己加锁
+func (f *logFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.rotate(int64(len(p))); err != nil {
+		return 0, err
+	}
+	n, err := f.fp.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *logFile) rotate(next int64) error {
+	date := time.Now().Format(logDateFormat)
+	cfg := f.service.rotate
+	if f.fp != nil && date == f.date {
+		if cfg.MaxSize <= 0 || f.size == 0 || f.size+next <= cfg.MaxSize<<20 {
+			return nil
+		}
+		// 按大小切分，当前文件改名为下一个序号
+		f.fp.Close()
+		f.fp = nil
+		dir := f.service.LogsPath()
+		index := 1
+		for _, part := range logParts(dir, f.date, f.scope) {
+			if part.index >= index {
+				index = part.index + 1
+			}
+		}
+		rotated := path.Join(dir, logFileName(f.date, f.scope, index))
+		if err := os.Rename(path.Join(dir, logFileName(f.date, f.scope, 0)), rotated); err != nil {
+			return err
+		}
+		f.service.archive(rotated)
+	} else if f.fp != nil {
+		// 按日期切分
+		f.fp.Close()
+		f.fp = nil
+		f.service.archive(path.Join(f.service.LogsPath(), logFileName(f.date, f.scope, 0)))
+	}
+	fp, err := os.OpenFile(f.service.LogFile(f.scope), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := fp.Stat()
+	if err != nil {
+		fp.Close()
+		return err
+	}
+	f.fp = fp
+	f.date = date
+	f.size = info.Size()
+	return nil
+}
+
+// current 正在写入的文件名，没有打开文件时为空
+func (f *logFile) current() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fp == nil {
+		return ""
+	}
+	return logFileName(f.date, f.scope, 0)
+}
+
+// Close 关闭文件
+func (f *logFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fp == nil {
+		return nil
+	}
+	err := f.fp.Close()
+	f.fp = nil
+	return err
+}
+
+// archive 在后台压缩切分出来的文件并清理过期的日志
+func (logger *loggerService) archive(file string) {
+	go func() {
+		logger.cleanMu.Lock()
+		defer logger.cleanMu.Unlock()
+		if logger.rotate.Compress && file != "" {
+			if err := compressFile(file); err != nil {
+				Logger.Errorln("compress log file error:", err)
+			}
+		}
+		logger.cleanup()
+	}()
+}
+
+// compressFile 压缩文件为 .gz 并删除原文件
+func compressFile(file string) error {
+	src, err := os.Open(file)
+	if os.IsNotExist(err) {
+		// 已经被压缩过
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmp := file + ".gz.tmp"
+	dst, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	if err == nil {
+		err = zw.Close()
+	}
+	if e := dst.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp, file+".gz")
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	src.Close()
+	return os.Remove(file)
+}
+
+// cleanup 删除超过保留天数的日志，总长度超过限制时从最旧的文件开始删除
+// 压缩之前没有压缩的历史文件（例如上次运行留下的）
+func (logger *loggerService) cleanup() {
+	cfg := logger.rotate
+	dir := logger.LogsPath()
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	today := time.Now().Format(logDateFormat)
+	// 刚过零点时还没有切分的前一天的文件仍然在写入
+	writing := make(map[string]bool)
+	for _, f := range []*logFile{logger.fileSI, logger.fileE} {
+		if f != nil {
+			writing[f.current()] = true
+		}
+	}
+	type entry struct {
+		logName
+		info os.FileInfo
+	}
+	entries := make([]entry, 0, len(infos))
+	var total int64
+	for _, info := range infos {
+		n, ok := parseLogName(info.Name())
+		if !ok {
+			continue
+		}
+		total += info.Size()
+		// 正在写入的文件
+		if (n.date == today && n.index == 0) || writing[n.name] {
+			continue
+		}
+		if cfg.Compress && !n.gzip {
+			file := path.Join(dir, n.name)
+			if err := compressFile(file); err != nil {
+				Logger.Errorln("compress log file error:", err)
+			} else if zipped, err := os.Stat(file + ".gz"); err == nil {
+				total += zipped.Size() - info.Size()
+				info = zipped
+				n.name += ".gz"
+				n.gzip = true
+			}
+		}
+		entries = append(entries, entry{n, info})
+	}
+	// 日期相同时先写入的文件更旧
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].date != entries[j].date {
+			return entries[i].date < entries[j].date
+		}
+		return entries[i].info.ModTime().Before(entries[j].info.ModTime())
+	})
+	deadline := ""
+	if cfg.MaxAge > 0 {
+		deadline = time.Now().AddDate(0, 0, -cfg.MaxAge).Format(logDateFormat)
+	}
+	for _, e := range entries {
+		expired := deadline != "" && e.date < deadline
+		oversize := cfg.MaxTotalSize > 0 && total > cfg.MaxTotalSize<<20
+		if !expired && !oversize {
+			continue
+		}
+		if err := os.Remove(path.Join(dir, e.name)); err != nil {
+			Logger.Errorln("remove log file error:", err)
+			continue
+		}
+		total -= e.info.Size()
+	}
+}
+
+// openLogParts 按顺序读取某一天的日志，压缩的文件会被解压
+// 返回的 size 为原始文件的总长度，存在压缩文件时为 -1
+func openLogParts(dir, date, scope string) (io.ReadCloser, int64, error) {
+	parts := logParts(dir, date, scope)
+	if len(parts) == 0 {
+		return nil, 0, os.ErrNotExist
+	}
+	readers := make([]io.Reader, 0, len(parts))
+	closers := make(multiCloser, 0, len(parts)*2)
+	var size int64
+	for _, part := range parts {
+		fp, err := os.Open(path.Join(dir, part.name))
+		if err != nil {
+			closers.Close()
+			return nil, 0, err
+		}
+		closers = append(closers, fp)
+		if !part.gzip {
+			if info, err := fp.Stat(); err == nil && size >= 0 {
+				size += info.Size()
+			}
+			readers = append(readers, fp)
+			continue
+		}
+		size = -1
+		zr, err := gzip.NewReader(fp)
+		if err != nil {
+			closers.Close()
+			return nil, 0, err
+		}
+		closers = append(closers, zr)
+		readers = append(readers, zr)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(readers...), closers}, size, nil
+}
+
+type multiCloser []io.Closer
+
+func (c multiCloser) Close() error {
+	var err error
+	for _, closer := range c {
+		if e := closer.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
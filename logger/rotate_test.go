@@ -0,0 +1,90 @@
+package logger
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestParseLogName(t *testing.T) {
+	cases := []struct {
+		name string
+		want logName
+		ok   bool
+	}{
+		{"2020-01-02.log", logName{date: "2020-01-02"}, true},
+		{"2020-01-02-error.3.log.gz", logName{date: "2020-01-02", scope: "error", index: 3, gzip: true}, true},
+		{"2020-01-02.12.log", logName{date: "2020-01-02", index: 12}, true},
+		{"2020-01-02.log.gz.tmp", logName{}, false},
+		{"haruno.log", logName{}, false},
+	}
+	for _, c := range cases {
+		got, ok := parseLogName(c.name)
+		if ok != c.ok {
+			t.Errorf("parseLogName(%q) ok = %v, want %v", c.name, ok, c.ok)
+			continue
+		}
+		if ok {
+			c.want.name = c.name
+		}
+		if got != c.want {
+			t.Errorf("parseLogName(%q) = %+v, want %+v", c.name, got, c.want)
+		}
+	}
+}
+
+func touch(t *testing.T, dir string, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		if err := ioutil.WriteFile(path.Join(dir, name), []byte(name+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// 切分出来的文件按序号排列，序号为 0 的文件在最后，压缩完成的文件优先
+func TestLogPartsOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logs-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	touch(t, dir,
+		"2020-01-02.log", "2020-01-02.10.log", "2020-01-02.2.log",
+		"2020-01-02.1.log", "2020-01-02.1.log.gz",
+		"2020-01-02-error.log", "2020-01-03.1.log")
+	var names []string
+	for _, part := range logParts(dir, "2020-01-02", "") {
+		names = append(names, part.name)
+	}
+	want := []string{"2020-01-02.1.log.gz", "2020-01-02.2.log", "2020-01-02.10.log", "2020-01-02.log"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("logParts = %v, want %v", names, want)
+	}
+}
+
+// 清理时不压缩还在写入的前一天的文件
+func TestCleanupSkipsOpenFile(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	svc := &loggerService{logsPath: dir, rotate: RotateConfig{Compress: true}}
+	touch(t, dir, "2020-01-02.log", "2020-01-02-error.log")
+	fp, err := os.OpenFile(path.Join(dir, "2020-01-02-error.log"), os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc.fileE = &logFile{service: svc, scope: "error", fp: fp, date: "2020-01-02"}
+	defer svc.fileE.Close()
+	svc.cleanup()
+	if _, err := os.Stat(path.Join(dir, "2020-01-02-error.log")); err != nil {
+		t.Errorf("open file should be kept: %v", err)
+	}
+	if _, err := os.Stat(path.Join(dir, "2020-01-02.log.gz")); err != nil {
+		t.Errorf("closed file should be compressed: %v", err)
+	}
+}
@@ -0,0 +1,420 @@
+package logger
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 查询的限制
+const (
+	defaultSearchLimit = 100
+	maxSearchLimit     = 1000
+	maxSearchDays      = 31
+	// maxLogLineSize 单行日志的最大长度
+	maxLogLineSize = 1 << 20
+)
+
+// Record 查询到的一条日志
+type Record struct {
+	Time time.Time `json:"time"`
+	// Level 日志的类型 debug、info、success、warn 或者 error
+	Level  string `json:"level"`
+	Text   string `json:"text"`
+	Fields Fields `json:"fields,omitempty"`
+	// raw 日志文件中的原文
+	raw string
+}
+
+// recordKeys 日志文件中不属于键值的字段
+var recordKeys = map[string]bool{"time": true, "level": true, "msg": true, "name": true, "type": true}
+
+// parseRecord 解析一行文本或者json格式的日志
+func parseRecord(line string) (*Record, bool) {
+	var kv map[string]interface{}
+	if strings.HasPrefix(line, "{") {
+		if err := json.Unmarshal([]byte(line), &kv); err != nil {
+			return nil, false
+		}
+	} else {
+		var ok bool
+		if kv, ok = parseTextLine(line); !ok {
+			return nil, false
+		}
+	}
+	rec := &Record{raw: line}
+	rec.Text, _ = kv["msg"].(string)
+	rec.Level, _ = kv["type"].(string)
+	if rec.Level == "" {
+		// 没有类型时使用 logrus 的级别
+		rec.Level, _ = kv["level"].(string)
+		if rec.Level == "warning" {
+			rec.Level = "warn"
+		}
+	}
+	if str, ok := kv["time"].(string); ok {
+		rec.Time, _ = time.Parse(time.RFC3339, str)
+	}
+	for k, v := range kv {
+		if recordKeys[k] {
+			continue
+		}
+		if rec.Fields == nil {
+			rec.Fields = make(Fields)
+		}
+		rec.Fields[k] = v
+	}
+	return rec, true
+}
+
+// parseTextLine 解析 logrus 文本格式的 key=value
+func parseTextLine(line string) (map[string]interface{}, bool) {
+	kv := make(map[string]interface{})
+	for i := 0; i < len(line); {
+		if line[i] == ' ' {
+			i++
+			continue
+		}
+		eq := strings.IndexByte(line[i:], '=')
+		if eq <= 0 {
+			return nil, false
+		}
+		key := line[i : i+eq]
+		i += eq + 1
+		if i < len(line) && line[i] == '"' {
+			j := i + 1
+			for j < len(line) && line[j] != '"' {
+				if line[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(line) {
+				return nil, false
+			}
+			val, err := strconv.Unquote(line[i : j+1])
+			if err != nil {
+				return nil, false
+			}
+			kv[key] = val
+			i = j + 1
+			continue
+		}
+		end := strings.IndexByte(line[i:], ' ')
+		if end < 0 {
+			end = len(line) - i
+		}
+		kv[key] = line[i : i+end]
+		i += end
+	}
+	return kv, true
+}
+
+// logQuery 日志的过滤条件
+type logQuery struct {
+	level   int
+	fields  map[string]string
+	keyword string
+	pattern *regexp.Regexp
+}
+
+func (q *logQuery) match(rec *Record) bool {
+	if level, err := ParseLevel(rec.Level); err == nil && level < q.level {
+		return false
+	}
+	for k, v := range q.fields {
+		val, ok := rec.Fields[k]
+		if !ok || fmt.Sprint(val) != v {
+			return false
+		}
+	}
+	if q.keyword != "" && !strings.Contains(strings.ToLower(rec.Text), q.keyword) {
+		found := false
+		for _, v := range rec.Fields {
+			if strings.Contains(strings.ToLower(fmt.Sprint(v)), q.keyword) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if q.pattern != nil && !q.pattern.MatchString(rec.Text) {
+		return false
+	}
+	return true
+}
+
+// logCursor 分页的位置：日期和每个文件已经读取的行数
+type logCursor struct {
+	date  string
+	lines [2]int
+}
+
+func (c logCursor) String() string {
+	raw := fmt.Sprintf("%s|%d|%d", c.date, c.lines[0], c.lines[1])
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func parseCursor(s string) (logCursor, error) {
+	var c logCursor
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, err
+	}
+	parts := strings.Split(string(raw), "|")
+	if len(parts) != 3 {
+		return c, fmt.Errorf("invalid cursor")
+	}
+	if _, err := time.Parse(logDateFormat, parts[0]); err != nil {
+		return c, err
+	}
+	c.date = parts[0]
+	for i := range c.lines {
+		if c.lines[i], err = strconv.Atoi(parts[i+1]); err != nil || c.lines[i] < 0 {
+			return c, fmt.Errorf("invalid cursor")
+		}
+	}
+	return c, nil
+}
+
+// recordStream 按行读取某一天的日志
+type recordStream struct {
+	rc      io.ReadCloser
+	scanner *bufio.Scanner
+	lines   int
+	next    *Record
+	// nextLines 读取 next 之后的行数
+	nextLines int
+}
+
+func openRecordStream(dir, date, scope string, skip int) (*recordStream, error) {
+	rc, _, err := openLogParts(dir, date, scope)
+	if os.IsNotExist(err) {
+		return &recordStream{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	s := &recordStream{rc: rc, scanner: bufio.NewScanner(rc)}
+	s.scanner.Buffer(make([]byte, 64*1024), maxLogLineSize)
+	for s.lines < skip && s.scanner.Scan() {
+		s.lines++
+	}
+	s.advance()
+	return s, nil
+}
+
+// advance 读取下一条可以解析的日志
+func (s *recordStream) advance() {
+	s.next = nil
+	if s.scanner == nil {
+		return
+	}
+	s.nextLines = s.lines
+	for s.scanner.Scan() {
+		s.nextLines++
+		if rec, ok := parseRecord(s.scanner.Text()); ok {
+			s.next = rec
+			return
+		}
+	}
+}
+
+func (s *recordStream) Close() {
+	if s.rc != nil {
+		s.rc.Close()
+	}
+}
+
+// searchDays 按时间顺序查询每一天的日志，visit 返回 false 时停止
+// 普通日志和错误日志在不同的文件中，按时间合并
+func searchDays(dir string, from, to time.Time, cursor logCursor, scopes []string, visit func(*Record, logCursor) bool) error {
+	for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+		date := day.Format(logDateFormat)
+		if cursor.date != "" && date < cursor.date {
+			continue
+		}
+		skip := [2]int{}
+		if date == cursor.date {
+			skip = cursor.lines
+		}
+		streams := make([]*recordStream, len(scopes))
+		for i, scope := range scopes {
+			s, err := openRecordStream(dir, date, scope, skip[i])
+			if err != nil {
+				for _, opened := range streams[:i] {
+					opened.Close()
+				}
+				return err
+			}
+			streams[i] = s
+		}
+		stop := false
+		for !stop {
+			pick := -1
+			for i, s := range streams {
+				if s.next != nil && (pick < 0 || s.next.Time.Before(streams[pick].next.Time)) {
+					pick = i
+				}
+			}
+			if pick < 0 {
+				break
+			}
+			rec := streams[pick].next
+			streams[pick].lines = streams[pick].nextLines
+			streams[pick].advance()
+			pos := logCursor{date: date}
+			for i, s := range streams {
+				pos.lines[i] = s.lines
+			}
+			stop = !visit(rec, pos)
+		}
+		for _, s := range streams {
+			s.Close()
+		}
+		if stop {
+			return nil
+		}
+	}
+	return nil
+}
+
+// searchResult 查询的结果
+type searchResult struct {
+	Records []*Record `json:"records"`
+	// Next 下一页的 cursor，没有更多的日志时为空
+	Next string `json:"next,omitempty"`
+}
+
+// SearchLogHandler 查询日志
+//
+// 参数：
+// from, to 日期范围（默认为今天），date 同时设置 from 和 to；
+// level 最小级别；field.<key>=<value> 键值过滤；q 关键字（不区分大小写）；regex 正则匹配文本；
+// limit 每页数量，cursor 上一页返回的 next；tail=N 返回最后 N 条；
+// format=json（默认）返回 json，format=text 返回日志原文，下一页的 cursor 在响应头 X-Log-Cursor 中
+func SearchLogHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	today := time.Now().Format(logDateFormat)
+	from, to := query.Get("from"), query.Get("to")
+	if date := query.Get("date"); date != "" {
+		from, to = date, date
+	}
+	if to == "" {
+		to = today
+	}
+	if from == "" {
+		from = to
+	}
+	fromDay, err1 := time.Parse(logDateFormat, from)
+	toDay, err2 := time.Parse(logDateFormat, to)
+	if err1 != nil || err2 != nil || toDay.Before(fromDay) || toDay.Sub(fromDay) > maxSearchDays*24*time.Hour {
+		http.Error(w, RequestParamError, http.StatusBadRequest)
+		return
+	}
+	q := &logQuery{fields: make(map[string]string), keyword: strings.ToLower(query.Get("q"))}
+	var err error
+	if q.level, err = ParseLevel(query.Get("level")); err != nil {
+		http.Error(w, RequestParamError, http.StatusBadRequest)
+		return
+	}
+	if query.Get("level") == "" {
+		q.level = LevelDebug
+	}
+	if expr := query.Get("regex"); expr != "" {
+		if q.pattern, err = regexp.Compile(expr); err != nil {
+			http.Error(w, RequestParamError, http.StatusBadRequest)
+			return
+		}
+	}
+	for key, values := range query {
+		if strings.HasPrefix(key, "field.") && len(values) > 0 {
+			q.fields[strings.TrimPrefix(key, "field.")] = values[0]
+		}
+	}
+	limit := defaultSearchLimit
+	if raw := query.Get("limit"); raw != "" {
+		if limit, err = strconv.Atoi(raw); err != nil || limit <= 0 {
+			http.Error(w, RequestParamError, http.StatusBadRequest)
+			return
+		}
+	}
+	tail := 0
+	if raw := query.Get("tail"); raw != "" {
+		if tail, err = strconv.Atoi(raw); err != nil || tail <= 0 {
+			http.Error(w, RequestParamError, http.StatusBadRequest)
+			return
+		}
+	}
+	if limit > maxSearchLimit {
+		limit = maxSearchLimit
+	}
+	if tail > maxSearchLimit {
+		tail = maxSearchLimit
+	}
+	var cursor logCursor
+	if raw := query.Get("cursor"); raw != "" {
+		if cursor, err = parseCursor(raw); err != nil {
+			http.Error(w, RequestParamError, http.StatusBadRequest)
+			return
+		}
+	}
+	// 错误日志单独保存
+	scopes := []string{"", "error"}
+	if q.level >= LevelError {
+		scopes = []string{"error"}
+	}
+	result := searchResult{Records: make([]*Record, 0)}
+	var last logCursor
+	err = searchDays(Service.LogsPath(), fromDay, toDay, cursor, scopes, func(rec *Record, pos logCursor) bool {
+		if !q.match(rec) {
+			return true
+		}
+		if tail > 0 {
+			// 只保留最后 tail 条
+			if len(result.Records) == tail {
+				copy(result.Records, result.Records[1:])
+				result.Records = result.Records[:tail-1]
+			}
+			result.Records = append(result.Records, rec)
+			return true
+		}
+		if len(result.Records) == limit {
+			result.Next = last.String()
+			return false
+		}
+		result.Records = append(result.Records, rec)
+		last = pos
+		return true
+	})
+	if err != nil {
+		Logger.Println(err)
+		http.Error(w, InnerServerError, http.StatusInternalServerError)
+		return
+	}
+	if query.Get("format") == "text" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if result.Next != "" {
+			w.Header().Set("X-Log-Cursor", result.Next)
+		}
+		bw := bufio.NewWriter(w)
+		for _, rec := range result.Records {
+			bw.WriteString(rec.raw)
+			bw.WriteByte('\n')
+		}
+		bw.Flush()
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(result)
+}
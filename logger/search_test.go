@@ -0,0 +1,60 @@
+package logger
+
+import (
+	"encoding/base64"
+	"reflect"
+	"testing"
+)
+
+func TestParseTextLine(t *testing.T) {
+	cases := []struct {
+		line string
+		want map[string]interface{}
+		ok   bool
+	}{
+		{
+			`time="2020-01-02T03:04:05+08:00" level=info msg="hello \"world\"" name=haruno`,
+			map[string]interface{}{
+				"time":  "2020-01-02T03:04:05+08:00",
+				"level": "info",
+				"msg":   `hello "world"`,
+				"name":  "haruno",
+			},
+			true,
+		},
+		{`level=warn  msg=`, map[string]interface{}{"level": "warn", "msg": ""}, true},
+		{`msg="unterminated`, nil, false},
+		{`plain text`, nil, false},
+		{`=value`, nil, false},
+	}
+	for _, c := range cases {
+		got, ok := parseTextLine(c.line)
+		if ok != c.ok {
+			t.Errorf("parseTextLine(%q) ok = %v, want %v", c.line, ok, c.ok)
+			continue
+		}
+		if ok && !reflect.DeepEqual(got, c.want) {
+			t.Errorf("parseTextLine(%q) = %v, want %v", c.line, got, c.want)
+		}
+	}
+}
+
+func TestParseCursor(t *testing.T) {
+	c := logCursor{date: "2020-01-02", lines: [2]int{12, 3}}
+	got, err := parseCursor(c.String())
+	if err != nil || got != c {
+		t.Fatalf("parseCursor(%q) = %+v, %v, want %+v", c.String(), got, err, c)
+	}
+	invalid := []string{
+		"not base64!",
+		base64.RawURLEncoding.EncodeToString([]byte("2020-01-02|1")),
+		base64.RawURLEncoding.EncodeToString([]byte("2020-13-02|1|2")),
+		base64.RawURLEncoding.EncodeToString([]byte("2020-01-02|-1|2")),
+		base64.RawURLEncoding.EncodeToString([]byte("2020-01-02|1|x")),
+	}
+	for _, s := range invalid {
+		if _, err := parseCursor(s); err == nil {
+			t.Errorf("parseCursor(%q) should fail", s)
+		}
+	}
+}